@@ -1,22 +1,66 @@
 package config
 
 type InferenceConfig struct {
-	APIVersion string   `yaml:"apiVersion"`
-	Debug      bool     `yaml:"debug"`
-	Runtime    string   `yaml:"runtime"`
-	Backends   []string `yaml:"backends"`
-	Models     []Model  `yaml:"models"`
-	Config     string   `yaml:"config"`
+	APIVersion         string            `yaml:"apiVersion"`
+	Debug              bool              `yaml:"debug"`
+	Runtime            string            `yaml:"runtime"`
+	Backends           []string          `yaml:"backends"`
+	BackendCPUFallback bool              `yaml:"backendCPUFallback"`
+	Models             []Model           `yaml:"models"`
+	ModelsPath         string            `yaml:"modelsPath"`
+	ModelSubdirs       bool              `yaml:"modelSubdirs"`
+	WriteLockfile      bool              `yaml:"writeLockfile"`
+	Config             string            `yaml:"config"`
+	HTTPDownloader     string            `yaml:"httpDownloader"`
+	HTTPAuth           bool              `yaml:"httpAuth"`
+	NetworkTimeout     int               `yaml:"networkTimeout"`
+	Retries            int               `yaml:"retries"`
+	DownloadTimeout    int               `yaml:"downloadTimeout"`
+	OCIConcurrency     int               `yaml:"ociConcurrency"`
+	InsecureRegistries []string          `yaml:"insecureRegistries"`
+	Offline            bool              `yaml:"offline"`
+	HFEndpoint         string            `yaml:"hfEndpoint"`
+	LocalAIVersion     string            `yaml:"localAIVersion"`
+	LocalAIRegistry    string            `yaml:"localAIRegistry"`
+	BackendRegistry    string            `yaml:"backendRegistry"`
+	BackendRegistries  map[string]string `yaml:"backendRegistries"`
+	LocalAISHA256      map[string]string `yaml:"localAISHA256"`
+	Labels             map[string]string `yaml:"labels"`
+	Env                map[string]string `yaml:"env"`
+	Ports              []string          `yaml:"ports"`
+	Entrypoint         []string          `yaml:"entrypoint"`
+	Cmd                []string          `yaml:"cmd"`
+	Healthcheck        *Healthcheck      `yaml:"healthcheck"`
+}
+
+// Healthcheck is an HTTP healthcheck of the inference image. Durations are in seconds and
+// zero values keep the defaults of the container runtime.
+type Healthcheck struct {
+	Path        string `yaml:"path"`
+	Port        int    `yaml:"port"`
+	Interval    int    `yaml:"interval"`
+	Timeout     int    `yaml:"timeout"`
+	StartPeriod int    `yaml:"startPeriod"`
+	Retries     int    `yaml:"retries"`
 }
 
 type Model struct {
 	Name            string           `yaml:"name"`
 	Source          string           `yaml:"source"`
 	SHA256          string           `yaml:"sha256"`
+	FileMode        string           `yaml:"fileMode"`
+	Decompress      bool             `yaml:"decompress"`
+	FetchShards     bool             `yaml:"fetchShards"`
+	WeightSelector  string           `yaml:"weightSelector"`
+	WeightMediaType string           `yaml:"weightMediaType"`
+	FetchAllWeights bool             `yaml:"fetchAllWeights"`
 	PromptTemplates []PromptTemplate `yaml:"promptTemplates"`
 }
 
 type PromptTemplate struct {
-	Name     string `yaml:"name"`
-	Template string `yaml:"template"`
+	Name           string `yaml:"name"`
+	Template       string `yaml:"template"`
+	TemplateSource string `yaml:"templateSource"`
+	Format         string `yaml:"format"`
+	Validate       bool   `yaml:"validate"`
 }
@@ -11,14 +11,15 @@ import (
 )
 
 const (
-	defaultBackendName    = "llama-cpp"
-	cpuLlamaCppBackend    = "cpu-llama-cpp"
-	cuda12LlamaCppBackend = "cuda12-llama-cpp"
+	defaultBackendName       = "llama-cpp"
+	cpuLlamaCppBackend       = "cpu-llama-cpp"
+	cuda12LlamaCppBackend    = "cuda12-llama-cpp"
+	intelSyclLlamaCppBackend = "intel-sycl-f16-llama-cpp"
 )
 
-// getBackendTag returns the appropriate OCI tag for the given backend and runtime.
-func getBackendTag(backend, runtime string, platform specs.Platform) string {
-	baseTag := localAIVersion
+// getBackendTag returns the appropriate OCI tag for the given backend, runtime and LocalAI version.
+func getBackendTag(backend, runtime, version string, platform specs.Platform) string {
+	baseTag := version
 
 	// Map backend names to their OCI tag equivalents
 	backendMap := map[string]string{
@@ -38,6 +39,11 @@ func getBackendTag(backend, runtime string, platform specs.Platform) string {
 		return fmt.Sprintf("%s-cpu-llama-cpp", baseTag)
 	}
 
+	// Handle Intel runtime - llama-cpp uses the SYCL build, other backends fall back to CPU
+	if runtime == utils.RuntimeIntel && platform.Architecture == utils.PlatformAMD64 && backendName == defaultBackendName {
+		return fmt.Sprintf("%s-gpu-intel-sycl-f16-llama-cpp", baseTag)
+	}
+
 	// Handle CUDA runtime
 	if runtime == utils.RuntimeNVIDIA && platform.Architecture == utils.PlatformAMD64 {
 		switch backendName {
@@ -57,6 +63,8 @@ func getBackendTag(backend, runtime string, platform specs.Platform) string {
 	switch backendName {
 	case "exllama2":
 		return fmt.Sprintf("%s-cpu-exllama2", baseTag)
+	case "diffusers":
+		return fmt.Sprintf("%s-cpu-diffusers", baseTag)
 	case "llama-cpp":
 		return fmt.Sprintf("%s-cpu-llama-cpp", baseTag)
 	default:
@@ -88,6 +96,12 @@ func getBackendName(backend, runtime string, platform specs.Platform) string {
 		return cpuLlamaCppBackend
 	}
 
+	// Handle Intel runtime - llama-cpp uses the SYCL build, other backends fall back to CPU
+	if runtime == utils.RuntimeIntel && platform.Architecture == utils.PlatformAMD64 &&
+		backend != utils.BackendExllamaV2 && backend != utils.BackendDiffusers {
+		return intelSyclLlamaCppBackend
+	}
+
 	// Handle CUDA runtime
 	if runtime == utils.RuntimeNVIDIA && platform.Architecture == utils.PlatformAMD64 {
 		switch backend {
@@ -107,6 +121,8 @@ func getBackendName(backend, runtime string, platform specs.Platform) string {
 	switch backend {
 	case utils.BackendExllamaV2:
 		return "cpu-exllama2"
+	case utils.BackendDiffusers:
+		return "cpu-diffusers"
 	case utils.BackendLlamaCpp:
 		return cpuLlamaCppBackend
 	default:
@@ -115,26 +131,42 @@ func getBackendName(backend, runtime string, platform specs.Platform) string {
 	}
 }
 
-// installBackend downloads and installs a backend from OCI registry.
-func installBackend(backend string, c *config.InferenceConfig, platform specs.Platform, s llb.State, merge llb.State) llb.State {
-	tag := getBackendTag(backend, c.Runtime, platform)
+// getBackendImage returns the OCI image reference the given backend is installed from.
+func getBackendImage(backend, version string, c *config.InferenceConfig, platform specs.Platform) string {
+	// Use Apple Silicon specific registry for arm64 platforms
+	if runtime := c.Runtime; runtime == utils.RuntimeAppleSilicon && platform.Architecture == utils.PlatformARM64 {
+		localAIVersion := "v3.4.0" // temp pin for now
+		return fmt.Sprintf("sertacacr.azurecr.io/llama-cpp:%s-vulkan", localAIVersion)
+	}
+	return fmt.Sprintf("%s:%s", getBackendRegistry(backend, c), getBackendTag(backend, c.Runtime, version, platform))
+}
+
+// getBackendRegistry returns the repository the given backend is pulled from: its entry in
+// BackendRegistries, else BackendRegistry, else the upstream LocalAI backends repository.
+func getBackendRegistry(backend string, c *config.InferenceConfig) string {
+	if registry := c.BackendRegistries[backend]; registry != "" {
+		return registry
+	}
+	if c.BackendRegistry != "" {
+		return c.BackendRegistry
+	}
+	return utils.BackendOCIRegistry
+}
 
+// installBackend downloads and installs a backend built for the given LocalAI version from OCI registry.
+// It returns the layers the backend adds on top of s (its dependencies and files). Backends
+// do not depend on each other, so the returned states can be solved concurrently.
+func installBackend(backend, version string, c *config.InferenceConfig, platform specs.Platform, s llb.State) llb.State {
 	// Install dependencies for Python-based backends
+	layers := llb.Scratch()
 	switch backend {
 	case utils.BackendExllamaV2:
-		merge = installExllamaDependencies(s, merge)
+		layers = installExllamaDependencies(s, layers)
 	case utils.BackendDiffusers:
-		merge = installDiffusersDependencies(s, merge)
+		layers = installDiffusersDependencies(s, layers)
 	}
 
-	// Use Apple Silicon specific registry for arm64 platforms
-	var ociImage string
-	if runtime := c.Runtime; runtime == utils.RuntimeAppleSilicon && platform.Architecture == utils.PlatformARM64 {
-		localAIVersion := "v3.4.0" // temp pin for now
-		ociImage = fmt.Sprintf("sertacacr.azurecr.io/llama-cpp:%s-vulkan", localAIVersion)
-	} else {
-		ociImage = fmt.Sprintf("%s:%s", utils.BackendOCIRegistry, tag)
-	}
+	ociImage := getBackendImage(backend, version, c, platform)
 
 	// Create the backends directory
 	savedState := s
@@ -168,7 +200,7 @@ func installBackend(backend string, c *config.InferenceConfig, platform specs.Pl
 	)
 
 	diff := llb.Diff(savedState, s)
-	return llb.Merge([]llb.State{merge, diff})
+	return llb.Merge([]llb.State{layers, diff})
 }
 
 // getDefaultBackends returns the default backends based on runtime if no backends are specified.
@@ -177,23 +209,27 @@ func getDefaultBackends(_ string) []string {
 }
 
 // installBackends installs all specified backends or default backends if none specified.
-func installBackends(c *config.InferenceConfig, platform specs.Platform, s llb.State, merge llb.State) llb.State {
+// Each backend is built independently from s and the results are merged once, in the
+// configured backend order, so the final layer order is deterministic.
+func installBackends(c *config.InferenceConfig, version string, platform specs.Platform, s llb.State, merge llb.State) llb.State {
 	backends := c.Backends
 	if len(backends) == 0 {
 		backends = getDefaultBackends(c.Runtime)
 	}
 
+	layers := []llb.State{merge}
 	for _, backend := range backends {
-		merge = installBackend(backend, c, platform, s, merge)
+		layers = append(layers, installBackend(backend, version, c, platform, s))
 
-		// For llama-cpp backend with CUDA runtime, also install the CPU version for fallback
-		if backend == utils.BackendLlamaCpp && c.Runtime == utils.RuntimeNVIDIA && platform.Architecture == utils.PlatformAMD64 {
+		// For llama-cpp backend with CUDA runtime, also install the CPU version for fallback,
+		// and for the other GPU backends when BackendCPUFallback is set
+		if (backend == utils.BackendLlamaCpp || c.BackendCPUFallback) && c.Runtime == utils.RuntimeNVIDIA && platform.Architecture == utils.PlatformAMD64 {
 			// Create a modified config with CPU runtime to install the CPU version
 			cpuConfig := *c
 			cpuConfig.Runtime = "cpu" // Use CPU runtime to force CPU backend installation
-			merge = installBackend(backend, &cpuConfig, platform, s, merge)
+			layers = append(layers, installBackend(backend, version, &cpuConfig, platform, s))
 		}
 	}
 
-	return merge
+	return llb.Merge(layers)
 }
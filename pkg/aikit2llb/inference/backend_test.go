@@ -1,10 +1,15 @@
 package inference
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/kaito-project/aikit/pkg/aikit/config"
 	"github.com/kaito-project/aikit/pkg/utils"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -61,6 +66,15 @@ func TestGetBackendTag(t *testing.T) {
 			},
 			want: fmt.Sprintf("%s-gpu-nvidia-cuda-12-diffusers", localAIVersion),
 		},
+		{
+			name:    "CPU diffusers",
+			backend: utils.BackendDiffusers,
+			runtime: "cpu",
+			platform: specs.Platform{
+				Architecture: utils.PlatformAMD64,
+			},
+			want: fmt.Sprintf("%s-cpu-diffusers", localAIVersion),
+		},
 		{
 			name:    "Apple Silicon always uses CPU llama-cpp",
 			backend: utils.BackendExllamaV2,
@@ -115,6 +129,33 @@ func TestGetBackendTag(t *testing.T) {
 			},
 			want: fmt.Sprintf("%s-cpu-llama-cpp", localAIVersion),
 		},
+		{
+			name:    "Intel llama-cpp uses SYCL",
+			backend: utils.BackendLlamaCpp,
+			runtime: utils.RuntimeIntel,
+			platform: specs.Platform{
+				Architecture: utils.PlatformAMD64,
+			},
+			want: fmt.Sprintf("%s-gpu-intel-sycl-f16-llama-cpp", localAIVersion),
+		},
+		{
+			name:    "Intel exllama2 falls back to CPU",
+			backend: utils.BackendExllamaV2,
+			runtime: utils.RuntimeIntel,
+			platform: specs.Platform{
+				Architecture: utils.PlatformAMD64,
+			},
+			want: fmt.Sprintf("%s-cpu-exllama2", localAIVersion),
+		},
+		{
+			name:    "Intel on ARM64 uses CPU llama-cpp",
+			backend: utils.BackendLlamaCpp,
+			runtime: utils.RuntimeIntel,
+			platform: specs.Platform{
+				Architecture: utils.PlatformARM64,
+			},
+			want: fmt.Sprintf("%s-cpu-llama-cpp", localAIVersion),
+		},
 		{
 			name:    "Empty backend with CUDA runtime defaults to CUDA llama-cpp",
 			backend: "",
@@ -128,7 +169,7 @@ func TestGetBackendTag(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := getBackendTag(tt.backend, tt.runtime, tt.platform)
+			got := getBackendTag(tt.backend, tt.runtime, localAIVersion, tt.platform)
 			if got != tt.want {
 				t.Errorf("getBackendTag() = %v, want %v", got, tt.want)
 			}
@@ -136,6 +177,71 @@ func TestGetBackendTag(t *testing.T) {
 	}
 }
 
+func TestGetBackendImage_Registry(t *testing.T) {
+	amd64 := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	arm64 := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformARM64}
+	tests := []struct {
+		name     string
+		backend  string
+		cfg      *config.InferenceConfig
+		platform specs.Platform
+		want     string
+	}{
+		{
+			name:     "default registry",
+			backend:  utils.BackendLlamaCpp,
+			cfg:      &config.InferenceConfig{},
+			platform: amd64,
+			want:     utils.BackendOCIRegistry + ":" + localAIVersion + "-cpu-llama-cpp",
+		},
+		{
+			name:     "global override",
+			backend:  utils.BackendLlamaCpp,
+			cfg:      &config.InferenceConfig{BackendRegistry: "registry.internal:5000/mirror/backends"},
+			platform: amd64,
+			want:     "registry.internal:5000/mirror/backends:" + localAIVersion + "-cpu-llama-cpp",
+		},
+		{
+			name:    "per-backend override wins",
+			backend: utils.BackendExllamaV2,
+			cfg: &config.InferenceConfig{
+				Runtime:           utils.RuntimeNVIDIA,
+				BackendRegistry:   "registry.internal/backends",
+				BackendRegistries: map[string]string{utils.BackendExllamaV2: "registry.internal/exllama"},
+			},
+			platform: amd64,
+			want:     "registry.internal/exllama:" + localAIVersion + "-gpu-nvidia-cuda-12-exllama2",
+		},
+		{
+			name:    "per-backend override for another backend",
+			backend: utils.BackendLlamaCpp,
+			cfg: &config.InferenceConfig{
+				BackendRegistries: map[string]string{utils.BackendExllamaV2: "registry.internal/exllama"},
+			},
+			platform: amd64,
+			want:     utils.BackendOCIRegistry + ":" + localAIVersion + "-cpu-llama-cpp",
+		},
+		{
+			name:    "apple silicon keeps vulkan image",
+			backend: utils.BackendLlamaCpp,
+			cfg: &config.InferenceConfig{
+				Runtime:         utils.RuntimeAppleSilicon,
+				BackendRegistry: "registry.internal/backends",
+			},
+			platform: arm64,
+			want:     "sertacacr.azurecr.io/llama-cpp:v3.4.0-vulkan",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getBackendImage(tt.backend, localAIVersion, tt.cfg, tt.platform); got != tt.want {
+				t.Errorf("getBackendImage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestGetDefaultBackends(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -271,6 +377,15 @@ func TestGetBackendName(t *testing.T) {
 			},
 			want: "cuda12-diffusers",
 		},
+		{
+			name:    "CPU diffusers",
+			backend: utils.BackendDiffusers,
+			runtime: "cpu",
+			platform: specs.Platform{
+				Architecture: utils.PlatformAMD64,
+			},
+			want: "cpu-diffusers",
+		},
 		{
 			name:    "Apple Silicon always uses cpu-llama-cpp regardless of backend",
 			backend: utils.BackendExllamaV2,
@@ -307,6 +422,33 @@ func TestGetBackendName(t *testing.T) {
 			},
 			want: "cuda12-llama-cpp",
 		},
+		{
+			name:    "Intel runtime - llama-cpp returns intel-sycl-f16-llama-cpp",
+			backend: utils.BackendLlamaCpp,
+			runtime: utils.RuntimeIntel,
+			platform: specs.Platform{
+				Architecture: utils.PlatformAMD64,
+			},
+			want: "intel-sycl-f16-llama-cpp",
+		},
+		{
+			name:    "Intel runtime - exllama2 returns cpu-exllama2",
+			backend: utils.BackendExllamaV2,
+			runtime: utils.RuntimeIntel,
+			platform: specs.Platform{
+				Architecture: utils.PlatformAMD64,
+			},
+			want: "cpu-exllama2",
+		},
+		{
+			name:    "ARM64 with Intel runtime - llama-cpp returns cpu-llama-cpp",
+			backend: utils.BackendLlamaCpp,
+			runtime: utils.RuntimeIntel,
+			platform: specs.Platform{
+				Architecture: utils.PlatformARM64,
+			},
+			want: "cpu-llama-cpp",
+		},
 		{
 			name:    "ARM64 with CPU runtime - exllama2 returns cpu-exllama2",
 			backend: utils.BackendExllamaV2,
@@ -336,3 +478,66 @@ func TestGetBackendName(t *testing.T) {
 		})
 	}
 }
+
+func TestInstallBackends_MergesAllBackends(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	for _, backends := range [][]string{
+		{utils.BackendExllamaV2, utils.BackendDiffusers, utils.BackendLlamaCpp},
+		{utils.BackendLlamaCpp, utils.BackendDiffusers, utils.BackendExllamaV2},
+	} {
+		t.Run(strings.Join(backends, ","), func(t *testing.T) {
+			c := &config.InferenceConfig{Backends: backends}
+			merged := installBackends(c, localAIVersion, platform, llb.Image(utils.UbuntuBase), llb.Image(distrolessBase))
+			def, err := merged.Marshal(context.Background())
+			if err != nil {
+				t.Fatalf("marshal failed: %v", err)
+			}
+
+			// Every backend is merged directly into the final state alongside the base merge.
+			widest := 0
+			for _, dt := range def.Def {
+				var op pb.Op
+				if err := op.UnmarshalVT(dt); err != nil {
+					t.Fatalf("unmarshal op: %v", err)
+				}
+				if op.GetMerge() != nil {
+					widest = max(widest, len(op.GetMerge().Inputs))
+				}
+			}
+			if widest != len(backends)+1 {
+				t.Errorf("expected a single merge of %d inputs, widest merge has %d", len(backends)+1, widest)
+			}
+
+			got := marshalState(t, merged)
+			for _, b := range backends {
+				dir := "/backends/" + getBackendName(b, c.Runtime, platform) + "/"
+				if !strings.Contains(got, dir) {
+					t.Errorf("expected merge to install %s into %s", b, dir)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallBackends_CPUFallback(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	backends := []string{utils.BackendExllamaV2, utils.BackendDiffusers}
+	install := func(fallback bool) string {
+		c := &config.InferenceConfig{Runtime: utils.RuntimeNVIDIA, Backends: backends, BackendCPUFallback: fallback}
+		return marshalState(t, installBackends(c, localAIVersion, platform, llb.Image(utils.UbuntuBase), llb.Image(distrolessBase)))
+	}
+
+	got := install(true)
+	for _, dir := range []string{"cuda12-exllama2", "cpu-exllama2", "cuda12-diffusers", "cpu-diffusers"} {
+		if !strings.Contains(got, "/backends/"+dir+"/") {
+			t.Errorf("expected backend directory %s with cpu fallback", dir)
+		}
+	}
+
+	got = install(false)
+	for _, dir := range []string{"cpu-exllama2", "cpu-diffusers"} {
+		if strings.Contains(got, "/backends/"+dir+"/") {
+			t.Errorf("unexpected backend directory %s without cpu fallback", dir)
+		}
+	}
+}
@@ -1,26 +1,57 @@
 package inference
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
+	"path"
+	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/kaito-project/aikit/pkg/aikit/config"
 	"github.com/kaito-project/aikit/pkg/utils"
 	"github.com/moby/buildkit/client/llb"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v2"
 )
 
 const (
 	distrolessBase = "ghcr.io/kaito-project/aikit/base:latest"
 	localAIVersion = "v3.8.0"
-	localAIRepo    = "ghcr.io/kaito-project/aikit/localai:"
+	localAIRepo    = "ghcr.io/kaito-project/aikit/localai"
 	cudaVersion    = "12-5"
+
+	// registryConfigSecret and registryTokenSecret are optional BuildKit secrets used to
+	// authenticate the LocalAI artifact pull when it is mirrored to a private registry.
+	registryConfigSecret = "registry-config"
+	registryTokenSecret  = "registry-token"
+
+	cudaKeyringURL        = "https://developer.download.nvidia.com/compute/cuda/repos/ubuntu2204/x86_64/cuda-keyring_1.1-1_all.deb"
+	cudaKeyringInstallCmd = "dpkg -i cuda-keyring_1.1-1_all.deb && rm cuda-keyring_1.1-1_all.deb"
+	cudaAptUpdateCmd      = "apt-get update && apt-get install --no-install-recommends -y ca-certificates && apt-get update"
+
+	intelOneAPIKeyURL       = "https://apt.repos.intel.com/intel-gpg-keys/GPG-PUB-KEY-INTEL-SW-PRODUCTS.PUB"
+	intelOneAPIRepoCmd      = "apt-get update && apt-get install --no-install-recommends -y ca-certificates gnupg && gpg --dearmor -o /usr/share/keyrings/oneapi-archive-keyring.gpg GPG-PUB-KEY-INTEL-SW-PRODUCTS.PUB && rm GPG-PUB-KEY-INTEL-SW-PRODUCTS.PUB && echo 'deb [signed-by=/usr/share/keyrings/oneapi-archive-keyring.gpg] https://apt.repos.intel.com/oneapi all main' > /etc/apt/sources.list.d/oneAPI.list"
+	intelOneAPIAptUpdateCmd = "apt-get update"
+	// intelOneAPIInstallCmd installs only the sycl compiler and onemkl runtimes the llama-cpp
+	// sycl backend links against, rather than the multi-GB base toolkit.
+	intelOneAPIInstallCmd = "apt-get install -y --no-install-recommends intel-oneapi-runtime-dpcpp-cpp intel-oneapi-runtime-mkl && apt-get clean"
+
+	// jinjaValidateScript fails when /template.jinja is not a syntactically valid Jinja template.
+	jinjaValidateScript = "pip install --no-cache-dir -q jinja2==3.1.4 && python3 -c 'import jinja2; jinja2.Environment().parse(open(\"/template.jinja\").read())'"
 )
 
 // Aikit2LLB converts an InferenceConfig to an LLB state.
-func Aikit2LLB(c *config.InferenceConfig, platform *specs.Platform) (llb.State, *specs.Image, error) {
+func Aikit2LLB(c *config.InferenceConfig, platform *specs.Platform) (llb.State, *dockerspec.DockerOCIImage, error) {
 	var merge, state llb.State
+	if err := ValidateInferenceConfig(c); err != nil {
+		return state, nil, err
+	}
+	if err := checkPlatformOS(platform); err != nil {
+		return state, nil, err
+	}
 	if c.Runtime == utils.RuntimeAppleSilicon {
 		state = llb.Image(utils.AppleSiliconBase, llb.Platform(*platform))
 	} else {
@@ -34,7 +65,12 @@ func Aikit2LLB(c *config.InferenceConfig, platform *specs.Platform) (llb.State,
 		return state, nil, err
 	}
 
-	state, merge, err = addLocalAI(state, merge, *platform)
+	version, err := ParseLocalAIVersion(c.LocalAIVersion)
+	if err != nil {
+		return state, nil, err
+	}
+
+	state, merge, err = addLocalAI(state, merge, *platform, getLocalAIRegistry(c), version, c.LocalAISHA256[platform.Architecture], networkTimeout(c))
 	if err != nil {
 		return state, nil, err
 	}
@@ -44,13 +80,132 @@ func Aikit2LLB(c *config.InferenceConfig, platform *specs.Platform) (llb.State,
 		state, merge = installCuda(c, state, merge)
 	}
 
+	// install oneapi if runtime is intel and architecture is amd64
+	if c.Runtime == utils.RuntimeIntel && platform.Architecture == utils.PlatformAMD64 {
+		state, merge = installIntelOneAPI(state, merge)
+	}
+
 	// install backend dependencies
-	merge = installBackends(c, *platform, state, merge)
+	merge = installBackends(c, version, *platform, state, merge)
 
 	imageCfg := NewImageConfig(c, platform)
 	return merge, imageCfg, nil
 }
 
+// PlatformState is the LLB state and image config of an inference image for one platform.
+type PlatformState struct {
+	Platform specs.Platform
+	State    llb.State
+	Image    *dockerspec.DockerOCIImage
+}
+
+// Aikit2LLBMultiPlatform converts an InferenceConfig to one LLB state and image config per
+// platform, in the order of platforms, so the caller can assemble them into an image index.
+// Each platform gets the LocalAI artifact and checksum of its own architecture.
+func Aikit2LLBMultiPlatform(c *config.InferenceConfig, platforms []*specs.Platform) ([]PlatformState, error) {
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("at least one platform is required")
+	}
+	results := make([]PlatformState, 0, len(platforms))
+	seen := make(map[string]bool, len(platforms))
+	for _, p := range platforms {
+		if p == nil {
+			return nil, fmt.Errorf("platform must not be nil")
+		}
+		platform := *p
+		key := platform.OS + "/" + platform.Architecture + "/" + platform.Variant
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate platform %s/%s", platform.OS, platform.Architecture)
+		}
+		seen[key] = true
+		state, image, err := Aikit2LLB(c, &platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert for platform %s/%s: %w", platform.OS, platform.Architecture, err)
+		}
+		results = append(results, PlatformState{Platform: platform, State: state, Image: image})
+	}
+	return results, nil
+}
+
+// modelSourceSchemes lists the URL schemes supported as model sources.
+var modelSourceSchemes = []string{"oci", "oci-layout", "http", "https", "huggingface", "gs"}
+
+// ValidateInferenceConfig checks every model source, backend name and the LocalAI config of
+// c before any LLB is generated. Sources must use a supported URL scheme or be a path in the
+// build context. All problems are returned together.
+func ValidateInferenceConfig(c *config.InferenceConfig) error {
+	var errs []error
+	for i, model := range c.Models {
+		if model.Source == "" {
+			errs = append(errs, fmt.Errorf("model %d (%s): source is required", i, model.Name))
+			continue
+		}
+		if u, err := url.ParseRequestURI(model.Source); err == nil && !slices.Contains(modelSourceSchemes, u.Scheme) {
+			errs = append(errs, fmt.Errorf("model %d (%s): unsupported URL scheme %q in %s, must be one of %s:// or a local path", i, model.Name, u.Scheme, model.Source, strings.Join(modelSourceSchemes, "://, ")))
+		}
+	}
+	backends := []string{utils.BackendLlamaCpp, utils.BackendExllamaV2, utils.BackendDiffusers}
+	for _, b := range c.Backends {
+		if !slices.Contains(backends, b) {
+			errs = append(errs, fmt.Errorf("backend %q is not supported, must be one of %s", b, strings.Join(backends, ", ")))
+		}
+	}
+	if err := validateLocalAIConfig(c.Config); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// validateLocalAIConfig checks that cfg, written verbatim to /config.yaml and passed to
+// LocalAI with --config-file, parses as YAML into a list of model configs that each have a
+// name, so mistakes fail the build instead of crashing LocalAI at startup.
+func validateLocalAIConfig(cfg string) error {
+	if strings.TrimSpace(cfg) == "" {
+		return nil
+	}
+	var doc any
+	if err := yaml.Unmarshal([]byte(cfg), &doc); err != nil {
+		return fmt.Errorf("config is not valid YAML: %w", err)
+	}
+	entries, ok := doc.([]any)
+	if !ok {
+		if _, isMap := doc.(map[any]any); isMap {
+			return fmt.Errorf("config must be a list of LocalAI model configs, got a single mapping; start each model with \"- name: <model>\"")
+		}
+		return fmt.Errorf("config must be a list of LocalAI model configs, got %T", doc)
+	}
+	var errs []error
+	for i, entry := range entries {
+		m, ok := entry.(map[any]any)
+		if !ok {
+			errs = append(errs, fmt.Errorf("config entry %d must be a mapping of model settings, got %T", i, entry))
+			continue
+		}
+		if name, _ := m["name"].(string); strings.TrimSpace(name) == "" {
+			errs = append(errs, fmt.Errorf("config entry %d has no name", i))
+		}
+		if params, ok := m["parameters"]; ok {
+			if _, isMap := params.(map[any]any); !isMap {
+				errs = append(errs, fmt.Errorf("config entry %d: parameters must be a mapping, got %T", i, params))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkPlatformOS returns an error for target operating systems other than linux. The
+// base images, apt-based runtime installs and the LocalAI artifacts are linux only, so a
+// windows target would otherwise produce an image that cannot run.
+func checkPlatformOS(platform *specs.Platform) error {
+	if platform.OS == "" || platform.OS == utils.PlatformLinux {
+		return nil
+	}
+	if platform.OS == "windows" {
+		return fmt.Errorf("unsupported OS %s: inference images are linux only, as the base images, runtime installs and LocalAI builds have no windows variant; use a linux/%s platform, e.g. under WSL2 on windows hosts", platform.OS, platform.Architecture)
+	}
+	return fmt.Errorf("unsupported OS %s: inference images are linux only", platform.OS)
+}
+
 // getBaseImage returns the base image given the InferenceConfig and platform.
 func getBaseImage(c *config.InferenceConfig, platform *specs.Platform) llb.State {
 	if len(c.Backends) > 0 {
@@ -62,104 +217,222 @@ func getBaseImage(c *config.InferenceConfig, platform *specs.Platform) llb.State
 	return llb.Image(distrolessBase, llb.Platform(*platform))
 }
 
-// copyModels copies models to the image.
+// copyModels copies models to the image. Each model is fetched into its own diff on top of s,
+// so BuildKit can download them in parallel, and the diffs are merged in model order followed
+// by the config file.
 func copyModels(c *config.InferenceConfig, base llb.State, s llb.State, platform specs.Platform) (llb.State, llb.State, error) {
-	savedState := s
+	diffs, downloads, err := modelDiffs(c, s, platform)
+	if err != nil {
+		return llb.State{}, llb.State{}, err
+	}
+
+	// record what was downloaded for every model if requested
+	if c.WriteLockfile {
+		lock, err := writeLockfile(c, downloads, s)
+		if err != nil {
+			return llb.State{}, llb.State{}, err
+		}
+		diffs = append(diffs, lock)
+	}
+
+	// create config file if defined, written verbatim so quotes, backticks and $ need no escaping
+	if c.Config != "" {
+		cfg := s.File(
+			llb.Mkdir("/configuration", 0o755, llb.WithParents(true)).
+				Mkfile("/config.yaml", 0o644, []byte(c.Config)),
+			llb.WithCustomName(fmt.Sprintf("Creating config for platform %s/%s", platform.OS, platform.Architecture)))
+		diffs = append(diffs, llb.Diff(s, cfg))
+	}
+
+	merge := llb.Merge(append([]llb.State{base}, diffs...))
+	return llb.Merge(append([]llb.State{s}, diffs...)), merge, nil
+}
+
+// modelDiffs returns, for every model of c, the diff on top of s holding the downloaded
+// model and its prompt templates, and the diff holding only the downloaded model. The diffs
+// do not depend on each other.
+func modelDiffs(c *config.InferenceConfig, s llb.State, platform specs.Platform) ([]llb.State, []llb.State, error) {
+	diffs := make([]llb.State, 0, len(c.Models))
+	downloads := make([]llb.State, 0, len(c.Models))
 	for _, model := range c.Models {
+		if c.Offline {
+			if err := checkOfflineSource(c, model); err != nil {
+				return nil, nil, err
+			}
+		}
+		mode, err := ParseModelFileMode(model.FileMode)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m := s
+		dir, name := modelDir(c, model)
 		// Check if the model source is a URL
 		if _, err := url.ParseRequestURI(model.Source); err == nil {
 			switch {
 			case strings.HasPrefix(model.Source, "oci://"):
-				s = handleOCI(model.Source, s, platform)
+				m, err = handleOCI(model.Source, modelWeightSelection(model), networkTimeout(c), downloadRetries(c), c.DownloadTimeout, c.OCIConcurrency, c.InsecureRegistries, dir, mode, m, platform)
+				if err != nil {
+					return nil, nil, err
+				}
+			case strings.HasPrefix(model.Source, "oci-layout://"):
+				m = handleOCILayout(model.Source, modelWeightSelection(model), dir, mode, m, platform)
 			case strings.HasPrefix(model.Source, "http://"), strings.HasPrefix(model.Source, "https://"):
-				s = handleHTTP(model.Source, model.Name, model.SHA256, s)
+				m = handleHTTP(model.Source, name, model.SHA256, c.HTTPDownloader, c.HTTPAuth, model.Decompress, model.FetchShards, networkTimeout(c), dir, mode, m)
 			case strings.HasPrefix(model.Source, "huggingface://"):
-				s, err = handleHuggingFace(model.Source, s)
+				m, err = handleHuggingFace(model.Source, c.HFEndpoint, networkTimeout(c), dir, mode, m)
 				if err != nil {
-					return llb.State{}, llb.State{}, err
+					return nil, nil, err
+				}
+			case strings.HasPrefix(model.Source, "gs://"):
+				m, err = handleGCS(model.Source, dir, mode, m)
+				if err != nil {
+					return nil, nil, err
 				}
 			default:
-				return llb.State{}, llb.State{}, fmt.Errorf("unsupported URL scheme: %s", model.Source)
+				return nil, nil, fmt.Errorf("unsupported URL scheme: %s", model.Source)
 			}
 		} else {
 			// Handle local paths
-			s = handleLocal(model.Source, s)
+			m = handleLocal(model.Source, dir, mode, m)
 		}
 
+		downloads = append(downloads, llb.Diff(s, m))
+
 		// create prompt templates if defined
 		for _, pt := range model.PromptTemplates {
-			if pt.Name != "" && pt.Template != "" {
-				s = s.Run(utils.Shf("echo -n \"%s\" > /models/%s.tmpl", pt.Template, pt.Name)).Root()
+			if pt.Name != "" && (pt.Template != "" || pt.TemplateSource != "") {
+				m = addPromptTemplate(pt, modelsPath(c), m)
 			}
 		}
+		diffs = append(diffs, llb.Diff(s, m))
 	}
+	return diffs, downloads, nil
+}
 
-	// create config file if defined
-	if c.Config != "" {
-		s = s.Run(utils.Shf("mkdir -p /configuration && echo -n \"%s\" > /config.yaml", c.Config),
-			llb.WithCustomName(fmt.Sprintf("Creating config for platform %s/%s", platform.OS, platform.Architecture))).Root()
+// promptTemplatePath returns where a prompt template is written in modelsDir: <name>.tmpl
+// for Go templates (the default) and <name>.jinja for Jinja templates.
+func promptTemplatePath(pt config.PromptTemplate, modelsDir string) string {
+	if pt.Format == utils.PromptTemplateFormatJinja {
+		return path.Join(modelsDir, pt.Name+".jinja")
 	}
+	return path.Join(modelsDir, pt.Name+".tmpl")
+}
 
-	diff := llb.Diff(savedState, s)
-	merge := llb.Merge([]llb.State{base, diff})
-	return s, merge, nil
+// addPromptTemplate writes a prompt template verbatim to modelsDir. Jinja templates are
+// written, when validation is requested, only after they parse with jinja2.
+func addPromptTemplate(pt config.PromptTemplate, modelsDir string, s llb.State) llb.State {
+	dest := promptTemplatePath(pt, modelsDir)
+	if pt.Format != utils.PromptTemplateFormatJinja {
+		return s.File(promptTemplateAction(pt, dest), llb.WithCustomName("Creating prompt template "+pt.Name))
+	}
+	if !pt.Validate {
+		return s.File(promptTemplateAction(pt, dest), llb.WithCustomName("Creating Jinja prompt template "+pt.Name))
+	}
+	validated := llb.Image(pythonImage).
+		File(promptTemplateAction(pt, "/template.jinja")).
+		Run(
+			utils.Sh(jinjaValidateScript),
+			llb.WithCustomName("Validating Jinja prompt template "+pt.Name),
+		).Root()
+	return s.File(
+		llb.Copy(validated, "/template.jinja", dest, &llb.CopyInfo{CreateDestPath: true}),
+		llb.WithCustomName("Creating Jinja prompt template "+pt.Name),
+	)
+}
+
+// promptTemplateAction returns the file action writing the content of pt to dest: the inline
+// template, or the file named by its templateSource, downloaded when it is an http(s) URL and
+// copied from the build context otherwise.
+func promptTemplateAction(pt config.PromptTemplate, dest string) *llb.FileAction {
+	copyInfo := &llb.CopyInfo{CreateDestPath: true, Mode: &llb.ChmodOpt{Mode: 0o644}}
+	switch {
+	case pt.TemplateSource == "":
+		return llb.Mkdir(path.Dir(dest), 0o755, llb.WithParents(true)).Mkfile(dest, 0o644, []byte(pt.Template))
+	case strings.HasPrefix(pt.TemplateSource, "http://"), strings.HasPrefix(pt.TemplateSource, "https://"):
+		return llb.Copy(llb.HTTP(pt.TemplateSource, llb.Filename("template")), "template", dest, copyInfo)
+	default:
+		return llb.Copy(llb.Local("context"), pt.TemplateSource, dest, copyInfo)
+	}
 }
 
 // installCuda installs cuda libraries and dependencies.
 func installCuda(c *config.InferenceConfig, s llb.State, merge llb.State) (llb.State, llb.State) {
-	cudaKeyringURL := "https://developer.download.nvidia.com/compute/cuda/repos/ubuntu2204/x86_64/cuda-keyring_1.1-1_all.deb"
 	cudaKeyring := llb.HTTP(cudaKeyringURL)
 	s = s.File(
 		llb.Copy(cudaKeyring, utils.FileNameFromURL(cudaKeyringURL), "/"),
 		llb.WithCustomName("Copying "+utils.FileNameFromURL(cudaKeyringURL)), //nolint: goconst
 	)
-	s = s.Run(utils.Sh("dpkg -i cuda-keyring_1.1-1_all.deb && rm cuda-keyring_1.1-1_all.deb")).Root()
+	s = s.Run(utils.Sh(cudaKeyringInstallCmd)).Root()
 
 	savedState := s
 	// running apt-get update twice due to nvidia repo
-	s = s.Run(utils.Sh("apt-get update && apt-get install --no-install-recommends -y ca-certificates && apt-get update"), llb.IgnoreCache).Root()
+	s = s.Run(utils.Sh(cudaAptUpdateCmd), llb.IgnoreCache).Root()
+
+	for _, cmd := range cudaInstallCommands(c) {
+		s = s.Run(utils.Sh(cmd)).Root()
+	}
+
+	diff := llb.Diff(savedState, s)
+	return s, llb.Merge([]llb.State{merge, diff})
+}
+
+// installIntelOneAPI installs the intel oneapi sycl and onemkl runtimes from intel's apt
+// repository, used by the llama-cpp sycl backend.
+func installIntelOneAPI(s llb.State, merge llb.State) (llb.State, llb.State) {
+	oneAPIKey := llb.HTTP(intelOneAPIKeyURL)
+	s = s.File(
+		llb.Copy(oneAPIKey, utils.FileNameFromURL(intelOneAPIKeyURL), "/"),
+		llb.WithCustomName("Copying "+utils.FileNameFromURL(intelOneAPIKeyURL)),
+	)
+	s = s.Run(utils.Sh(intelOneAPIRepoCmd)).Root()
+
+	savedState := s
+	s = s.Run(utils.Sh(intelOneAPIAptUpdateCmd), llb.IgnoreCache).Root()
+	s = s.Run(utils.Sh(intelOneAPIInstallCmd)).Root()
+
+	diff := llb.Diff(savedState, s)
+	return s, llb.Merge([]llb.State{merge, diff})
+}
+
+// cudaInstallCommands returns the apt commands that install the cuda libraries needed by the configured backends.
+func cudaInstallCommands(c *config.InferenceConfig) []string {
+	var cmds []string
 
 	// default llama.cpp backend is being used
 	if len(c.Backends) == 0 {
 		// install cuda libraries and pciutils for gpu detection
-		s = s.Run(utils.Shf("apt-get install -y --no-install-recommends pciutils libcublas-%[1]s cuda-cudart-%[1]s && apt-get clean", cudaVersion)).Root()
+		cmds = append(cmds, fmt.Sprintf("apt-get install -y --no-install-recommends pciutils libcublas-%[1]s cuda-cudart-%[1]s && apt-get clean", cudaVersion))
 		// TODO: clean up /var/lib/dpkg/status
 	}
 
 	// installing dev dependencies used for exllama
 	for b := range c.Backends {
 		if c.Backends[b] == utils.BackendExllamaV2 {
-			exllamaDeps := fmt.Sprintf("apt-get install -y --no-install-recommends cuda-cudart-dev-%[1]s cuda-crt-%[1]s libcusparse-dev-%[1]s libcublas-dev-%[1]s libcusolver-dev-%[1]s cuda-nvcc-%[1]s libcurand-dev-%[1]s && apt-get clean", cudaVersion)
-
-			s = s.Run(utils.Sh(exllamaDeps)).Root()
+			cmds = append(cmds, fmt.Sprintf("apt-get install -y --no-install-recommends cuda-cudart-dev-%[1]s cuda-crt-%[1]s libcusparse-dev-%[1]s libcublas-dev-%[1]s libcusolver-dev-%[1]s cuda-nvcc-%[1]s libcurand-dev-%[1]s && apt-get clean", cudaVersion))
 		}
 	}
-
-	diff := llb.Diff(savedState, s)
-	return s, llb.Merge([]llb.State{merge, diff})
+	return cmds
 }
 
-// addLocalAI adds the LocalAI binary to the image.
-func addLocalAI(s llb.State, merge llb.State, platform specs.Platform) (llb.State, llb.State, error) {
-	// Map architectures to OCI artifact references & internal artifact filenames
-	artifactRefs := map[string]struct {
-		Ref string
-	}{
-		utils.PlatformAMD64: {Ref: localAIRepo + localAIVersion + "-amd64"},
-		utils.PlatformARM64: {Ref: localAIRepo + localAIVersion + "-arm64"},
-	}
-
-	art, ok := artifactRefs[platform.Architecture]
-	if !ok {
-		return s, merge, fmt.Errorf("unsupported architecture %s", platform.Architecture)
+// addLocalAI adds the LocalAI binary of the given version, pulled from the registry
+// repository, to the image. When sha256 is set, the pulled binary must match it.
+// timeout bounds, in seconds, how long resolving and connecting to the registry may take.
+func addLocalAI(s llb.State, merge llb.State, platform specs.Platform, registry, version, sha256 string, timeout int) (llb.State, llb.State, error) {
+	ref, err := getLocalAIRef(platform, registry, version)
+	if err != nil {
+		return s, merge, err
 	}
 
 	savedState := s
 
-	// Use the oras CLI image to pull the artifact containing the LocalAI binary
+	// Use the oras CLI image to pull the artifact containing the LocalAI binary.
+	// Registry credentials are mounted from optional secrets so anonymous pulls keep working.
 	tooling := llb.Image(orasImage, llb.Platform(platform)).Run(
-		utils.Shf("set -e\noras pull %[1]s\nchmod +x local-ai\nchmod 755 local-ai", art.Ref),
-		llb.WithCustomName("Pulling LocalAI from OCI artifact "+art.Ref),
+		utils.Sh(localAIPullScript(ref, platform.Architecture, sha256, timeout)),
+		llb.AddSecret("/run/secrets/"+registryConfigSecret, llb.SecretID(registryConfigSecret), llb.SecretOptional),
+		llb.AddSecret("/run/secrets/"+registryTokenSecret, llb.SecretID(registryTokenSecret), llb.SecretOptional),
+		llb.WithCustomName("Pulling LocalAI from OCI artifact "+ref),
 	).Root()
 
 	// Copy the prepared binary into /usr/bin/local-ai
@@ -171,3 +444,121 @@ func addLocalAI(s llb.State, merge llb.State, platform specs.Platform) (llb.Stat
 	diff := llb.Diff(savedState, s)
 	return s, llb.Merge([]llb.State{merge, diff}), nil
 }
+
+// elfMachines maps target architectures to the e_machine field of an ELF header,
+// as printed in hex by od for the two little-endian bytes at offset 18.
+var elfMachines = map[string]string{
+	utils.PlatformAMD64: "3e00",
+	utils.PlatformARM64: "b700",
+}
+
+// localAIPullScript returns the shell script that pulls the LocalAI artifact ref with oras.
+// A docker config from the registry-config secret or an identity token from the
+// registry-token secret is passed to oras when present; otherwise the pull is anonymous.
+// The pulled binary's ELF machine type is checked against arch so a mispinned artifact
+// fails the build instead of shipping a binary that cannot run. When sha256 is set, the
+// binary is also verified against it. The registry must be reachable within timeout seconds.
+func localAIPullScript(ref, arch, sha256 string, timeout int) string {
+	return fmt.Sprintf(`set -e
+%[6]s
+auth=""
+if [ -s /run/secrets/%[2]s ]; then auth="--registry-config /run/secrets/%[2]s"; fi
+if [ -s /run/secrets/%[3]s ]; then auth="$auth --identity-token $(cat /run/secrets/%[3]s)"; fi
+oras pull $auth %[1]s
+%[7]smachine=$(od -An -tx1 -j18 -N2 local-ai | tr -d ' \n')
+if [ "$machine" != "%[5]s" ]; then
+	echo "local-ai binary architecture mismatch: expected %[4]s (ELF machine %[5]s), got $machine" >&2
+	exit 1
+fi
+chmod +x local-ai
+chmod 755 local-ai
+`, ref, registryConfigSecret, registryTokenSecret, arch, elfMachines[arch], registryPreflight(ref, "", timeout), localAIChecksumScript(sha256))
+}
+
+// localAIChecksumScript returns the shell lines verifying the pulled local-ai binary against
+// sha256, or an empty string when no digest is configured.
+func localAIChecksumScript(sha256 string) string {
+	if sha256 == "" {
+		return ""
+	}
+	return fmt.Sprintf(`if ! echo '%[1]s  local-ai' | sha256sum -c -; then
+	echo "local-ai binary checksum mismatch: expected sha256 %[1]s, got $(sha256sum local-ai | cut -d' ' -f1)" >&2
+	exit 1
+fi
+`, sha256)
+}
+
+// networkTimeout returns the connect timeout, in seconds, applied to network steps of c.
+func networkTimeout(c *config.InferenceConfig) int {
+	if c.NetworkTimeout > 0 {
+		return c.NetworkTimeout
+	}
+	return utils.DefaultNetworkTimeout
+}
+
+// localAIVersionPattern matches LocalAI release tags (v3.8.0) and commit builds (sha-1a0d06f).
+var localAIVersionPattern = regexp.MustCompile(`^(v\d+\.\d+\.\d+(-[0-9A-Za-z.]+)?|sha-[0-9a-f]{7,40})$`)
+
+// ParseLocalAIVersion returns the LocalAI version to build with for a localAIVersion setting:
+// the pinned default when empty, or version itself when it is a release tag or sha- build.
+func ParseLocalAIVersion(version string) (string, error) {
+	if version == "" {
+		return localAIVersion, nil
+	}
+	if !localAIVersionPattern.MatchString(version) {
+		return "", fmt.Errorf("invalid localAIVersion %q, must be a release tag such as %s or a commit build such as sha-1a0d06f", version, localAIVersion)
+	}
+	return version, nil
+}
+
+// modelsPath returns the directory models are copied to, /models unless overridden.
+func modelsPath(c *config.InferenceConfig) string {
+	if c.ModelsPath != "" {
+		return path.Clean(c.ModelsPath)
+	}
+	return utils.DefaultModelsPath
+}
+
+// modelDir returns the directory model is copied to and the name used for nesting HTTP
+// downloads in it. With modelSubdirs, a named model gets its own <modelsPath>/<name>
+// directory; otherwise, and for unnamed models, models share modelsPath.
+func modelDir(c *config.InferenceConfig, model config.Model) (string, string) {
+	if c.ModelSubdirs && model.Name != "" {
+		return path.Join(modelsPath(c), model.Name), ""
+	}
+	return modelsPath(c), model.Name
+}
+
+// downloadRetries returns how many times network downloads of c are attempted.
+func downloadRetries(c *config.InferenceConfig) int {
+	if c.Retries > 0 {
+		return c.Retries
+	}
+	return utils.DefaultRetries
+}
+
+// getLocalAIRegistry returns the repository the LocalAI binary is pulled from: LocalAIRegistry
+// when set, else the aikit LocalAI repository.
+func getLocalAIRegistry(c *config.InferenceConfig) string {
+	if c.LocalAIRegistry != "" {
+		return c.LocalAIRegistry
+	}
+	return localAIRepo
+}
+
+// getLocalAIRef returns the LocalAI OCI artifact reference in registry for the given platform and version.
+func getLocalAIRef(platform specs.Platform, registry, version string) (string, error) {
+	// Map architectures to OCI artifact references & internal artifact filenames
+	artifactRefs := map[string]struct {
+		Ref string
+	}{
+		utils.PlatformAMD64: {Ref: registry + ":" + version + "-amd64"},
+		utils.PlatformARM64: {Ref: registry + ":" + version + "-arm64"},
+	}
+
+	art, ok := artifactRefs[platform.Architecture]
+	if !ok {
+		return "", fmt.Errorf("unsupported architecture %s", platform.Architecture)
+	}
+	return art.Ref, nil
+}
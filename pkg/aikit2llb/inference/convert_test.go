@@ -0,0 +1,663 @@
+package inference
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/kaito-project/aikit/pkg/aikit/config"
+	"github.com/kaito-project/aikit/pkg/utils"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestLocalAIPullScript(t *testing.T) {
+	ref := localAIRepo + ":" + localAIVersion + "-amd64"
+	script := localAIPullScript(ref, utils.PlatformAMD64, "", utils.DefaultNetworkTimeout)
+	for _, s := range []string{
+		`if [ -s /run/secrets/registry-config ]; then auth="--registry-config /run/secrets/registry-config"; fi`,
+		`auth="$auth --identity-token $(cat /run/secrets/registry-token)"`,
+		"oras pull $auth " + ref,
+		"chmod 755 local-ai",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+}
+
+func TestLocalAIPullScript_VerifiesArchitecture(t *testing.T) {
+	tests := []struct {
+		arch    string
+		machine string
+	}{
+		{arch: utils.PlatformAMD64, machine: "3e00"},
+		{arch: utils.PlatformARM64, machine: "b700"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arch, func(t *testing.T) {
+			script := localAIPullScript(localAIRepo+":"+localAIVersion+"-"+tt.arch, tt.arch, "", utils.DefaultNetworkTimeout)
+			for _, s := range []string{
+				"od -An -tx1 -j18 -N2 local-ai",
+				`if [ "$machine" != "` + tt.machine + `" ]; then`,
+				"expected " + tt.arch,
+				"exit 1",
+			} {
+				if !strings.Contains(script, s) {
+					t.Errorf("expected script to contain %q, got:\n%s", s, script)
+				}
+			}
+			if strings.Index(script, "od -An") > strings.Index(script, "chmod +x local-ai") {
+				t.Errorf("expected architecture check before the binary is made executable")
+			}
+		})
+	}
+}
+
+func TestLocalAIPullScript_Checksum(t *testing.T) {
+	ref := localAIRepo + ":" + localAIVersion + "-amd64"
+	if script := localAIPullScript(ref, utils.PlatformAMD64, "", utils.DefaultNetworkTimeout); strings.Contains(script, "sha256sum") {
+		t.Errorf("expected no checksum verification without a digest, got:\n%s", script)
+	}
+
+	sha := strings.Repeat("ab", 32)
+	script := localAIPullScript(ref, utils.PlatformAMD64, sha, utils.DefaultNetworkTimeout)
+	for _, s := range []string{
+		"echo '" + sha + "  local-ai' | sha256sum -c -",
+		"local-ai binary checksum mismatch: expected sha256 " + sha,
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+	if i := strings.Index(script, "sha256sum -c"); i < strings.Index(script, "oras pull") || i > strings.Index(script, "chmod +x local-ai") {
+		t.Errorf("expected checksum verification between the pull and chmod, got:\n%s", script)
+	}
+
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("sha256sum not available")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "local-ai"), []byte("binary"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", localAIChecksumScript(sha))
+	cmd.Dir = dir
+	if err := cmd.Run(); err == nil {
+		t.Error("expected checksum verification to fail for a mismatched binary")
+	}
+	cmd = exec.Command("sh", "-c", localAIChecksumScript(fmt.Sprintf("%x", sha256.Sum256([]byte("binary")))))
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("expected checksum verification to pass for a matching binary: %v\n%s", err, out)
+	}
+}
+
+func TestAddLocalAI_RegistryAuth(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	s, _, err := addLocalAI(llb.Image(utils.UbuntuBase), llb.Scratch(), platform, localAIRepo, localAIVersion, "", utils.DefaultNetworkTimeout)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := marshalState(t, s)
+	for _, secret := range []string{registryConfigSecret, registryTokenSecret} {
+		if !strings.Contains(got, "/run/secrets/"+secret) {
+			t.Errorf("expected %s secret to be mounted for the LocalAI pull", secret)
+		}
+	}
+}
+
+func TestLocalAIPullScript_ConnectTimeout(t *testing.T) {
+	script := localAIPullScript("ghcr.io/org/local-ai:v1-amd64", utils.PlatformAMD64, "", 7)
+	if !strings.Contains(script, "--connect-timeout 7 --max-time 14 https://ghcr.io:443/v2/") {
+		t.Errorf("expected registry preflight with a 7s timeout, got:\n%s", script)
+	}
+	if strings.Index(script, "/v2/") > strings.Index(script, "oras pull") {
+		t.Errorf("expected registry preflight before oras pull")
+	}
+}
+
+func TestParseLocalAIVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{version: "", want: localAIVersion},
+		{version: "v3.9.1", want: "v3.9.1"},
+		{version: "v3.9.0-rc1", want: "v3.9.0-rc1"},
+		{version: "sha-1a0d06f", want: "sha-1a0d06f"},
+		{version: "3.9.1", wantErr: true},
+		{version: "latest", wantErr: true},
+		{version: "sha-XYZ", wantErr: true},
+		{version: "v3.9.1;rm", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := ParseLocalAIVersion(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLocalAIVersion(%q) error = %v, wantErr %v", tt.version, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLocalAIVersion(%q) = %q, want %q", tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAikit2LLB_LocalAIVersion(t *testing.T) {
+	platform := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	c := &config.InferenceConfig{LocalAIVersion: "sha-1a0d06f"}
+	s, _, err := Aikit2LLB(c, platform)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := marshalState(t, s)
+	for _, want := range []string{localAIRepo + ":sha-1a0d06f-amd64", utils.BackendOCIRegistry + ":sha-1a0d06f-cpu-llama-cpp"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected LLB to reference %s", want)
+		}
+	}
+
+	if _, _, err := Aikit2LLB(&config.InferenceConfig{LocalAIVersion: "latest"}, platform); err == nil {
+		t.Error("expected an error for an invalid LocalAI version")
+	}
+}
+
+func TestAikit2LLB_LocalAIRegistry(t *testing.T) {
+	platform := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	c := &config.InferenceConfig{LocalAIRegistry: "registry.internal:5000/mirror/localai"}
+	s, _, err := Aikit2LLB(c, platform)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := marshalState(t, s)
+	if want := "registry.internal:5000/mirror/localai:" + localAIVersion + "-amd64"; !strings.Contains(got, want) {
+		t.Errorf("expected LLB to pull LocalAI from %s", want)
+	}
+	if strings.Contains(got, localAIRepo) {
+		t.Errorf("expected the default LocalAI repository not to be used")
+	}
+
+	dockerfile, err := Aikit2Dockerfile(c, platform)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(dockerfile, "oras pull registry.internal:5000/mirror/localai:"+localAIVersion+"-amd64") {
+		t.Errorf("expected dockerfile to pull LocalAI from the mirror, got:\n%s", dockerfile)
+	}
+}
+
+func TestAikit2LLB_UnsupportedOS(t *testing.T) {
+	for _, tt := range []struct {
+		os      string
+		wantErr string
+	}{
+		{os: "windows", wantErr: "unsupported OS windows"},
+		{os: "darwin", wantErr: "unsupported OS darwin"},
+		{os: utils.PlatformLinux},
+	} {
+		t.Run(tt.os, func(t *testing.T) {
+			_, _, err := Aikit2LLB(&config.InferenceConfig{}, &specs.Platform{OS: tt.os, Architecture: utils.PlatformAMD64})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAikit2LLBMultiPlatform(t *testing.T) {
+	amd64 := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	arm64 := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformARM64}
+	c := &config.InferenceConfig{LocalAISHA256: map[string]string{
+		utils.PlatformAMD64: strings.Repeat("a", 64),
+		utils.PlatformARM64: strings.Repeat("b", 64),
+	}}
+
+	results, err := Aikit2LLBMultiPlatform(c, []*specs.Platform{amd64, arm64})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 platform states, got %d", len(results))
+	}
+	for i, tc := range []struct {
+		arch, other, sha string
+	}{
+		{utils.PlatformAMD64, utils.PlatformARM64, strings.Repeat("a", 64)},
+		{utils.PlatformARM64, utils.PlatformAMD64, strings.Repeat("b", 64)},
+	} {
+		r := results[i]
+		if r.Platform.Architecture != tc.arch || r.Image.Architecture != tc.arch {
+			t.Errorf("result %d: expected %s platform and image config, got %s and %s", i, tc.arch, r.Platform.Architecture, r.Image.Architecture)
+		}
+		got := marshalState(t, r.State)
+		if !strings.Contains(got, localAIRepo+":"+localAIVersion+"-"+tc.arch) || !strings.Contains(got, tc.sha) {
+			t.Errorf("%s: expected LocalAI artifact and checksum of %s", tc.arch, tc.arch)
+		}
+		if strings.Contains(got, localAIRepo+":"+localAIVersion+"-"+tc.other) {
+			t.Errorf("%s: unexpected LocalAI artifact of %s", tc.arch, tc.other)
+		}
+	}
+
+	if _, err := Aikit2LLBMultiPlatform(c, nil); err == nil {
+		t.Error("expected an error without platforms")
+	}
+	if _, err := Aikit2LLBMultiPlatform(c, []*specs.Platform{amd64, amd64}); err == nil {
+		t.Error("expected an error for duplicate platforms")
+	}
+}
+
+func TestValidateInferenceConfig(t *testing.T) {
+	valid := []config.Model{
+		{Name: "http", Source: "https://example.com/a.gguf"},
+		{Name: "hf", Source: "huggingface://org/repo/a.gguf"},
+		{Name: "oci", Source: "oci://ghcr.io/org/pack:v1"},
+		{Name: "layout", Source: "oci-layout:///packs/model"},
+		{Name: "gcs", Source: "gs://bucket/a.gguf"},
+		{Name: "local", Source: "models/a.gguf"},
+	}
+	if err := ValidateInferenceConfig(&config.InferenceConfig{Models: valid, Backends: []string{utils.BackendExllamaV2}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := &config.InferenceConfig{
+		Models: append(valid,
+			config.Model{Name: "s3", Source: "s3://bucket/a.gguf"},
+			config.Model{Name: "ftp", Source: "ftp://host/a.gguf"},
+			config.Model{Name: "empty"},
+		),
+		Backends: []string{"vllm"},
+	}
+	err := ValidateInferenceConfig(c)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		`model 6 (s3): unsupported URL scheme "s3"`,
+		`model 7 (ftp): unsupported URL scheme "ftp"`,
+		"model 8 (empty): source is required",
+		`backend "vllm" is not supported`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q, got: %v", want, err)
+		}
+	}
+	for _, m := range valid {
+		if strings.Contains(err.Error(), "("+m.Name+")") {
+			t.Errorf("unexpected error for valid source %s: %v", m.Source, err)
+		}
+	}
+
+	platform := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	if _, _, err := Aikit2LLB(c, platform); err == nil || !strings.Contains(err.Error(), "unsupported URL scheme") {
+		t.Errorf("expected Aikit2LLB to reject invalid sources before building, got %v", err)
+	}
+}
+
+func TestValidateLocalAIConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "empty", config: ""},
+		{name: "valid", config: `
+- name: llama-3.2-1b-instruct
+  backend: llama
+  parameters:
+    model: Llama-3.2-1B-Instruct.Q4_K_M.gguf
+  context_size: 8192
+- name: phi
+  parameters:
+    model: phi.gguf
+`},
+		{name: "malformed YAML", config: "- name: llama\n  parameters: [model: a.gguf\n", wantErr: "config is not valid YAML"},
+		{name: "tab indentation", config: "- name: llama\n\tbackend: llama\n", wantErr: "config is not valid YAML"},
+		{name: "single mapping", config: "name: llama\nbackend: llama\n", wantErr: "got a single mapping"},
+		{name: "scalar", config: "llama", wantErr: "must be a list of LocalAI model configs, got string"},
+		{name: "missing name", config: "- backend: llama\n", wantErr: "config entry 0 has no name"},
+		{name: "scalar entry", config: "- name: llama\n- phi\n", wantErr: "config entry 1 must be a mapping"},
+		{name: "scalar parameters", config: "- name: llama\n  parameters: a.gguf\n", wantErr: "config entry 0: parameters must be a mapping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLocalAIConfig(tt.config)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	c := &config.InferenceConfig{
+		Models: []config.Model{{Name: "llama", Source: "https://example.com/a.gguf"}},
+		Config: "name: llama\n",
+	}
+	platform := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	if _, _, err := Aikit2LLB(c, platform); err == nil || !strings.Contains(err.Error(), "got a single mapping") {
+		t.Errorf("expected Aikit2LLB to reject a malformed config, got %v", err)
+	}
+}
+
+func TestCopyModels_PromptTemplateFormat(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	copyTemplates := func(pts ...config.PromptTemplate) string {
+		c := &config.InferenceConfig{Models: []config.Model{{Name: "m", Source: "m.gguf", PromptTemplates: pts}}}
+		s, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+		if err != nil {
+			t.Fatalf("copyModels failed: %v", err)
+		}
+		return marshalState(t, s)
+	}
+
+	def := copyTemplates(
+		config.PromptTemplate{Name: "chatGo", Template: "{{.Input}}"},
+		config.PromptTemplate{Name: "chatJinja", Template: "{{ messages }}", Format: utils.PromptTemplateFormatJinja},
+	)
+	for _, want := range []string{"/models/chatGo.tmpl", "/models/chatJinja.jinja"} {
+		if !strings.Contains(def, want) {
+			t.Errorf("expected LLB to write %s", want)
+		}
+	}
+	if strings.Contains(def, pythonImage) {
+		t.Error("expected no Jinja validation unless requested")
+	}
+
+	def = copyTemplates(config.PromptTemplate{Name: "chatJinja", Template: "{{ messages }}", Format: utils.PromptTemplateFormatJinja, Validate: true})
+	for _, want := range []string{pythonImage, "jinja2.Environment().parse", "/models/chatJinja.jinja"} {
+		if !strings.Contains(def, want) {
+			t.Errorf("expected LLB to contain %q", want)
+		}
+	}
+}
+
+func TestCopyModels_WritesFilesVerbatim(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	tmpl := "{{if eq .RoleName \"assistant\"}}{{`{\"name\": \"$1\"}`}}{{end}} \\n $HOME 'quoted'"
+	cfg := "- name: m\n  template:\n    chat: \"chat\"\n  stopwords:\n    - \"(?s)\\\\{.*\\\\}\"\n    - \"`$(id)`\"\n"
+	c := &config.InferenceConfig{
+		Models: []config.Model{{Name: "m", Source: "m.gguf", PromptTemplates: []config.PromptTemplate{{Name: "chat", Template: tmpl}}}},
+		Config: cfg,
+	}
+	s, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+	if err != nil {
+		t.Fatalf("copyModels failed: %v", err)
+	}
+	def, err := s.Marshal(context.Background())
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	files := map[string]string{}
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := op.UnmarshalVT(dt); err != nil {
+			t.Fatalf("unmarshal op: %v", err)
+		}
+		for _, a := range op.GetFile().GetActions() {
+			if mk := a.GetMkfile(); mk != nil {
+				files[mk.Path] = string(mk.Data)
+			}
+		}
+	}
+	for path, want := range map[string]string{"/models/chat.tmpl": tmpl, "/config.yaml": cfg} {
+		if got, ok := files[path]; !ok || got != want {
+			t.Errorf("expected %s to be written verbatim as %q, got %q", path, want, got)
+		}
+	}
+	if strings.Contains(marshalState(t, s), "echo -n") {
+		t.Error("expected no files to be written with echo")
+	}
+}
+
+func TestCopyModels_OCIFileMode(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	for _, source := range []string{"oci://ghcr.io/org/pack:v1", "oci-layout:///packs/llama:v1"} {
+		t.Run(source, func(t *testing.T) {
+			c := &config.InferenceConfig{Models: []config.Model{{Name: "m", Source: source, FileMode: "0644"}}}
+			s, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+			if err != nil {
+				t.Fatalf("copyModels failed: %v", err)
+			}
+			def, err := s.Marshal(context.Background())
+			if err != nil {
+				t.Fatalf("marshal failed: %v", err)
+			}
+			found := false
+			for _, dt := range def.Def {
+				var op pb.Op
+				if err := op.UnmarshalVT(dt); err != nil {
+					t.Fatalf("unmarshal op: %v", err)
+				}
+				for _, a := range op.GetFile().GetActions() {
+					if cp := a.GetCopy(); cp != nil && cp.Src == "/download" {
+						found = true
+						if cp.Mode != 0o644 {
+							t.Errorf("expected the pulled files to be copied with mode 0644, got %o", cp.Mode)
+						}
+					}
+				}
+			}
+			if !found {
+				t.Fatal("expected a copy from /download")
+			}
+		})
+	}
+}
+
+func TestInstallIntelOneAPI_CachesInstall(t *testing.T) {
+	s, _ := installIntelOneAPI(llb.Image(utils.UbuntuBase), llb.Scratch())
+	def, err := s.Marshal(context.Background())
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	ignoreCache := map[string]bool{}
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := op.UnmarshalVT(dt); err != nil {
+			t.Fatalf("unmarshal op: %v", err)
+		}
+		if e := op.GetExec(); e != nil {
+			args := e.GetMeta().GetArgs()
+			ignoreCache[args[len(args)-1]] = def.Metadata[digest.FromBytes(dt)].IgnoreCache
+		}
+	}
+	for cmd, want := range map[string]bool{intelOneAPIRepoCmd: false, intelOneAPIAptUpdateCmd: true, intelOneAPIInstallCmd: false} {
+		if got, ok := ignoreCache[cmd]; !ok || got != want {
+			t.Errorf("expected %q to run with IgnoreCache=%v, got %v (found %v)", cmd, want, got, ok)
+		}
+	}
+	if strings.Contains(intelOneAPIInstallCmd, "base-toolkit") {
+		t.Error("expected only the oneAPI runtime packages to be installed")
+	}
+}
+
+func TestCopyModels_PromptTemplateSource(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	c := &config.InferenceConfig{Models: []config.Model{{Name: "m", Source: "m.gguf", PromptTemplates: []config.PromptTemplate{
+		{Name: "inline", Template: "{{.Input}}"},
+		{Name: "local", TemplateSource: "templates/chat.tmpl"},
+		{Name: "remote", TemplateSource: "https://example.com/chat_template.jinja", Format: utils.PromptTemplateFormatJinja, Validate: true},
+	}}}}
+	s, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+	if err != nil {
+		t.Fatalf("copyModels failed: %v", err)
+	}
+	def := marshalState(t, s)
+	for _, want := range []string{
+		"/models/inline.tmpl",
+		"local://context",
+		"templates/chat.tmpl",
+		"/models/local.tmpl",
+		"https://example.com/chat_template.jinja",
+		"jinja2.Environment().parse",
+		"/models/remote.jinja",
+	} {
+		if !strings.Contains(def, want) {
+			t.Errorf("expected LLB to contain %q", want)
+		}
+	}
+
+	df, err := Aikit2Dockerfile(c, &platform)
+	if err != nil {
+		t.Fatalf("Aikit2Dockerfile failed: %v", err)
+	}
+	for _, want := range []string{
+		"COPY <<'EOF' /models/inline.tmpl",
+		"COPY --chmod=644 templates/chat.tmpl /models/local.tmpl\n",
+		"ADD --chmod=644 https://example.com/chat_template.jinja /models/remote.jinja\n",
+	} {
+		if !strings.Contains(df, want) {
+			t.Errorf("expected Dockerfile to contain %q, got:\n%s", want, df)
+		}
+	}
+}
+
+func TestCopyModels_ModelsPath(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	c := &config.InferenceConfig{
+		ModelsPath: "/data/models/",
+		Models: []config.Model{
+			{Name: "a", Source: "https://example.com/a.gguf", PromptTemplates: []config.PromptTemplate{{Name: "chat", Template: "{{.Input}}"}}},
+			{Name: "sub/b", Source: "https://example.com/b.gguf"},
+			{Name: "c", Source: "huggingface://org/repo@main/c.gguf"},
+			{Name: "d", Source: "huggingface://org/repo/d.gguf"},
+			{Name: "e", Source: "oci://ghcr.io/org/pack:v1"},
+			{Name: "f", Source: "oci://registry.ollama.ai/library/llama3:8b"},
+			{Name: "g", Source: "g.gguf"},
+		},
+	}
+	s, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+	if err != nil {
+		t.Fatalf("copyModels failed: %v", err)
+	}
+	def := marshalState(t, s)
+	for _, want := range []string{
+		"/data/models/a.gguf",
+		"/data/models/chat.tmpl",
+		"/data/models/sub/b.gguf",
+		"/data/models/c.gguf",
+		"/data/models/d.gguf",
+		"/data/models/llama3",
+	} {
+		if !strings.Contains(def, want) {
+			t.Errorf("expected LLB copy destination %q", want)
+		}
+	}
+	if got := strings.Count(def, "/models"); got != strings.Count(def, "/data/models") {
+		t.Errorf("expected every models path under /data/models, got %d of %d", strings.Count(def, "/data/models"), got)
+	}
+
+	img := NewImageConfig(c, &platform)
+	if !slices.Contains(img.Config.Cmd, "--models-path=/data/models") {
+		t.Errorf("expected LocalAI to load models from the custom path, got cmd %v", img.Config.Cmd)
+	}
+	if img := NewImageConfig(&config.InferenceConfig{}, &platform); len(img.Config.Cmd) != 0 {
+		t.Errorf("expected no models path flag by default, got cmd %v", img.Config.Cmd)
+	}
+}
+
+func TestCopyModels_ModelSubdirs(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	tests := []struct {
+		name  string
+		model config.Model
+		want  string
+	}{
+		{name: "named http", model: config.Model{Name: "llama", Source: "https://example.com/a.gguf"}, want: "/models/llama/a.gguf"},
+		{name: "nested name http", model: config.Model{Name: "org/llama", Source: "https://example.com/a.gguf"}, want: "/models/org/llama/a.gguf"},
+		{name: "unnamed http", model: config.Model{Source: "https://example.com/a.gguf"}, want: "/models/a.gguf"},
+		{name: "named huggingface", model: config.Model{Name: "llama", Source: "huggingface://org/repo/a.gguf"}, want: "/models/llama/a.gguf"},
+		{name: "named pinned huggingface", model: config.Model{Name: "llama", Source: "huggingface://org/repo@main/sub/a.gguf"}, want: "/models/llama/a.gguf"},
+		{name: "unnamed huggingface", model: config.Model{Source: "huggingface://org/repo/a.gguf"}, want: "/models/a.gguf"},
+		{name: "named local", model: config.Model{Name: "llama", Source: "a.gguf"}, want: "/models/llama/"},
+		{name: "unnamed local", model: config.Model{Source: "a.gguf"}, want: "/models/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.model.PromptTemplates = []config.PromptTemplate{{Name: "chat", Template: "{{.Input}}"}}
+			c := &config.InferenceConfig{ModelSubdirs: true, Models: []config.Model{tt.model}}
+			s, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+			if err != nil {
+				t.Fatalf("copyModels failed: %v", err)
+			}
+			def := marshalState(t, s)
+			if !strings.Contains(def, tt.want) {
+				t.Errorf("expected LLB copy destination %s", tt.want)
+			}
+			// Prompt templates stay in the models root, where LocalAI looks them up
+			if !strings.Contains(def, "/models/chat.tmpl") {
+				t.Error("expected the prompt template in /models")
+			}
+		})
+	}
+
+	// Without modelSubdirs, only a slash in the name nests HTTP downloads
+	c := &config.InferenceConfig{Models: []config.Model{{Name: "llama", Source: "https://example.com/a.gguf"}}}
+	s, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+	if err != nil {
+		t.Fatalf("copyModels failed: %v", err)
+	}
+	if def := marshalState(t, s); !strings.Contains(def, "/models/a.gguf") || strings.Contains(def, "/models/llama/") {
+		t.Error("expected the model directly in /models without modelSubdirs")
+	}
+}
+
+func TestCopyModels_IndependentDiffs(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	urls := []string{
+		"https://example.com/a.gguf",
+		"https://example.com/b.gguf",
+		"https://example.com/c.gguf",
+	}
+	c := &config.InferenceConfig{Config: "- name: a"}
+	for _, u := range urls {
+		c.Models = append(c.Models, config.Model{Name: utils.FileNameFromURL(u), Source: u})
+	}
+
+	diffs, _, err := modelDiffs(c, llb.Image(utils.UbuntuBase), platform)
+	if err != nil {
+		t.Fatalf("modelDiffs failed: %v", err)
+	}
+	if len(diffs) != len(urls) {
+		t.Fatalf("expected %d diffs, got %d", len(urls), len(diffs))
+	}
+	for i, d := range diffs {
+		def := marshalState(t, d)
+		for j, u := range urls {
+			if got := strings.Contains(def, u); got != (i == j) {
+				t.Errorf("diff %d: references %s = %v, want %v", i, u, got, i == j)
+			}
+		}
+	}
+
+	_, merge, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+	if err != nil {
+		t.Fatalf("copyModels failed: %v", err)
+	}
+	def := marshalState(t, merge)
+	for _, want := range append(urls, "/config.yaml") {
+		if !strings.Contains(def, want) {
+			t.Errorf("expected merged LLB to contain %q", want)
+		}
+	}
+}
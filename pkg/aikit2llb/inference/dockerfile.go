@@ -0,0 +1,294 @@
+package inference
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kaito-project/aikit/pkg/aikit/config"
+	"github.com/kaito-project/aikit/pkg/utils"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Aikit2Dockerfile renders a best-effort Dockerfile equivalent of the LLB graph
+// produced by Aikit2LLB. It is meant for transparency and debugging; the output
+// mirrors the build steps (base image, model copies, LocalAI, cuda, backends)
+// but is not guaranteed to produce a byte-identical image.
+func Aikit2Dockerfile(c *config.InferenceConfig, platform *specs.Platform) (string, error) {
+	var b strings.Builder
+	b.WriteString("# syntax=docker/dockerfile:1\n")
+	b.WriteString("# Approximate Dockerfile generated by aikit for transparency; not used by the build.\n\n")
+
+	version, err := ParseLocalAIVersion(c.LocalAIVersion)
+	if err != nil {
+		return "", err
+	}
+	localAIRef, err := getLocalAIRef(*platform, getLocalAIRegistry(c), version)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&b, "FROM %s AS localai\n", orasImage)
+	checksum := ""
+	if sha256 := c.LocalAISHA256[platform.Architecture]; sha256 != "" {
+		checksum = fmt.Sprintf(" && echo '%s  local-ai' | sha256sum -c -", sha256)
+	}
+	fmt.Fprintf(&b, "RUN oras pull %s%s && chmod 755 local-ai\n\n", localAIRef, checksum)
+
+	// OCI, OCI layout and GCS model sources are pulled in their own stages and copied into the final image
+	stages := map[int]string{}
+	for i, model := range c.Models {
+		stage := fmt.Sprintf("model-%d", i)
+		switch {
+		case strings.HasPrefix(model.Source, "oci://"):
+			artifactURL := strings.TrimPrefix(model.Source, "oci://")
+			cmd := handleGenericModelPack(artifactURL, modelWeightSelection(model), networkTimeout(c), downloadRetries(c), c.DownloadTimeout, c.OCIConcurrency, c.InsecureRegistries)
+			if strings.HasPrefix(artifactURL, ollamaRegistryURL) {
+				var err error
+				if _, cmd, err = handleOllamaRegistry(artifactURL, networkTimeout(c), downloadRetries(c), c.InsecureRegistries); err != nil {
+					return "", err
+				}
+			}
+			fmt.Fprintf(&b, "FROM %s AS %s\n", orasImage, stage)
+			b.WriteString("RUN apk add --no-cache jq curl\n")
+			writeDockerfileRun(&b, cmd)
+		case strings.HasPrefix(model.Source, "oci-layout://"):
+			fmt.Fprintf(&b, "FROM %s AS %s\n", orasImage, stage)
+			b.WriteString("RUN apk add --no-cache jq\n")
+			fmt.Fprintf(&b, "RUN --mount=type=bind,target=%s,rw <<EOF\n%s\nEOF\n", ociLayoutContextDir, strings.TrimSpace(handleOCILayoutModelPack(ociLayoutRef(model.Source), modelWeightSelection(model))))
+		case strings.HasPrefix(model.Source, "gs://"):
+			_, recursive := splitGCSSource(model.Source)
+			script := gcsDownloadScript(model.Source, recursive)
+			fmt.Fprintf(&b, "FROM %s AS %s\n", gcloudImage, stage)
+			fmt.Fprintf(&b, "RUN --mount=type=secret,id=%[1]s,target=/run/secrets/%[1]s <<EOF\n%[2]s\nEOF\n", gcpCredentialsSecret, strings.TrimSpace(script))
+		case model.Decompress && (strings.HasPrefix(model.Source, "http://") || strings.HasPrefix(model.Source, "https://")):
+			// Compressed downloads are unpacked in their own stages, one per file
+			for j, u := range modelURLs(model) {
+				filename := utils.FileNameFromURL(u)
+				name, err := DecompressedName(filename)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(&b, "FROM %s AS %s\n", alpineImage, decompressStage(i, j))
+				fmt.Fprintf(&b, "ADD %s%s /in/%s\n", dockerfileChecksum(model, u), u, filename)
+				fmt.Fprintf(&b, "RUN %s\n\n", decompressScript(filename, name))
+			}
+			continue
+		default:
+			continue
+		}
+		b.WriteString("\n")
+		stages[i] = stage
+	}
+
+	base := distrolessBase
+	switch {
+	case len(c.Backends) > 0:
+		base = utils.UbuntuBase
+	case c.Runtime == utils.RuntimeAppleSilicon:
+		base = utils.AppleSiliconBase
+	}
+	fmt.Fprintf(&b, "FROM --platform=%s/%s %s\n", utils.PlatformLinux, platform.Architecture, base)
+
+	for i, model := range c.Models {
+		dir, name := modelDir(c, model)
+		chmod, err := dockerfileChmod(model.FileMode)
+		if err != nil {
+			return "", err
+		}
+		if _, err := url.ParseRequestURI(model.Source); err == nil {
+			switch {
+			case strings.HasPrefix(model.Source, "oci://"), strings.HasPrefix(model.Source, "oci-layout://"):
+				fmt.Fprintf(&b, "COPY %s--from=%s /download/ %s/\n", chmod, stages[i], dir)
+			case strings.HasPrefix(model.Source, "gs://"):
+				fmt.Fprintf(&b, "COPY %s--from=%s /out/ %s/\n", chmod, stages[i], dir)
+			case strings.HasPrefix(model.Source, "http://"), strings.HasPrefix(model.Source, "https://"):
+				for j, u := range modelURLs(model) {
+					filename := utils.FileNameFromURL(u)
+					decompressed, err := DecompressedName(filename)
+					if model.Decompress && err == nil {
+						filename = decompressed
+					}
+					modelPath := path.Join(dir, filename)
+					if strings.Contains(name, "/") {
+						modelPath = path.Join(dir, path.Dir(name), filename)
+					}
+					if model.Decompress && err == nil {
+						fmt.Fprintf(&b, "COPY %s--from=%s /out/%s %s\n", chmod, decompressStage(i, j), filename, modelPath)
+						continue
+					}
+					fmt.Fprintf(&b, "ADD %s%s%s %s\n", chmod, dockerfileChecksum(model, u), u, modelPath)
+				}
+			case strings.HasPrefix(model.Source, "huggingface://"):
+				if spec, err := ParseHuggingFaceSpec(model.Source); err == nil && spec.SubPath != "" && hasPinnedRevision(model.Source) {
+					fmt.Fprintf(&b, "ADD %s%s %s\n", chmod, huggingFaceResolveURL(spec, c.HFEndpoint), path.Join(dir, path.Base(spec.SubPath)))
+					break
+				}
+				hfURL, modelName, err := ParseHuggingFaceURL(model.Source, c.HFEndpoint)
+				if err != nil {
+					return "", err
+				}
+				fmt.Fprintf(&b, "ADD %s%s %s\n", chmod, hfURL, path.Join(dir, modelName))
+			default:
+				return "", fmt.Errorf("unsupported URL scheme: %s", model.Source)
+			}
+		} else {
+			fmt.Fprintf(&b, "COPY %s%s %s/\n", chmod, model.Source, dir)
+		}
+
+		for _, pt := range model.PromptTemplates {
+			switch {
+			case pt.Name == "":
+			case strings.HasPrefix(pt.TemplateSource, "http://"), strings.HasPrefix(pt.TemplateSource, "https://"):
+				fmt.Fprintf(&b, "ADD --chmod=644 %s %s\n", pt.TemplateSource, promptTemplatePath(pt, modelsPath(c)))
+			case pt.TemplateSource != "":
+				fmt.Fprintf(&b, "COPY --chmod=644 %s %s\n", pt.TemplateSource, promptTemplatePath(pt, modelsPath(c)))
+			case pt.Template != "":
+				writeDockerfileHeredoc(&b, promptTemplatePath(pt, modelsPath(c)), pt.Template)
+			}
+		}
+	}
+
+	if c.Config != "" {
+		writeDockerfileHeredoc(&b, "/config.yaml", c.Config)
+	}
+
+	b.WriteString("COPY --from=localai /local-ai /usr/bin/local-ai\n")
+
+	if c.Runtime == utils.RuntimeNVIDIA && platform.Architecture == utils.PlatformAMD64 {
+		fmt.Fprintf(&b, "ADD %s /\n", cudaKeyringURL)
+		fmt.Fprintf(&b, "RUN %s\n", cudaKeyringInstallCmd)
+		fmt.Fprintf(&b, "RUN %s\n", cudaAptUpdateCmd)
+		for _, cmd := range cudaInstallCommands(c) {
+			fmt.Fprintf(&b, "RUN %s\n", cmd)
+		}
+	}
+
+	if c.Runtime == utils.RuntimeIntel && platform.Architecture == utils.PlatformAMD64 {
+		fmt.Fprintf(&b, "ADD %s /\n", intelOneAPIKeyURL)
+		fmt.Fprintf(&b, "RUN %s\n", intelOneAPIRepoCmd)
+		fmt.Fprintf(&b, "RUN %s\n", intelOneAPIAptUpdateCmd)
+		fmt.Fprintf(&b, "RUN %s\n", intelOneAPIInstallCmd)
+	}
+
+	backends := c.Backends
+	if len(backends) == 0 {
+		backends = getDefaultBackends(c.Runtime)
+	}
+	for _, backend := range backends {
+		writeDockerfileBackend(&b, backend, version, c, *platform)
+		// mirror installBackends: CPU fallback for llama-cpp, and for other GPU backends when requested
+		if (backend == utils.BackendLlamaCpp || c.BackendCPUFallback) && c.Runtime == utils.RuntimeNVIDIA && platform.Architecture == utils.PlatformAMD64 {
+			cpuConfig := *c
+			cpuConfig.Runtime = "cpu"
+			writeDockerfileBackend(&b, backend, version, &cpuConfig, *platform)
+		}
+	}
+
+	img := NewImageConfig(c, platform)
+	for _, env := range img.Config.Env {
+		k, v, _ := strings.Cut(env, "=")
+		fmt.Fprintf(&b, "ENV %s=%q\n", k, v)
+	}
+	for _, p := range slices.Sorted(maps.Keys(img.Config.ExposedPorts)) {
+		fmt.Fprintf(&b, "EXPOSE %s\n", p)
+	}
+	for _, k := range slices.Sorted(maps.Keys(img.Config.Labels)) {
+		fmt.Fprintf(&b, "LABEL %q=%q\n", k, img.Config.Labels[k])
+	}
+	if hc := img.Config.Healthcheck; hc != nil {
+		b.WriteString("HEALTHCHECK")
+		for _, opt := range []struct {
+			flag  string
+			value time.Duration
+		}{{"interval", hc.Interval}, {"timeout", hc.Timeout}, {"start-period", hc.StartPeriod}} {
+			if opt.value > 0 {
+				fmt.Fprintf(&b, " --%s=%s", opt.flag, opt.value)
+			}
+		}
+		if hc.Retries > 0 {
+			fmt.Fprintf(&b, " --retries=%d", hc.Retries)
+		}
+		fmt.Fprintf(&b, " CMD %s\n", dockerfileExecForm(hc.Test[1:]))
+	}
+	fmt.Fprintf(&b, "ENTRYPOINT %s\n", dockerfileExecForm(img.Config.Entrypoint))
+	if len(img.Config.Cmd) > 0 {
+		fmt.Fprintf(&b, "CMD %s\n", dockerfileExecForm(img.Config.Cmd))
+	}
+
+	return b.String(), nil
+}
+
+// modelURLs returns the URLs downloaded for an http(s) model: every shard of a split GGUF
+// file with fetchShards, otherwise just its source.
+func modelURLs(model config.Model) []string {
+	if model.FetchShards {
+		if shards, err := GGUFShardURLs(model.Source); err == nil {
+			return shards
+		}
+	}
+	return []string{model.Source}
+}
+
+// dockerfileChecksum returns the ADD --checksum flag (with trailing space) verifying u
+// against the model's sha256, which only applies to its source URL.
+func dockerfileChecksum(model config.Model, u string) string {
+	if model.SHA256 == "" || u != model.Source {
+		return ""
+	}
+	return "--checksum=sha256:" + model.SHA256 + " "
+}
+
+// decompressStage returns the name of the stage decompressing the j-th download of model i.
+func decompressStage(i, j int) string {
+	return fmt.Sprintf("model-%d-decompress-%d", i, j)
+}
+
+// writeDockerfileBackend writes the steps that install a single backend.
+func writeDockerfileBackend(b *strings.Builder, backend, version string, c *config.InferenceConfig, platform specs.Platform) {
+	switch backend {
+	case utils.BackendExllamaV2:
+		fmt.Fprintf(b, "RUN %s\n", exllamaDepsCmd)
+	case utils.BackendDiffusers:
+		fmt.Fprintf(b, "RUN %s\n", pythonBaseDepsCmd)
+	}
+	backendDir := fmt.Sprintf("/backends/%s", getBackendName(backend, c.Runtime, platform))
+	fmt.Fprintf(b, "COPY --from=%s / %s/\n", getBackendImage(backend, version, c, platform), backendDir)
+}
+
+// writeDockerfileRun writes a RUN instruction, using a heredoc for multi-line scripts.
+func writeDockerfileRun(b *strings.Builder, cmd string) {
+	cmd = strings.TrimSpace(cmd)
+	if !strings.Contains(cmd, "\n") {
+		fmt.Fprintf(b, "RUN %s\n", cmd)
+		return
+	}
+	fmt.Fprintf(b, "RUN <<EOF\n%s\nEOF\n", cmd)
+}
+
+// writeDockerfileHeredoc writes a COPY instruction creating dest with the given inline content.
+func writeDockerfileHeredoc(b *strings.Builder, dest, content string) {
+	fmt.Fprintf(b, "COPY <<'EOF' %s\n%s\nEOF\n", dest, strings.TrimPrefix(content, "\n"))
+}
+
+// dockerfileChmod returns the --chmod flag (with trailing space) for a model's fileMode,
+// or an empty string when source modes are preserved.
+func dockerfileChmod(fileMode string) (string, error) {
+	mode, err := ParseModelFileMode(fileMode)
+	if err != nil || mode == nil {
+		return "", err
+	}
+	return fmt.Sprintf("--chmod=%o ", mode.Mode), nil
+}
+
+// dockerfileExecForm renders args in Dockerfile JSON exec form.
+func dockerfileExecForm(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = fmt.Sprintf("%q", a)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -0,0 +1,171 @@
+package inference
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kaito-project/aikit/pkg/aikit/config"
+	"github.com/kaito-project/aikit/pkg/utils"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestAikit2Dockerfile(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         *config.InferenceConfig
+		platform    specs.Platform
+		mustContain []string
+	}{
+		{
+			name: "default llama-cpp with http model",
+			cfg: &config.InferenceConfig{
+				Models: []config.Model{
+					{
+						Name:   "llama",
+						Source: "https://example.com/llama.gguf",
+						SHA256: "abc123",
+					},
+				},
+			},
+			platform: specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64},
+			mustContain: []string{
+				"FROM --platform=linux/amd64 " + distrolessBase,
+				"ADD --chmod=444 --checksum=sha256:abc123 https://example.com/llama.gguf /models/llama.gguf",
+				"oras pull " + localAIRepo + ":" + localAIVersion + "-amd64",
+				"COPY --from=localai /local-ai /usr/bin/local-ai",
+				"COPY --from=" + utils.BackendOCIRegistry + ":" + localAIVersion + "-cpu-llama-cpp / /backends/cpu-llama-cpp/",
+				`ENTRYPOINT ["local-ai"]`,
+			},
+		},
+		{
+			name: "decompressed http model",
+			cfg: &config.InferenceConfig{
+				Models: []config.Model{
+					{
+						Name:       "llama",
+						Source:     "https://example.com/llama.gguf.gz",
+						SHA256:     "abc123",
+						Decompress: true,
+					},
+				},
+			},
+			platform: specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64},
+			mustContain: []string{
+				"FROM " + alpineImage + " AS model-0-decompress-0",
+				"ADD --checksum=sha256:abc123 https://example.com/llama.gguf.gz /in/llama.gguf.gz",
+				"RUN set -e; mkdir -p /out; gzip -dc '/in/llama.gguf.gz' > '/out/llama.gguf'",
+				"COPY --chmod=444 --from=model-0-decompress-0 /out/llama.gguf /models/llama.gguf",
+			},
+		},
+		{
+			name: "oci layout model",
+			cfg: &config.InferenceConfig{
+				Models: []config.Model{
+					{
+						Name:   "pack",
+						Source: "oci-layout:///layouts/pack:v1",
+					},
+				},
+			},
+			platform: specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64},
+			mustContain: []string{
+				"FROM " + orasImage + " AS model-0",
+				"RUN --mount=type=bind,target=/context,rw <<EOF",
+				"ref=/context/layouts/pack:v1",
+				"COPY --chmod=444 --from=model-0 /download/ /models/",
+			},
+		},
+		{
+			name: "cuda exllama2 with local model and config",
+			cfg: &config.InferenceConfig{
+				Runtime:  utils.RuntimeNVIDIA,
+				Backends: []string{utils.BackendExllamaV2},
+				Models: []config.Model{
+					{
+						Name:   "model",
+						Source: "models/model.safetensors",
+						PromptTemplates: []config.PromptTemplate{
+							{Name: "chatMsg", Template: "{{.Input}}"},
+						},
+					},
+				},
+				Config: "- name: model",
+			},
+			platform: specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64},
+			mustContain: []string{
+				"FROM --platform=linux/amd64 " + utils.UbuntuBase,
+				"COPY --chmod=444 models/model.safetensors /models/",
+				"COPY <<'EOF' /models/chatMsg.tmpl",
+				"COPY <<'EOF' /config.yaml",
+				"ADD " + cudaKeyringURL,
+				"RUN " + exllamaDepsCmd,
+				"/backends/cuda12-exllama2/",
+				`CMD ["--config-file=/config.yaml"]`,
+			},
+		},
+		{
+			name: "cuda exllama2 with cpu fallback",
+			cfg: &config.InferenceConfig{
+				Runtime:            utils.RuntimeNVIDIA,
+				Backends:           []string{utils.BackendExllamaV2},
+				BackendCPUFallback: true,
+			},
+			platform: specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64},
+			mustContain: []string{
+				"/backends/cuda12-exllama2/",
+				"COPY --from=" + utils.BackendOCIRegistry + ":" + localAIVersion + "-cpu-exllama2 / /backends/cpu-exllama2/",
+			},
+		},
+		{
+			name: "oci model on arm64",
+			cfg: &config.InferenceConfig{
+				Models: []config.Model{
+					{Name: "pack", Source: "oci://ghcr.io/org/pack:latest"},
+				},
+			},
+			platform: specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformARM64},
+			mustContain: []string{
+				"FROM " + orasImage + " AS model-0",
+				"oras pull  \"$ref\"",
+				"COPY --chmod=444 --from=model-0 /download/ /models/",
+				"oras pull " + localAIRepo + ":" + localAIVersion + "-arm64",
+			},
+		},
+		{
+			name: "gcs prefix model",
+			cfg: &config.InferenceConfig{
+				Models: []config.Model{
+					{Name: "llama", Source: "gs://bucket/models/llama/", FileMode: "0644"},
+				},
+			},
+			platform: specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64},
+			mustContain: []string{
+				"FROM " + gcloudImage + " AS model-0",
+				"RUN --mount=type=secret,id=gcp-credentials,target=/run/secrets/gcp-credentials <<EOF",
+				"gcloud storage cp --recursive 'gs://bucket/models/llama/*' /out/",
+				"COPY --chmod=644 --from=model-0 /out/ /models/",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Aikit2Dockerfile(tt.cfg, &tt.platform)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, s := range tt.mustContain {
+				if !strings.Contains(got, s) {
+					t.Errorf("expected dockerfile to contain %q, got:\n%s", s, got)
+				}
+			}
+		})
+	}
+}
+
+func TestAikit2Dockerfile_UnsupportedArchitecture(t *testing.T) {
+	_, err := Aikit2Dockerfile(&config.InferenceConfig{}, &specs.Platform{OS: utils.PlatformLinux, Architecture: "s390x"})
+	if err == nil {
+		t.Fatal("expected error for unsupported architecture")
+	}
+}
@@ -4,11 +4,15 @@ package inference
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 
+	"github.com/distribution/reference"
+	"github.com/kaito-project/aikit/pkg/aikit/config"
 	"github.com/kaito-project/aikit/pkg/utils"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/opencontainers/go-digest"
@@ -17,11 +21,26 @@ import (
 
 const (
 	orasImage         = "ghcr.io/oras-project/oras:v1.2.0"
+	alpineImage       = "docker.io/library/alpine:3.20"
+	pythonImage       = "docker.io/library/python:3.12-alpine"
+	gcloudImage       = "gcr.io/google.com/cloudsdktool/google-cloud-cli:499.0.0-slim"
 	ollamaRegistryURL = "registry.ollama.ai"
+
+	// largeFileMarker is appended to download descriptions of files whose extension suggests model weights.
+	largeFileMarker = " (large)"
+
+	// gcpCredentialsSecret is the optional BuildKit secret holding a service account JSON key for gs:// sources.
+	gcpCredentialsSecret = "gcp-credentials"
 )
 
-// handleOCI handles OCI artifact downloading and processing.
-func handleOCI(source string, s llb.State, platform specs.Platform) llb.State {
+// handleOCI handles OCI artifact downloading and processing into modelsDir.
+// weights optionally picks the weight layers of a multi-variant or sharded modelpack to fetch
+// instead of every layer. timeout bounds, in seconds, how long resolving and connecting to the registry may take,
+// fetches are attempted up to retries times, each modelpack fetch for at most downloadTimeout
+// seconds when positive, and concurrency, when positive, sets the number
+// of modelpack layers pulled in parallel. insecureRegistries lists registries reached without
+// TLS verification or over plain HTTP (see registryTransport).
+func handleOCI(source string, weights weightSelection, timeout, retries, downloadTimeout, concurrency int, insecureRegistries []string, modelsDir string, mode *llb.ChmodOpt, s llb.State, platform specs.Platform) (llb.State, error) {
 	toolingImage := llb.Image(orasImage, llb.Platform(platform))
 
 	artifactURL := strings.TrimPrefix(source, "oci://")
@@ -29,99 +48,661 @@ func handleOCI(source string, s llb.State, platform specs.Platform) llb.State {
 
 	if strings.HasPrefix(artifactURL, ollamaRegistryURL) {
 		// Reuse existing specialized logic
-		modelName, orasCmd := handleOllamaRegistry(artifactURL)
+		modelName, orasCmd, err := handleOllamaRegistry(artifactURL, timeout, retries, insecureRegistries)
+		if err != nil {
+			return llb.State{}, err
+		}
 		script = fmt.Sprintf("apk add --no-cache jq curl && %s", orasCmd)
 		toolingImage = toolingImage.Run(utils.Sh(script)).Root()
-		modelPath := fmt.Sprintf("/models/%s", modelName)
+		modelPath := path.Join(modelsDir, modelName)
 		s = s.File(
-			llb.Copy(toolingImage, modelName, modelPath, createCopyOptions()...),
-			llb.WithCustomName("Copying "+artifactURL+" to "+modelPath),
+			llb.Copy(toolingImage, modelName, modelPath, createCopyOptions(mode)...),
+			llb.WithCustomName("Copying "+describeDownload(source)+" to "+modelPath),
 		)
-		return s
+		return s, nil
 	}
 
-	// Generic (ModelPack) selects the first application/vnd.cncf.model.weight.* layer.
-	orasCmd := handleGenericModelPack(artifactURL)
+	// Generic (ModelPack) pulls every layer, or only the selected weight layer.
+	orasCmd := handleGenericModelPack(artifactURL, weights, timeout, retries, downloadTimeout, concurrency, insecureRegistries)
 	script = fmt.Sprintf("apk add --no-cache jq curl && %s", orasCmd)
 	toolingImage = toolingImage.Run(utils.Sh(script)).Root()
-	// Copy all files from /download to /models
+	// Copy all files from /download to the models directory
+	s = s.File(
+		llb.Copy(toolingImage, "/download/", modelsDir+"/", &llb.CopyInfo{
+			CopyDirContentsOnly: true,
+			CreateDestPath:      true,
+			Mode:                mode,
+		}),
+		llb.WithCustomName("Copying "+describeDownload(source)+" to "+modelsDir+"/"),
+	)
+	return s, nil
+}
+
+// handleOCILayout handles modelpacks pre-staged as an OCI image layout in the build context,
+// referenced as oci-layout:///<dir>[:<tag>|@<digest>] (see ociLayoutRef). The layout is read
+// by oras directly, so no registry is contacted. The weights are copied into modelsDir with mode.
+func handleOCILayout(source string, weights weightSelection, modelsDir string, mode *llb.ChmodOpt, s llb.State, platform specs.Platform) llb.State {
+	layoutRef := ociLayoutRef(source)
+	script := "apk add --no-cache jq && " + handleOCILayoutModelPack(layoutRef, weights)
+	run := llb.Image(orasImage, llb.Platform(platform)).Run(
+		utils.Sh(script),
+		llb.AddMount(ociLayoutContextDir, llb.Local("context")),
+		llb.WithCustomName("Pulling "+source+" from OCI layout"),
+	)
 	s = s.File(
-		llb.Copy(toolingImage, "/download/", "/models/", &llb.CopyInfo{
+		llb.Copy(run.Root(), "/download/", modelsDir+"/", &llb.CopyInfo{
 			CopyDirContentsOnly: true,
 			CreateDestPath:      true,
+			Mode:                mode,
 		}),
-		llb.WithCustomName("Copying weight layer from "+artifactURL+" to /models/"),
+		llb.WithCustomName("Copying weight layer from "+source+" to "+modelsDir+"/"),
 	)
 	return s
 }
 
-// handleOllamaRegistry handles the Ollama registry specific download.
-func handleOllamaRegistry(artifactURL string) (string, string) {
-	artifactURLWithoutTag := strings.Split(artifactURL, ":")[0]
-	tag := strings.Split(artifactURL, ":")[1]
-	modelName := strings.Split(artifactURLWithoutTag, "/")[2]
-	orasCmd := fmt.Sprintf("oras blob fetch %[1]s@$(curl https://%[2]s/v2/library/%[3]s/manifests/%[4]s | jq -r '.layers[] | select(.mediaType == \"application/vnd.ollama.image.model\").digest') --output %[3]s", artifactURLWithoutTag, ollamaRegistryURL, modelName, tag)
-	return modelName, orasCmd
+// ociLayoutContextDir is where the build context is mounted when reading OCI layout sources.
+const ociLayoutContextDir = "/context"
+
+// ociLayoutRef converts an oci-layout:///<dir>[:<tag>|@<digest>] source into the reference
+// oras expects with --oci-layout. <dir> is relative to the build context root and the tag
+// defaults to latest, matching the ref name the packager writes.
+func ociLayoutRef(source string) string {
+	ref := strings.TrimPrefix(source, "oci-layout://")
+	dir, suffix := ref, ":latest"
+	if i := strings.LastIndex(ref, "@"); i != -1 {
+		dir, suffix = ref[:i], ref[i:]
+	} else if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		dir, suffix = ref[:i], ref[i:]
+	}
+	return path.Join(ociLayoutContextDir, path.Clean("/"+dir)) + suffix
+}
+
+// handleOllamaRegistry handles the Ollama registry specific download. artifactURL is
+// <host>[:<port>]/[<namespace>/]<model>[:<tag>|@<digest>]; the namespace defaults to library
+// and the tag to latest. It returns the model name and the script fetching its weights, which
+// attempts the manifest and blob fetches up to retries times. Hosts in insecureRegistries are
+// reached as described in registryTransport.
+func handleOllamaRegistry(artifactURL string, timeout, retries int, insecureRegistries []string) (string, string, error) {
+	named, err := reference.ParseNormalizedNamed(artifactURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid ollama reference %q: %w", artifactURL, err)
+	}
+	// Community models live under their owner's namespace; official ones under library
+	repo := reference.Path(named)
+	if !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	ref := "latest"
+	if digested, ok := named.(reference.Digested); ok {
+		ref = digested.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		ref = tagged.Tag()
+	}
+	host := reference.Domain(named)
+	modelName := path.Base(repo)
+	orasFlag, warning := registryTransport(host, insecureRegistries)
+	curlCmd, scheme, blobFlags := "curl", "https", ""
+	switch orasFlag {
+	case orasInsecureFlag:
+		curlCmd, blobFlags = "curl -k", " "+orasFlag
+	case orasPlainHTTPFlag:
+		scheme, blobFlags = "http", " "+orasFlag
+	}
+	orasCmd := fmt.Sprintf(`set -e
+%[7]s%[8]sdigest=$(retry %[9]s --connect-timeout %[5]d %[10]s://%[2]s/v2/%[3]s/manifests/%[4]s | jq -r '.layers[] | select(.mediaType == "application/vnd.ollama.image.model").digest')
+if [ -z "$digest" ]; then
+	echo "No model layer found in %[2]s/%[3]s:%[4]s" >&2
+	exit 1
+fi
+retry oras blob fetch%[11]s %[1]s@$digest --output %[6]s
+`, host+"/"+repo, host, repo, ref, timeout, modelName, utils.RetryFunc(retries), warning, curlCmd, scheme, blobFlags)
+	return modelName, orasCmd, nil
 }
 
 // handleGenericModelPack builds an oras command that pulls the artifact,
 // automatically using org.opencontainers.image.title for filenames.
-// For localhost registries (localhost:* or 127.0.0.1:*), uses --insecure flag with a warning.
-func handleGenericModelPack(artifactURL string) string {
-	// Determine if this is a localhost registry that may need insecure flag
-	isLocalhost := strings.HasPrefix(artifactURL, "localhost:") ||
-		strings.HasPrefix(artifactURL, "127.0.0.1:") ||
-		strings.HasPrefix(artifactURL, "::1:")
+// Loopback registries and those in insecureRegistries are reached without TLS verification or
+// over plain HTTP, with a warning (see registryTransport).
+// When weights is active, only the application/vnd.cncf.model.weight.v1.* layers it selects
+// are fetched, each blob on its own, and tar layers are extracted. The registry must be
+// reachable within timeout seconds (see registryPreflight), and each oras fetch is
+// attempted up to retries times with exponential backoff, each attempt
+// bounded to downloadTimeout seconds when positive (see utils.TimeoutFunc). concurrency,
+// when positive, sets the number of layers oras pulls in parallel.
+func handleGenericModelPack(artifactURL string, weights weightSelection, timeout, retries, downloadTimeout, concurrency int, insecureRegistries []string) string {
+	host, _, _ := strings.Cut(artifactURL, "/")
+	insecureFlag, warningMsg := registryTransport(host, insecureRegistries)
+
+	return modelPackPullScript(artifactURL, insecureFlag, warningMsg+registryPreflight(artifactURL, insecureFlag, timeout), weights, retries, downloadTimeout, concurrency)
+}
 
-	insecureFlag := ""
-	warningMsg := ""
-	if isLocalhost {
-		insecureFlag = "--insecure"
-		warningMsg = "echo '[WARNING] Using insecure connection for localhost registry' >&2\n"
+// handleOCILayoutModelPack builds the oras command that pulls a modelpack from the OCI image
+// layout referenced by layoutRef (<dir>:<tag> or <dir>@<digest>) instead of a registry, so
+// no network preflight is needed. weights behaves as in handleGenericModelPack.
+func handleOCILayoutModelPack(layoutRef string, weights weightSelection) string {
+	return modelPackPullScript(layoutRef, "--oci-layout", "", weights, 1, 0, 0)
+}
+
+// modelPackPullScript returns the shell script pulling ref with oras into /download, passing
+// orasFlags to every oras invocation and running preamble before anything is fetched.
+// Each oras invocation is attempted up to retries times, each attempt running for at most
+// downloadTimeout seconds when positive, and a positive concurrency is passed
+// to oras pull as --concurrency.
+func modelPackPullScript(ref, orasFlags, preamble string, weights weightSelection, retries, downloadTimeout, concurrency int) string {
+	timeoutFunc, timeoutPrefix := utils.TimeoutFunc(downloadTimeout)
+	preamble = timeoutFunc + utils.RetryFunc(retries) + preamble
+	pullFlags := orasFlags
+	if concurrency > 0 {
+		pullFlags = strings.TrimSpace(fmt.Sprintf("%s --concurrency %d", orasFlags, concurrency))
+	}
+	if weights.active() {
+		filter, nameCmd := weightSelectorFilter, weightLayerBasename
+		if weights.all {
+			filter, nameCmd = weightLayersFilter, weightLayerFilepath
+		}
+		mtSuffix := ""
+		if weights.mediaType != "" {
+			mtSuffix = "." + weights.mediaType
+		}
+		// A single selected layer is saved under its basename, so only the full weight set
+		// recreates aliased paths
+		aliases := ""
+		if weights.all {
+			aliases = aliasCopyScript("/tmp/layers.jsonl", ".")
+		}
+		return fmt.Sprintf(`set -e
+ref=%[1]s
+%[2]s
+mkdir -p /download
+cd /download
+echo "Selecting %[4]s from $ref" >&2
+if ! retry %[9]soras manifest fetch %[3]s "$ref" > /tmp/manifest.json 2>/tmp/oras-error.log; then
+	echo "Failed to fetch manifest from $ref" >&2
+	cat /tmp/oras-error.log >&2
+	exit 1
+fi
+jq -c --arg re %[5]s --arg mt %[7]s '%[6]s' /tmp/manifest.json > /tmp/layers.jsonl
+if [ ! -s /tmp/layers.jsonl ]; then
+	echo "No weight layer in $ref matches %[4]s" >&2
+	exit 1
+fi
+repo=%[10]s
+while read -r layer <&3; do
+	digest=$(echo "$layer" | jq -r .digest)
+	mt=$(echo "$layer" | jq -r .mediaType)
+%[8]s
+	echo "Fetching $name ($digest)" >&2
+	retry %[9]soras blob fetch %[3]s --output /tmp/layer "$repo@$digest"
+	case "$mt" in
+		*.tar) tar -xf /tmp/layer -C /download ;;
+		*.tar+gzip) tar -xzf /tmp/layer -C /download ;;
+		*.tar+zstd) apk add --no-cache zstd >/dev/null; zstd -dc /tmp/layer | tar -xf - -C /download ;;
+		*.tar+lz4) apk add --no-cache lz4 >/dev/null; lz4 -dc /tmp/layer | tar -xf - -C /download ;;
+		*) mkdir -p "$(dirname "/download/$name")"; mv /tmp/layer "/download/$name" ;;
+	esac
+	rm -f /tmp/layer
+done 3< /tmp/layers.jsonl
+%[11]secho "Downloaded files:" >&2
+ls -lh /download
+`, ref, preamble, orasFlags, utils.ShellQuote(weights.String()), utils.ShellQuote(weightSelectorPattern(weights.selector)), filter, utils.ShellQuote(mtSuffix), nameCmd, timeoutPrefix, utils.ShellQuote(refRepository(ref)), aliases)
 	}
 
-	cmd := fmt.Sprintf(`set -e
+	return fmt.Sprintf(`set -e
 ref=%[1]s
 %[2]s
 mkdir -p /download
 cd /download
 echo "Pulling artifact from $ref" >&2
-if ! oras pull %[3]s "$ref" 2>/tmp/oras-error.log; then
+if ! retry %[4]soras pull %[3]s "$ref" 2>/tmp/oras-error.log; then
 	echo "Failed to pull artifact from $ref" >&2
 	cat /tmp/oras-error.log >&2
 	exit 1
 fi
-echo "Downloaded files:" >&2
+if ! retry %[4]soras manifest fetch %[5]s "$ref" > /tmp/manifest.json 2>/tmp/oras-error.log; then
+	echo "Failed to fetch manifest from $ref" >&2
+	cat /tmp/oras-error.log >&2
+	exit 1
+fi
+%[6]secho "Downloaded files:" >&2
 ls -lh /download
-`, artifactURL, warningMsg, insecureFlag)
+`, ref, preamble, pullFlags, timeoutPrefix, orasFlags, aliasCopyScript("/tmp/manifest.json", ".layers[]"))
+}
 
-	return cmd
+// aliasCopyScript returns the shell snippet recreating the paths a modelpack stores only once:
+// the packager keeps a single layer for identical files and lists the other paths in its
+// org.cncf.model.filepath.aliases annotation. Each alias of a layer selected by filter from
+// the JSON in file is copied from the layer's downloaded file. Tar layers are skipped, since
+// their content is extracted under the paths recorded in the archive.
+func aliasCopyScript(file, filter string) string {
+	return fmt.Sprintf(`jq -r '%[2]s | select(.mediaType | test("\\.tar") | not) | (.annotations["org.cncf.model.filepath"] // .annotations["org.opencontainers.image.title"] // "") as $src | (.annotations["org.cncf.model.filepath.aliases"] // "" | split(",")[] | select(. != "")) as $alias | [$src, $alias] | @tsv' %[1]s > /tmp/aliases.tsv
+while IFS="$(printf '\t')" read -r src alias <&3; do
+	case "/$src/$alias/" in
+		*/../*|*//*) echo "Refusing to copy $src to $alias outside /download" >&2; exit 1 ;;
+	esac
+	[ -f "/download/$src" ] || continue
+	echo "Copying $src to alias $alias" >&2
+	mkdir -p "$(dirname "/download/$alias")"
+	cp "/download/$src" "/download/$alias"
+done 3< /tmp/aliases.tsv
+`, file, filter)
 }
 
-// handleHTTP handles HTTP(S) downloads.
-func handleHTTP(source, name, sha256 string, s llb.State) llb.State {
-	opts := []llb.HTTPOption{llb.Filename(utils.FileNameFromURL(source))}
-	if sha256 != "" {
-		digest := digest.NewDigestFromEncoded(digest.SHA256, sha256)
-		opts = append(opts, llb.Checksum(digest))
+// registryPreflight returns a shell snippet that fails with a clear message when the registry
+// serving ref cannot be reached within timeout seconds. oras has no connect timeout of its
+// own, so without it a pull behind broken DNS or a proxy hangs for minutes. The probe requests
+// the registry's /v2/ endpoint with curl, which honors HTTP(S)_PROXY like oras does, using
+// the transport implied by orasFlag (see registryTransport). Only failures to resolve or
+// connect fail the build; any HTTP response, including 401, means the registry is reachable.
+func registryPreflight(ref, orasFlag string, timeout int) string {
+	host, port := registryHostPort(ref)
+	scheme, curlFlags := "https", ""
+	switch orasFlag {
+	case orasInsecureFlag:
+		curlFlags = " -k"
+	case orasPlainHTTPFlag:
+		scheme = "http"
+		if port == "443" {
+			port = "80"
+		}
+	}
+	return fmt.Sprintf(`command -v curl >/dev/null 2>&1 || apk add --no-cache curl >/dev/null
+preflight=0
+curl -s%[4]s -o /dev/null --connect-timeout %[1]d --max-time %[5]d %[6]s://%[2]s:%[3]s/v2/ || preflight=$?
+case "$preflight" in
+	5|6|7|28)
+		echo "Cannot connect to registry %[2]s:%[3]s within %[1]ds, check DNS and proxy settings (HTTPS_PROXY)" >&2
+		exit 1 ;;
+esac`, timeout, host, port, curlFlags, 2*timeout, scheme)
+}
+
+const (
+	// orasInsecureFlag makes oras skip TLS certificate verification.
+	orasInsecureFlag = "--insecure"
+	// orasPlainHTTPFlag makes oras talk to the registry over plain HTTP.
+	orasPlainHTTPFlag = "--plain-http"
+)
+
+// registryTransport returns the oras flag needed to reach the registry host ([host][:port])
+// and a shell snippet warning about it. Loopback registries (localhost, 127.0.0.1 and ::1)
+// and hosts listed in insecureRegistries skip TLS verification; entries prefixed with
+// http:// are reached over plain HTTP instead. An entry without a port matches the host on
+// any port. Other hosts need no flag.
+func registryTransport(host string, insecureRegistries []string) (string, string) {
+	for _, entry := range insecureRegistries {
+		flag := orasInsecureFlag
+		if rest, ok := strings.CutPrefix(entry, "http://"); ok {
+			entry, flag = rest, orasPlainHTTPFlag
+		}
+		entry = strings.TrimSuffix(strings.TrimPrefix(entry, "https://"), "/")
+		if entry == host || entry == registryHostname(host) {
+			return flag, fmt.Sprintf("echo '[WARNING] Using insecure connection for registry %s' >&2\n", host)
+		}
 	}
+	switch registryHostname(host) {
+	case "localhost", "127.0.0.1", "::1", "[::1]":
+		return orasInsecureFlag, "echo '[WARNING] Using insecure connection for localhost registry' >&2\n"
+	}
+	return "", ""
+}
+
+// registryHostname strips the port, if any, from a registry host.
+func registryHostname(host string) string {
+	if strings.HasPrefix(host, "::1:") {
+		return "::1"
+	}
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		return host[:i]
+	}
+	return host
+}
+
+// registryHostPort returns the registry host and port serving ref, defaulting to Docker Hub
+// for references without a registry component and to port 443.
+func registryHostPort(ref string) (string, string) {
+	host, _, found := strings.Cut(ref, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return "registry-1.docker.io", "443"
+	}
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		return host[:i], host[i+1:]
+	}
+	return host, "443"
+}
+
+// weightLayersFilter is the jq program selecting every modelpack weight layer whose filepath
+// annotation (falling back to the title) matches the regular expression $re and whose media
+// type ends in $mt, one compact JSON descriptor per line.
+const weightLayersFilter = `.layers[] | select((.mediaType | startswith("application/vnd.cncf.model.weight.v1.")) and (.mediaType | endswith($mt)) and ((.annotations["org.cncf.model.filepath"] // .annotations["org.opencontainers.image.title"] // "") | test($re)))`
+
+// weightSelectorFilter is the jq program selecting only the first layer of weightLayersFilter.
+const weightSelectorFilter = `[` + weightLayersFilter + `] | first // empty`
+
+// weightLayerBasename sets $name to the base name of the selected layer's file.
+const weightLayerBasename = `	name=$(basename "$(echo "$layer" | jq -r '.annotations["org.opencontainers.image.title"] // .annotations["org.cncf.model.filepath"] // .digest')")`
+
+// weightLayerFilepath sets $name to the layer's org.cncf.model.filepath annotation, keeping
+// subdirectories so sharded weights land where the model expects them, and rejects paths
+// escaping the download directory.
+const weightLayerFilepath = `	name=$(echo "$layer" | jq -r '.annotations["org.cncf.model.filepath"] // .annotations["org.opencontainers.image.title"] // .digest')
+	case "/$name/" in
+		//*|*/../*) echo "Refusing to write weight layer outside the models directory: $name" >&2; exit 1 ;;
+	esac`
+
+// weightSelection picks the weight layers fetched from a modelpack instead of every layer.
+type weightSelection struct {
+	selector  string // filepath substring or glob, see weightSelectorPattern
+	mediaType string // packaging suffix of the layer media type, e.g. raw or tar+zstd
+	all       bool   // fetch every matching weight layer instead of the first
+}
+
+// modelWeightSelection returns the weight selection configured for model.
+func modelWeightSelection(model config.Model) weightSelection {
+	return weightSelection{selector: model.WeightSelector, mediaType: model.WeightMediaType, all: model.FetchAllWeights}
+}
+
+// active reports whether w selects weight layers rather than pulling the whole artifact.
+func (w weightSelection) active() bool {
+	return w.selector != "" || w.mediaType != "" || w.all
+}
+
+// String describes the selected layers for build logs.
+func (w weightSelection) String() string {
+	desc := "the first weight layer"
+	if w.all {
+		desc = "all weight layers"
+	}
+	if w.selector != "" {
+		desc += " matching " + w.selector
+	}
+	if w.mediaType != "" {
+		desc += " with media type *." + w.mediaType
+	}
+	return desc
+}
+
+// weightSelectorPattern converts a weight selector into a regular expression. Selectors
+// containing * or ? are globs matched against the whole filepath; anything else is a
+// plain substring match.
+func weightSelectorPattern(selector string) string {
+	if !strings.ContainsAny(selector, "*?") {
+		return regexp.QuoteMeta(selector)
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range selector {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// refRepository returns ref without its tag or digest, the repository blobs are fetched from.
+// A colon only starts the tag in the last path component, so a registry port is kept.
+func refRepository(ref string) string {
+	if i := strings.LastIndex(ref, "@"); i != -1 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// weightExtensions lists file extensions of model weights, which are typically gigabytes in size.
+var weightExtensions = []string{".gguf", ".ggml", ".safetensors", ".bin", ".pt", ".pth", ".onnx"}
+
+// describeDownload returns a human-readable description of source for build step names,
+// naming the file, where it comes from and, for weight files, a large marker so long
+// copies are recognizable in the build log.
+func describeDownload(source string) string {
+	switch {
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		name := utils.FileNameFromURL(source)
+		if u, err := url.Parse(source); err == nil && u.Host != "" {
+			name += " from " + u.Host
+		}
+		return name + sizeMarker(source)
+	case strings.HasPrefix(source, "huggingface://"):
+		spec, err := ParseHuggingFaceSpec(source)
+		if err != nil {
+			return source
+		}
+		repo := spec.Namespace + "/" + spec.Model
+		file := spec.SubPath
+		if hasPinnedRevision(source) {
+			repo += "@" + spec.Revision
+		} else if _, modelFile, err := ParseHuggingFaceURL(source, ""); err == nil {
+			file = modelFile
+		}
+		if file == "" {
+			return "Hugging Face " + repo
+		}
+		return file + " from Hugging Face " + repo + sizeMarker(file)
+	case strings.HasPrefix(source, "oci://"):
+		ref := strings.TrimPrefix(source, "oci://")
+		if strings.HasPrefix(ref, ollamaRegistryURL) {
+			return strings.TrimPrefix(ref, ollamaRegistryURL+"/") + " from Ollama registry"
+		}
+		return "modelpack " + ref
+	}
+	return source
+}
+
+// sizeMarker returns largeFileMarker when the file name of p has a weight extension.
+func sizeMarker(p string) string {
+	if u, err := url.Parse(p); err == nil {
+		p = u.Path
+	}
+	for _, ext := range weightExtensions {
+		if strings.HasSuffix(strings.ToLower(p), ext) {
+			return largeFileMarker
+		}
+	}
+	return ""
+}
 
-	m := llb.HTTP(source, opts...)
-	modelPath := "/models/" + utils.FileNameFromURL(source)
+// handleHTTP handles HTTP(S) downloads.
+// downloader selects the download implementation; utils.HTTPDownloaderAria2 uses aria2c, anything else llb.HTTP.
+// When auth is true, the file is fetched with curl using the http-auth secret instead (see HTTPAuthState),
+// connecting within timeout seconds. When decompress is true, a .gz, .zst or .xz download is
+// stored decompressed, without its compression suffix; sha256 still applies to the download.
+// When shards is true and source is one shard of a split GGUF file, every shard is downloaded
+// (see GGUFShardURLs), with sha256 applying to source only.
+func handleHTTP(source, name, sha256, downloader string, auth, decompress, shards bool, timeout int, modelsDir string, mode *llb.ChmodOpt, s llb.State) llb.State {
+	if shards {
+		if urls, err := GGUFShardURLs(source); err == nil {
+			for _, u := range urls {
+				checksum := ""
+				if u == source {
+					checksum = sha256
+				}
+				s = handleHTTP(u, name, checksum, downloader, auth, decompress, false, timeout, modelsDir, mode, s)
+			}
+			return s
+		}
+	}
+	filename := utils.FileNameFromURL(source)
+	var m llb.State
+	switch {
+	case auth:
+		m = HTTPAuthState(source, filename, sha256, timeout)
+	case downloader == utils.HTTPDownloaderAria2:
+		m = Aria2State(source, filename, sha256)
+	default:
+		opts := []llb.HTTPOption{llb.Filename(filename)}
+		if sha256 != "" {
+			digest := digest.NewDigestFromEncoded(digest.SHA256, sha256)
+			opts = append(opts, llb.Checksum(digest))
+		}
+		m = llb.HTTP(source, opts...)
+	}
+	if decompress {
+		if decompressed, err := DecompressedName(filename); err == nil {
+			m = decompressState(m, filename, decompressed)
+			filename = decompressed
+		}
+	}
+	modelPath := path.Join(modelsDir, filename)
 	if strings.Contains(name, "/") {
-		modelPath = "/models/" + path.Dir(name) + "/" + utils.FileNameFromURL(source)
+		modelPath = path.Join(modelsDir, path.Dir(name), filename)
 	}
 
 	s = s.File(
-		llb.Copy(m, utils.FileNameFromURL(source), modelPath, createCopyOptions()...),
-		llb.WithCustomName("Copying "+utils.FileNameFromURL(source)+" to "+modelPath),
+		llb.Copy(m, filename, modelPath, createCopyOptions(mode)...),
+		llb.WithCustomName("Copying "+describeDownload(source)+" to "+modelPath),
 	)
 	return s
 }
 
+// ggufShardPattern matches the file name of one shard of a split GGUF file as written by
+// llama.cpp's gguf-split, e.g. model-00001-of-00003.gguf.
+var ggufShardPattern = regexp.MustCompile(`^(.+)-(\d{5})-of-(\d{5})\.gguf$`)
+
+// GGUFShardURLs returns, in order, the URLs of every shard of the split GGUF file whose shard
+// source points to, derived by replacing the shard number in its file name. Query strings and
+// fragments are kept. It returns an error when source does not name a GGUF shard.
+func GGUFShardURLs(source string) ([]string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	dir, file := path.Split(u.Path)
+	match := ggufShardPattern.FindStringSubmatch(file)
+	if match == nil {
+		return nil, fmt.Errorf("%s is not a GGUF shard, must be named <model>-NNNNN-of-NNNNN.gguf", file)
+	}
+	index, _ := strconv.Atoi(match[2])
+	total, _ := strconv.Atoi(match[3])
+	if index < 1 || index > total {
+		return nil, fmt.Errorf("%s is not a valid GGUF shard, shard %d of %d", file, index, total)
+	}
+	urls := make([]string, 0, total)
+	for i := 1; i <= total; i++ {
+		if i == index {
+			urls = append(urls, source)
+			continue
+		}
+		shard := *u
+		shard.Path = fmt.Sprintf("%s%s-%05d-of-%s.gguf", dir, match[1], i, match[3])
+		shard.RawPath = ""
+		urls = append(urls, shard.String())
+	}
+	return urls, nil
+}
+
+// decompressCommands maps the compression suffixes supported by the decompress model option
+// to the command writing the decompressed content of a file to stdout.
+var decompressCommands = map[string]string{
+	".gz":  "gzip -dc",
+	".zst": "apk add --no-cache zstd && zstd -dc",
+	".xz":  "apk add --no-cache xz && xz -dc",
+}
+
+// DecompressedName returns filename without its .gz, .zst or .xz suffix, the name a
+// download is stored under with the decompress model option, or an error for other files.
+func DecompressedName(filename string) (string, error) {
+	ext := strings.ToLower(path.Ext(filename))
+	name := strings.TrimSuffix(filename, path.Ext(filename))
+	if _, ok := decompressCommands[ext]; !ok || name == "" {
+		return "", fmt.Errorf("cannot decompress %s, must end in .gz, .zst or .xz", filename)
+	}
+	return name, nil
+}
+
+// decompressState returns a state containing /<name>, the decompressed content of
+// /<filename> in m.
+func decompressState(m llb.State, filename, name string) llb.State {
+	run := llb.Image(alpineImage).Run(
+		utils.Sh(decompressScript(filename, name)),
+		llb.AddMount("/in", m, llb.Readonly),
+		llb.WithCustomName("Decompressing "+filename),
+	)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/out/"+name, "/"+name))
+}
+
+// decompressScript returns the shell command writing the decompressed content of
+// /in/<filename> to /out/<name>.
+func decompressScript(filename, name string) string {
+	cmd := decompressCommands[strings.ToLower(path.Ext(filename))]
+	return fmt.Sprintf("set -e; mkdir -p /out; %s %s > %s", cmd, utils.ShellQuote("/in/"+filename), utils.ShellQuote("/out/"+name))
+}
+
+// Aria2State returns a state containing source downloaded to /<filename> using a
+// multi-connection aria2c download. When sha256 is set, the file is verified after download.
+func Aria2State(source, filename, sha256 string) llb.State {
+	run := llb.Image(alpineImage).Run(
+		utils.Sh(aria2DownloadScript(source, filename, sha256)),
+		llb.WithCustomName("Downloading "+filename+" with aria2"),
+	)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/out/"+filename, "/"+filename))
+}
+
+// aria2DownloadScript returns the shell script that downloads source into /out/<filename>
+// with aria2c and optionally verifies its sha256 digest.
+func aria2DownloadScript(source, filename, sha256 string) string {
+	script := fmt.Sprintf(`set -e
+apk add --no-cache aria2
+mkdir -p /out
+aria2c -x16 -s16 --allow-overwrite=true --auto-file-renaming=false -d /out -o %[2]s %[1]s
+`, utils.ShellQuote(source), utils.ShellQuote(filename))
+	return script + sha256CheckScript(sha256, filename)
+}
+
+// HTTPAuthState returns a state containing source downloaded to /<filename> with curl,
+// sending an Authorization header read from the required http-auth secret. The secret holds
+// either a full header value ("Bearer <token>" or "Basic <base64>") or a bare token, which is
+// sent as a bearer token. When sha256 is set, the file is verified after download.
+func HTTPAuthState(source, filename, sha256 string, timeout int) llb.State {
+	run := llb.Image(alpineImage).Run(
+		utils.Sh(httpAuthDownloadScript(source, filename, sha256, timeout)),
+		llb.AddSecret("/run/secrets/http-auth", llb.SecretID("http-auth")),
+		llb.WithCustomName("Downloading "+describeDownload(source)+" with http-auth"),
+	)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/out/"+filename, "/"+filename))
+}
+
+// httpAuthDownloadScript returns the shell script that downloads source into /out/<filename>
+// with curl, authorized by the http-auth secret, and optionally verifies its sha256 digest.
+// Connecting to the host must succeed within timeout seconds.
+func httpAuthDownloadScript(source, filename, sha256 string, timeout int) string {
+	script := fmt.Sprintf(`set -e
+apk add --no-cache curl
+mkdir -p /out
+auth="$(cat /run/secrets/http-auth)"
+case "$auth" in
+Bearer\ *|Basic\ *) ;;
+*) auth="Bearer $auth" ;;
+esac
+curl -fSL --connect-timeout %[3]d -H "Authorization: $auth" -o %[2]s %[1]s
+`, utils.ShellQuote(source), utils.ShellQuote("/out/"+filename), timeout)
+	return script + sha256CheckScript(sha256, filename)
+}
+
+// sha256CheckScript returns the shell lines verifying /out/<filename> against sha256,
+// or nothing when sha256 is empty.
+func sha256CheckScript(sha256, filename string) string {
+	if sha256 == "" {
+		return ""
+	}
+	return fmt.Sprintf(`if ! printf '%%s  %%s\n' %[1]s %[2]s | sha256sum -c -; then
+	echo "sha256 mismatch for "%[3]s >&2
+	exit 1
+fi
+`, utils.ShellQuote(sha256), utils.ShellQuote("/out/"+filename), utils.ShellQuote(filename))
+}
+
 // ParseHuggingFaceURL converts a huggingface:// URL to https:// URL with optional branch support.
-func ParseHuggingFaceURL(source string) (string, string, error) {
-	baseURL := "https://huggingface.co/"
+// The branch is given either after the model as "@rev" or ":rev", or as its own path segment.
+// endpoint overrides the Hugging Face base URL (e.g. a mirror); see utils.HFEndpoint for the default.
+func ParseHuggingFaceURL(source, endpoint string) (string, string, error) {
+	baseURL := utils.HFEndpoint(endpoint) + "/"
 	modelPath := strings.TrimPrefix(source, "huggingface://")
 
 	// Split the model path to check for branch specification
@@ -135,6 +716,17 @@ func ParseHuggingFaceURL(source string) (string, string, error) {
 	model := parts[1]
 	var branch, modelFile string
 
+	if i := strings.IndexAny(model, "@:"); i >= 0 {
+		// URL includes branch after the model: "huggingface://{namespace}/{model}@{branch}/{file}"
+		model, branch = model[:i], model[i+1:]
+		filePath := strings.Join(parts[2:], "/")
+		if model == "" || branch == "" || filePath == "" || strings.HasSuffix(filePath, "/") {
+			return "", "", errors.New("invalid Hugging Face URL format")
+		}
+		fullURL := fmt.Sprintf("%s%s/%s/resolve/%s/%s", baseURL, namespace, model, branch, filePath)
+		return fullURL, path.Base(filePath), nil
+	}
+
 	if len(parts) == 4 {
 		// URL includes branch: "huggingface://{namespace}/{model}/{branch}/{file}"
 		branch = parts[2]
@@ -151,9 +743,17 @@ func ParseHuggingFaceURL(source string) (string, string, error) {
 }
 
 // handleHuggingFace handles Hugging Face model downloads with branch support.
-func handleHuggingFace(source string, s llb.State) (llb.State, error) {
+// References with an explicit revision (huggingface://org/model@rev/path/to/file) are
+// fetched as a single file from the resolve URL, using the optional hf-token secret.
+// endpoint is the Hugging Face base URL and timeout bounds, in seconds, how long resolving
+// and connecting to Hugging Face may take. The model is copied into modelsDir.
+func handleHuggingFace(source, endpoint string, timeout int, modelsDir string, mode *llb.ChmodOpt, s llb.State) (llb.State, error) {
+	if spec, err := ParseHuggingFaceSpec(source); err == nil && spec.SubPath != "" && hasPinnedRevision(source) {
+		return handleHuggingFaceFile(source, spec, endpoint, timeout, modelsDir, mode, s), nil
+	}
+
 	// Translate the Hugging Face URL, extracting the branch if provided
-	hfURL, modelName, err := ParseHuggingFaceURL(source)
+	hfURL, modelName, err := ParseHuggingFaceURL(source, endpoint)
 	if err != nil {
 		return llb.State{}, err
 	}
@@ -162,49 +762,206 @@ func handleHuggingFace(source string, s llb.State) (llb.State, error) {
 	opts := []llb.HTTPOption{llb.Filename(modelName)}
 	m := llb.HTTP(hfURL, opts...)
 
-	// Determine the model path in the /models directory
-	modelPath := fmt.Sprintf("/models/%s", modelName)
+	// Determine the model path in the models directory
+	modelPath := path.Join(modelsDir, modelName)
 
 	// Copy the downloaded file to the desired location
 	s = s.File(
-		llb.Copy(m, modelName, modelPath, createCopyOptions()...),
-		llb.WithCustomName("Copying "+modelName+" from Hugging Face to "+modelPath),
+		llb.Copy(m, modelName, modelPath, createCopyOptions(mode)...),
+		llb.WithCustomName("Copying "+describeDownload(source)+" to "+modelPath),
 	)
 	return s, nil
 }
 
-// handleLocal handles copying from local paths.
-func handleLocal(source string, s llb.State) llb.State {
+// handleHuggingFaceFile downloads a single (possibly nested) file of a Hugging Face
+// repository at a pinned revision into <modelsDir>/<basename>. spec is the parsed source.
+func handleHuggingFaceFile(source string, spec *HuggingFaceSpec, endpoint string, timeout int, modelsDir string, mode *llb.ChmodOpt, s llb.State) llb.State {
+	hfURL := huggingFaceResolveURL(spec, endpoint)
+	modelName := path.Base(spec.SubPath)
+	run := llb.Image(alpineImage).Run(
+		utils.Sh(hfFileDownloadScript(hfURL, modelName, timeout)),
+		llb.AddSecret("/run/secrets/hf-token", llb.SecretID("hf-token"), llb.SecretOptional),
+		llb.WithCustomName("Downloading "+describeDownload(source)),
+	)
+
+	modelPath := path.Join(modelsDir, modelName)
 	s = s.File(
-		llb.Copy(llb.Local("context"), source, "/models/", createCopyOptions()...),
-		llb.WithCustomName("Copying "+utils.FileNameFromURL(source)+" to /models"),
+		llb.Copy(run.Root(), "/out/"+modelName, modelPath, createCopyOptions(mode)...),
+		llb.WithCustomName("Copying "+describeDownload(source)+" to "+modelPath),
 	)
 	return s
 }
 
-// createCopyOptions returns the common llb.CopyOption used in file operations.
-func createCopyOptions() []llb.CopyOption {
-	mode := llb.ChmodOpt{
-		Mode: os.FileMode(0o444),
+// hasPinnedRevision reports whether a huggingface:// reference pins its revision with "@"
+// (huggingface://org/model@rev/...), as opposed to the legacy slash-separated branch form.
+func hasPinnedRevision(source string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(source, "huggingface://"), "/", 3)
+	return len(parts) >= 2 && strings.Contains(parts[1], "@")
+}
+
+// huggingFaceResolveURL returns the direct download URL on endpoint for the file referenced by spec.
+func huggingFaceResolveURL(spec *HuggingFaceSpec, endpoint string) string {
+	return fmt.Sprintf("%s/%s/%s/resolve/%s/%s", utils.HFEndpoint(endpoint), spec.Namespace, spec.Model, spec.Revision, spec.SubPath)
+}
+
+// hfFileDownloadScript returns a shell script that downloads hfURL into /out/<filename>,
+// sending the Hugging Face token from /run/secrets/hf-token when present. Connecting to the
+// host must succeed within timeout seconds.
+func hfFileDownloadScript(hfURL, filename string, timeout int) string {
+	return fmt.Sprintf(`set -e
+apk add --no-cache curl
+mkdir -p /out
+if [ -f /run/secrets/hf-token ]; then
+	curl -fSL --connect-timeout %[3]d -H "Authorization: Bearer $(cat /run/secrets/hf-token)" -o %[2]s %[1]s
+else
+	curl -fSL --connect-timeout %[3]d -o %[2]s %[1]s
+fi
+`, utils.ShellQuote(hfURL), utils.ShellQuote("/out/"+filename), timeout)
+}
+
+// handleGCS handles Google Cloud Storage (gs://) downloads into modelsDir.
+func handleGCS(source, modelsDir string, mode *llb.ChmodOpt, s llb.State) (llb.State, error) {
+	gcs, err := GCSState(source)
+	if err != nil {
+		return llb.State{}, err
 	}
+	s = s.File(
+		llb.Copy(gcs, "/", modelsDir+"/", &llb.CopyInfo{
+			CopyDirContentsOnly: true,
+			CreateDestPath:      true,
+			Mode:                mode,
+		}),
+		llb.WithCustomName("Copying "+source+" to "+modelsDir),
+	)
+	return s, nil
+}
+
+// GCSState returns a state containing the object or prefix referenced by a gs:// source
+// rooted at /. References ending in "/" (or naming only a bucket) download every object
+// under the prefix; anything else downloads a single object. A service account key is
+// read from the gcp-credentials secret when present; otherwise access is anonymous.
+func GCSState(source string) (llb.State, error) {
+	if !strings.HasPrefix(source, "gs://") {
+		return llb.State{}, fmt.Errorf("not a gs source: %s", source)
+	}
+	bucket, recursive := splitGCSSource(source)
+	if bucket == "" {
+		return llb.State{}, fmt.Errorf("invalid gs source %q: bucket is empty", source)
+	}
+	run := llb.Image(gcloudImage).Run(
+		utils.Sh(gcsDownloadScript(source, recursive)),
+		llb.AddSecret("/run/secrets/"+gcpCredentialsSecret, llb.SecretID(gcpCredentialsSecret), llb.SecretOptional),
+		llb.WithCustomName("Downloading "+source+" from Google Cloud Storage"),
+	)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/out/", "/", &llb.CopyInfo{CopyDirContentsOnly: true})), nil
+}
+
+// splitGCSSource returns the bucket of a gs:// source and whether it refers to a
+// prefix (trailing slash or bucket only) rather than a single object.
+func splitGCSSource(source string) (string, bool) {
+	bucket, object, _ := strings.Cut(strings.TrimPrefix(source, "gs://"), "/")
+	return bucket, object == "" || strings.HasSuffix(object, "/")
+}
+
+// gcsDownloadScript returns the shell script that copies source into /out with gcloud storage.
+// For prefixes, the contents of the prefix (not the prefix directory itself) are copied.
+func gcsDownloadScript(source string, recursive bool) string {
+	src := source
+	flags := ""
+	if recursive {
+		src = strings.TrimSuffix(source, "/") + "/*"
+		flags = " --recursive"
+	}
+	return fmt.Sprintf(`set -e
+if [ -s /run/secrets/%[3]s ]; then
+	gcloud auth activate-service-account --key-file=/run/secrets/%[3]s --quiet
+else
+	gcloud config set auth/disable_credentials true --quiet
+fi
+mkdir -p /out
+if ! gcloud storage cp%[2]s '%[1]s' /out/; then
+	if [ ! -s /run/secrets/%[3]s ]; then
+		echo "failed to download %[4]s anonymously; if the bucket is private, provide a service account key with --secret id=%[3]s" >&2
+	fi
+	exit 1
+fi
+`, src, flags, gcpCredentialsSecret, source)
+}
+
+// ModelPackState returns a state containing the files of the modelpack referenced by an
+// oci:// source (tagged or pinned by digest) rooted at /, pulled with oras as in handleOCI.
+// timeout bounds connecting to the registry and each fetch is attempted up to retries times,
+// each attempt running for at most downloadTimeout seconds when positive.
+func ModelPackState(source string, timeout, retries, downloadTimeout int) (llb.State, error) {
+	artifactURL, ok := strings.CutPrefix(source, "oci://")
+	if !ok {
+		return llb.State{}, fmt.Errorf("not an oci source: %s", source)
+	}
+	named, err := reference.ParseNormalizedNamed(artifactURL)
+	if err != nil {
+		return llb.State{}, fmt.Errorf("invalid oci source %q: %w", source, err)
+	}
+	if _, tagged := named.(reference.Tagged); !tagged {
+		if _, digested := named.(reference.Digested); !digested {
+			return llb.State{}, fmt.Errorf("invalid oci source %q: a tag or digest is required", source)
+		}
+	}
+	if strings.HasPrefix(artifactURL, ollamaRegistryURL) {
+		return llb.State{}, fmt.Errorf("oci source %q: Ollama registry models are not modelpacks", source)
+	}
+	run := llb.Image(orasImage).Run(
+		utils.Sh("apk add --no-cache jq curl && "+handleGenericModelPack(artifactURL, weightSelection{}, timeout, retries, downloadTimeout, 0, nil)),
+		llb.WithCustomName("Downloading "+describeDownload(source)),
+	)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/download/", "/", &llb.CopyInfo{CopyDirContentsOnly: true})), nil
+}
+
+// handleLocal handles copying from local paths into modelsDir.
+func handleLocal(source, modelsDir string, mode *llb.ChmodOpt, s llb.State) llb.State {
+	s = s.File(
+		llb.Copy(llb.Local("context"), source, modelsDir+"/", createCopyOptions(mode)...),
+		llb.WithCustomName("Copying "+utils.FileNameFromURL(source)+" to "+modelsDir),
+	)
+	return s
+}
+
+// createCopyOptions returns the common llb.CopyOption used in file operations.
+// mode is applied to the copied files; nil preserves the source modes.
+func createCopyOptions(mode *llb.ChmodOpt) []llb.CopyOption {
 	return []llb.CopyOption{
 		&llb.CopyInfo{
 			CreateDestPath: true,
-			Mode:           &mode,
+			Mode:           mode,
 		},
 	}
 }
 
+// ParseModelFileMode returns the chmod applied to a model's files for its fileMode
+// setting: 0444 when empty, the given octal mode (e.g. "0644"), or nil for "preserve".
+func ParseModelFileMode(fileMode string) (*llb.ChmodOpt, error) {
+	switch fileMode {
+	case "":
+		return &llb.ChmodOpt{Mode: os.FileMode(0o444)}, nil
+	case utils.FileModePreserve:
+		return nil, nil
+	}
+	mode, err := strconv.ParseUint(fileMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return nil, fmt.Errorf("invalid file mode %q, must be an octal permission (e.g. 0644) or %q", fileMode, utils.FileModePreserve)
+	}
+	return &llb.ChmodOpt{Mode: os.FileMode(mode)}, nil
+}
+
 // HuggingFaceSpec represents a parsed huggingface:// reference.
 // Supported forms:
 //
 //	huggingface://namespace/model                -> revision: main
 //	huggingface://namespace/model@rev            -> explicit revision
 //	huggingface://namespace/model:rev            -> (legacy separator) explicit revision
-//	huggingface://namespace/model@rev/path/to    -> with subpath (ignored by current callers)
+//	huggingface://namespace/model@rev/path/to    -> with subpath (a single file)
+//	huggingface://namespace/model@rev/path/to/   -> with directory subpath (see IsDir)
+//	huggingface://namespace/model@rev/a,b/c      -> with several files (see Files)
 //	huggingface://namespace/model/path/to        -> implicit main revision with subpath
-//
-// For current usage we only need Namespace, Model, Revision; subpath is ignored.
 type HuggingFaceSpec struct {
 	Namespace string
 	Model     string
@@ -212,17 +969,42 @@ type HuggingFaceSpec struct {
 	SubPath   string // optional; empty means whole repo
 }
 
+// IsDir reports whether the subpath names a directory of the repository rather than a
+// single file, which is spelled with a trailing slash.
+func (s *HuggingFaceSpec) IsDir() bool {
+	return strings.HasSuffix(s.SubPath, "/")
+}
+
+// Files returns the repository files named by the subpath, which may list several
+// comma-separated files such as "config.json,tokenizer.json".
+func (s *HuggingFaceSpec) Files() []string {
+	if s.SubPath == "" {
+		return nil
+	}
+	return strings.Split(s.SubPath, ",")
+}
+
 var hfSpecPattern = regexp.MustCompile(`^huggingface://([^/]+)/([^/@:]+)(?:[@:]([^/]+))?(?:/(.*))?$`)
 
+var (
+	// ErrNotHuggingFace is returned by ParseHuggingFaceSpec for references without the
+	// huggingface:// scheme.
+	ErrNotHuggingFace = errors.New("not a huggingface source")
+	// ErrInvalidHuggingFaceSpec is returned by ParseHuggingFaceSpec for malformed
+	// huggingface:// references.
+	ErrInvalidHuggingFaceSpec = errors.New("invalid huggingface spec")
+)
+
 // ParseHuggingFaceSpec parses a huggingface:// reference into its components.
-// Defaults revision to "main" when omitted.
+// Defaults revision to "main" when omitted. Errors wrap ErrNotHuggingFace or
+// ErrInvalidHuggingFaceSpec.
 func ParseHuggingFaceSpec(src string) (*HuggingFaceSpec, error) {
 	if !strings.HasPrefix(src, "huggingface://") {
-		return nil, fmt.Errorf("not a huggingface source: %s", src)
+		return nil, fmt.Errorf("%w: %s", ErrNotHuggingFace, src)
 	}
 	m := hfSpecPattern.FindStringSubmatch(src)
 	if m == nil {
-		return nil, fmt.Errorf("invalid huggingface spec: %s", src)
+		return nil, fmt.Errorf("%w: %s", ErrInvalidHuggingFaceSpec, src)
 	}
 	spec := &HuggingFaceSpec{Namespace: m[1], Model: m[2], Revision: "main"}
 	if m[3] != "" {
@@ -231,9 +1013,16 @@ func ParseHuggingFaceSpec(src string) (*HuggingFaceSpec, error) {
 	if m[4] != "" {
 		spec.SubPath = m[4]
 	}
+	if strings.Contains(spec.SubPath, ",") {
+		for _, f := range spec.Files() {
+			if f == "" || strings.HasSuffix(f, "/") {
+				return nil, fmt.Errorf("%w: %s: each comma-separated entry must name a file", ErrInvalidHuggingFaceSpec, src)
+			}
+		}
+	}
 	// Basic validation: no empty pieces
 	if spec.Namespace == "" || spec.Model == "" {
-		return nil, errors.New("namespace and model required")
+		return nil, fmt.Errorf("%w: %s: namespace and model required", ErrInvalidHuggingFaceSpec, src)
 	}
 	return spec, nil
 }
@@ -0,0 +1,1229 @@
+package inference
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kaito-project/aikit/pkg/aikit/config"
+	"github.com/kaito-project/aikit/pkg/utils"
+	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// marshalState returns the concatenated LLB definition of a state for content assertions.
+func marshalState(t *testing.T, s llb.State) string {
+	t.Helper()
+	def, err := s.Marshal(context.Background())
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	var combined string
+	for _, d := range def.ToPB().Def {
+		combined += string(d)
+	}
+	return combined
+}
+
+func TestAria2DownloadScript(t *testing.T) {
+	script := aria2DownloadScript("https://example.com/model.gguf", "model.gguf", "abc123")
+	for _, s := range []string{
+		"apk add --no-cache aria2",
+		"aria2c -x16 -s16",
+		"-d /out -o 'model.gguf' 'https://example.com/model.gguf'",
+		`printf '%s  %s\n' 'abc123' '/out/model.gguf' | sha256sum -c -`,
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+
+	script = aria2DownloadScript("https://example.com/model.gguf", "model.gguf", "")
+	if strings.Contains(script, "sha256sum") {
+		t.Errorf("expected no checksum verification without sha256, got:\n%s", script)
+	}
+
+	script = aria2DownloadScript("https://example.com/it's.gguf?a=$(id)", "it's $HOME.gguf", "")
+	if want := `-o 'it'\''s $HOME.gguf' 'https://example.com/it'\''s.gguf?a=$(id)'`; !strings.Contains(script, want) {
+		t.Errorf("expected the URL and filename to be shell-quoted as %q, got:\n%s", want, script)
+	}
+}
+
+func TestSha256CheckScript_QuotesFilename(t *testing.T) {
+	for _, tool := range []string{"sh", "sha256sum"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	dir := t.TempDir()
+	const filename = "it's $HOME.gguf"
+	if err := os.WriteFile(filepath.Join(dir, filename), []byte("weights"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for sum, wantErr := range map[string]bool{
+		fmt.Sprintf("%x", sha256.Sum256([]byte("weights"))): false,
+		fmt.Sprintf("%x", sha256.Sum256([]byte("other"))):   true,
+	} {
+		script := strings.ReplaceAll(sha256CheckScript(sum, filename), "/out/", dir+"/")
+		if out, err := exec.Command("sh", "-c", script).CombinedOutput(); (err != nil) != wantErr {
+			t.Errorf("checksum %s: expected error %v, got %v\n%s", sum, wantErr, err, out)
+		}
+	}
+}
+
+func TestHandleHTTP_Downloader(t *testing.T) {
+	base := llb.Image("ubuntu:22.04")
+
+	got := marshalState(t, handleHTTP("https://example.com/model.gguf", "model", "abc123", utils.HTTPDownloaderAria2, false, false, false, utils.DefaultNetworkTimeout, utils.DefaultModelsPath, nil, base))
+	if !strings.Contains(got, "aria2c -x16 -s16") {
+		t.Errorf("expected aria2 download in definition")
+	}
+
+	got = marshalState(t, handleHTTP("https://example.com/model.gguf", "model", "abc123", "", false, false, false, utils.DefaultNetworkTimeout, utils.DefaultModelsPath, nil, base))
+	if strings.Contains(got, "aria2c") {
+		t.Errorf("expected native HTTP download by default")
+	}
+}
+
+func TestHandleHTTP_Auth(t *testing.T) {
+	base := llb.Image("ubuntu:22.04")
+
+	got := marshalState(t, handleHTTP("https://example.com/model.gguf", "model", "abc123", "", true, false, false, 7, utils.DefaultModelsPath, nil, base))
+	for _, want := range []string{
+		"/run/secrets/http-auth",
+		`curl -fSL --connect-timeout 7 -H "Authorization: $auth" -o '/out/model.gguf' 'https://example.com/model.gguf'`,
+		`printf '%s  %s\n' 'abc123' '/out/model.gguf' | sha256sum -c -`,
+		"/models/model.gguf",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected definition to contain %q", want)
+		}
+	}
+
+	got = marshalState(t, handleHTTP("https://example.com/model.gguf", "model", "abc123", "", false, false, false, 7, utils.DefaultModelsPath, nil, base))
+	if strings.Contains(got, "http-auth") || strings.Contains(got, "curl") {
+		t.Errorf("expected native HTTP download without auth")
+	}
+}
+
+func TestHandleHTTP_Decompress(t *testing.T) {
+	base := llb.Image("ubuntu:22.04")
+	tests := []struct {
+		source string
+		want   []string
+	}{
+		{source: "https://example.com/model.gguf.gz", want: []string{"gzip -dc '/in/model.gguf.gz' > '/out/model.gguf'", "/models/model.gguf"}},
+		{source: "https://example.com/model.gguf.zst", want: []string{"apk add --no-cache zstd && zstd -dc '/in/model.gguf.zst' > '/out/model.gguf'"}},
+		{source: "https://example.com/model.GGUF.XZ", want: []string{"apk add --no-cache xz && xz -dc '/in/model.GGUF.XZ' > '/out/model.GGUF'", "/models/model.GGUF"}},
+		{source: "https://example.com/it's.gguf.gz", want: []string{`gzip -dc '/in/it'\''s.gguf.gz' > '/out/it'\''s.gguf'`}},
+	}
+	for _, tt := range tests {
+		got := marshalState(t, handleHTTP(tt.source, "model", "", "", false, true, false, utils.DefaultNetworkTimeout, utils.DefaultModelsPath, nil, base))
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: expected definition to contain %q", tt.source, want)
+			}
+		}
+	}
+
+	got := marshalState(t, handleHTTP("https://example.com/model.gguf.gz", "model", "", "", false, false, false, utils.DefaultNetworkTimeout, utils.DefaultModelsPath, nil, base))
+	if strings.Contains(got, "gzip -dc") || !strings.Contains(got, "/models/model.gguf.gz") {
+		t.Error("expected the compressed file to be stored as is without decompress")
+	}
+}
+
+func TestGGUFShardURLs(t *testing.T) {
+	tests := []struct {
+		source  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			source: "https://example.com/m/model-00002-of-00003.gguf",
+			want: []string{
+				"https://example.com/m/model-00001-of-00003.gguf",
+				"https://example.com/m/model-00002-of-00003.gguf",
+				"https://example.com/m/model-00003-of-00003.gguf",
+			},
+		},
+		{
+			source: "https://huggingface.co/org/repo/resolve/main/Q4_K_M/llama-3-70b-Q4_K_M-00001-of-00002.gguf?download=true",
+			want: []string{
+				"https://huggingface.co/org/repo/resolve/main/Q4_K_M/llama-3-70b-Q4_K_M-00001-of-00002.gguf?download=true",
+				"https://huggingface.co/org/repo/resolve/main/Q4_K_M/llama-3-70b-Q4_K_M-00002-of-00002.gguf?download=true",
+			},
+		},
+		{source: "https://example.com/model-00001-of-00001.gguf", want: []string{"https://example.com/model-00001-of-00001.gguf"}},
+		{source: "https://example.com/model.gguf", wantErr: true},
+		{source: "https://example.com/model-0001-of-0003.gguf", wantErr: true},
+		{source: "https://example.com/model-00001-of-00003.safetensors", wantErr: true},
+		{source: "https://example.com/model-00004-of-00003.gguf", wantErr: true},
+		{source: "https://example.com/model-00000-of-00003.gguf", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := GGUFShardURLs(tt.source)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("GGUFShardURLs(%q) error = %v, wantErr %v", tt.source, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("GGUFShardURLs(%q) = %v, want %v", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestHandleHTTP_FetchShards(t *testing.T) {
+	base := llb.Image("ubuntu:22.04")
+	source := "https://example.com/model-00001-of-00002.gguf"
+	got := marshalState(t, handleHTTP(source, "model", "", "", false, false, true, utils.DefaultNetworkTimeout, utils.DefaultModelsPath, nil, base))
+	for _, want := range []string{
+		"https://example.com/model-00001-of-00002.gguf",
+		"https://example.com/model-00002-of-00002.gguf",
+		"/models/model-00001-of-00002.gguf",
+		"/models/model-00002-of-00002.gguf",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected definition to contain %q", want)
+		}
+	}
+
+	got = marshalState(t, handleHTTP(source, "model", "", "", false, false, false, utils.DefaultNetworkTimeout, utils.DefaultModelsPath, nil, base))
+	if strings.Contains(got, "model-00002-of-00002.gguf") {
+		t.Error("expected only the given shard without fetchShards")
+	}
+}
+
+func TestDecompressedName(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+		wantErr  bool
+	}{
+		{filename: "model.gguf.gz", want: "model.gguf"},
+		{filename: "model.gguf.zst", want: "model.gguf"},
+		{filename: "model.bin.xz", want: "model.bin"},
+		{filename: "model.gguf", wantErr: true},
+		{filename: "model.tar.bz2", wantErr: true},
+		{filename: ".gz", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := DecompressedName(tt.filename)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("DecompressedName(%q) = %q, %v; want %q, error %v", tt.filename, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestHTTPAuthDownloadScript(t *testing.T) {
+	script := httpAuthDownloadScript("https://example.com/model.gguf", "model.gguf", "", 10)
+	for _, s := range []string{
+		`auth="$(cat /run/secrets/http-auth)"`,
+		`Bearer\ *|Basic\ *) ;;`,
+		`*) auth="Bearer $auth" ;;`,
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+	if strings.Contains(script, "sha256sum") {
+		t.Errorf("expected no checksum verification without sha256, got:\n%s", script)
+	}
+}
+
+func TestHandleHuggingFace_PinnedRevisionFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      string
+		endpoint    string
+		mustContain []string
+	}{
+		{
+			name:   "nested gguf file",
+			source: "huggingface://org/model@v1/sub/dir/model.Q4_K_M.gguf",
+			mustContain: []string{
+				"https://huggingface.co/org/model/resolve/v1/sub/dir/model.Q4_K_M.gguf",
+				"/out/model.Q4_K_M.gguf",
+				"/models/model.Q4_K_M.gguf",
+				"/run/secrets/hf-token",
+			},
+		},
+		{
+			name:   "top level file",
+			source: "huggingface://org/model@main/model.gguf",
+			mustContain: []string{
+				"https://huggingface.co/org/model/resolve/main/model.gguf",
+				"/models/model.gguf",
+			},
+		},
+		{
+			name:   "legacy branch form",
+			source: "huggingface://org/model/dev/model.gguf",
+			mustContain: []string{
+				"https://huggingface.co/org/model/resolve/dev/model.gguf",
+				"/models/model.gguf",
+			},
+		},
+		{
+			name:   "colon branch form",
+			source: "huggingface://org/model:v1/model.gguf",
+			mustContain: []string{
+				"https://huggingface.co/org/model/resolve/v1/model.gguf",
+				"/models/model.gguf",
+			},
+		},
+		{
+			name:     "pinned file from mirror",
+			source:   "huggingface://org/model@main/model.gguf",
+			endpoint: "https://hf-mirror.com/",
+			mustContain: []string{
+				"https://hf-mirror.com/org/model/resolve/main/model.gguf",
+			},
+		},
+		{
+			name:     "legacy branch form from mirror",
+			source:   "huggingface://org/model/dev/model.gguf",
+			endpoint: "https://hf-mirror.com",
+			mustContain: []string{
+				"https://hf-mirror.com/org/model/resolve/dev/model.gguf",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := handleHuggingFace(tt.source, tt.endpoint, utils.DefaultNetworkTimeout, utils.DefaultModelsPath, nil, llb.Image("ubuntu:22.04"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := marshalState(t, s)
+			for _, want := range tt.mustContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected definition to contain %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseHuggingFaceURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		wantURL  string
+		wantFile string
+		wantErr  bool
+	}{
+		{
+			name:     "at branch",
+			source:   "huggingface://org/model@v1/file.gguf",
+			wantURL:  "https://huggingface.co/org/model/resolve/v1/file.gguf",
+			wantFile: "file.gguf",
+		},
+		{
+			name:     "colon branch",
+			source:   "huggingface://org/model:v1/file.gguf",
+			wantURL:  "https://huggingface.co/org/model/resolve/v1/file.gguf",
+			wantFile: "file.gguf",
+		},
+		{
+			name:     "slash branch",
+			source:   "huggingface://org/model/v1/file.gguf",
+			wantURL:  "https://huggingface.co/org/model/resolve/v1/file.gguf",
+			wantFile: "file.gguf",
+		},
+		{
+			name:     "default branch",
+			source:   "huggingface://org/model/file.gguf",
+			wantURL:  "https://huggingface.co/org/model/resolve/main/file.gguf",
+			wantFile: "file.gguf",
+		},
+		{
+			name:     "at branch with nested file",
+			source:   "huggingface://org/model@v1/sub/file.gguf",
+			wantURL:  "https://huggingface.co/org/model/resolve/v1/sub/file.gguf",
+			wantFile: "file.gguf",
+		},
+		{
+			name:    "empty branch",
+			source:  "huggingface://org/model@/file.gguf",
+			wantErr: true,
+		},
+		{
+			name:    "branch without file",
+			source:  "huggingface://org/model:v1/",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotURL, gotFile, err := ParseHuggingFaceURL(tt.source, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseHuggingFaceURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotURL != tt.wantURL || gotFile != tt.wantFile {
+				t.Errorf("ParseHuggingFaceURL() = %q, %q, want %q, %q", gotURL, gotFile, tt.wantURL, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestGCSDownloadScript(t *testing.T) {
+	script := gcsDownloadScript("gs://bucket/models/llama/", true)
+	for _, s := range []string{
+		"gcloud auth activate-service-account --key-file=/run/secrets/gcp-credentials",
+		"gcloud config set auth/disable_credentials true",
+		"gcloud storage cp --recursive 'gs://bucket/models/llama/*' /out/",
+		"if the bucket is private, provide a service account key with --secret id=gcp-credentials",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+
+	script = gcsDownloadScript("gs://bucket/models/model.gguf", false)
+	if !strings.Contains(script, "gcloud storage cp 'gs://bucket/models/model.gguf' /out/") {
+		t.Errorf("expected single object copy, got:\n%s", script)
+	}
+}
+
+func TestGCSState(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      string
+		expectError bool
+		mustContain []string
+	}{
+		{
+			name:        "prefix",
+			source:      "gs://bucket/models/llama/",
+			mustContain: []string{"--recursive 'gs://bucket/models/llama/*'", "/run/secrets/gcp-credentials"},
+		},
+		{
+			name:        "bucket only",
+			source:      "gs://bucket",
+			mustContain: []string{"--recursive 'gs://bucket/*'"},
+		},
+		{
+			name:        "single object",
+			source:      "gs://bucket/model.gguf",
+			mustContain: []string{"gcloud storage cp 'gs://bucket/model.gguf' /out/"},
+		},
+		{
+			name:        "empty bucket",
+			source:      "gs://",
+			expectError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := GCSState(tt.source)
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := marshalState(t, s)
+			for _, want := range tt.mustContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected definition to contain %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestModelPackState(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      string
+		expectError bool
+		mustContain []string
+	}{
+		{
+			name:        "tagged",
+			source:      "oci://ghcr.io/org/model:v1",
+			mustContain: []string{"ref=ghcr.io/org/model:v1", "retry oras pull  \"$ref\"", "--connect-timeout 10 --max-time 20 https://ghcr.io:443/v2/"},
+		},
+		{
+			name:        "digest pinned",
+			source:      "oci://ghcr.io/org/model@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			mustContain: []string{"ref=ghcr.io/org/model@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		},
+		{
+			name:        "localhost registry",
+			source:      "oci://localhost:5000/model:latest",
+			mustContain: []string{"retry oras pull --insecure \"$ref\""},
+		},
+		{name: "no tag or digest", source: "oci://ghcr.io/org/model", expectError: true},
+		{name: "invalid reference", source: "oci://ghcr.io/org/model:v1; rm -rf /", expectError: true},
+		{name: "ollama", source: "oci://registry.ollama.ai/library/llama3:8b", expectError: true},
+		{name: "not oci", source: "https://example.com/model", expectError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ModelPackState(tt.source, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0)
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := marshalState(t, s)
+			for _, want := range tt.mustContain {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected definition to contain %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseModelFileMode(t *testing.T) {
+	tests := []struct {
+		fileMode    string
+		want        os.FileMode
+		preserve    bool
+		expectError bool
+	}{
+		{fileMode: "", want: 0o444},
+		{fileMode: "0644", want: 0o644},
+		{fileMode: "755", want: 0o755},
+		{fileMode: utils.FileModePreserve, preserve: true},
+		{fileMode: "rw", expectError: true},
+		{fileMode: "01777", expectError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fileMode, func(t *testing.T) {
+			mode, err := ParseModelFileMode(tt.fileMode)
+			if tt.expectError {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.preserve {
+				if mode != nil {
+					t.Fatalf("expected nil mode to preserve source modes, got %v", mode.Mode)
+				}
+				return
+			}
+			if mode == nil || mode.Mode != tt.want {
+				t.Fatalf("expected mode %o, got %v", tt.want, mode)
+			}
+		})
+	}
+}
+
+func TestCreateCopyOptions_Mode(t *testing.T) {
+	mode, err := ParseModelFileMode("0644")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts := createCopyOptions(mode)
+	info, ok := opts[0].(*llb.CopyInfo)
+	if !ok {
+		t.Fatalf("expected *llb.CopyInfo, got %T", opts[0])
+	}
+	if info.Mode == nil || info.Mode.Mode != 0o644 {
+		t.Fatalf("expected configured mode 0644 in copy options, got %v", info.Mode)
+	}
+
+	info = createCopyOptions(nil)[0].(*llb.CopyInfo)
+	if info.Mode != nil {
+		t.Fatalf("expected no chmod when preserving modes")
+	}
+}
+
+func TestWeightSelectorPattern(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{selector: "Q4_K_M", want: "Q4_K_M"},
+		{selector: "model.q8.gguf", want: `model\.q8\.gguf`},
+		{selector: "*Q4_K_M*.gguf", want: `^.*Q4_K_M.*\.gguf$`},
+		{selector: "part-?.bin", want: `^part-.\.bin$`},
+	}
+	for _, tt := range tests {
+		if got := weightSelectorPattern(tt.selector); got != tt.want {
+			t.Errorf("weightSelectorPattern(%q) = %q, want %q", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestHandleGenericModelPack_WeightSelector(t *testing.T) {
+	script := handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{selector: "Q4_K_M"}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, nil)
+	for _, s := range []string{
+		`oras manifest fetch  "$ref"`,
+		"jq -c --arg re 'Q4_K_M'",
+		weightSelectorFilter,
+		`oras blob fetch  --output /tmp/layer "$repo@$digest"`,
+		"*.tar+zstd)",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+
+	script = handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{mediaType: "tar+zstd"}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, nil)
+	for _, s := range []string{
+		"jq -c --arg re '' --arg mt '.tar+zstd'",
+		"Selecting 'the first weight layer with media type *.tar+zstd' from $ref",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+
+	if script := handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, nil); strings.Contains(script, "jq -c") || !strings.Contains(script, "oras pull") {
+		t.Errorf("expected full pull without a selector, got:\n%s", script)
+	}
+}
+
+func TestHandleGenericModelPack_FetchAllWeights(t *testing.T) {
+	script := handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{all: true}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, nil)
+	for _, s := range []string{
+		"Selecting 'all weight layers' from $ref",
+		"jq -c --arg re '' --arg mt '' '" + weightLayersFilter + "' /tmp/manifest.json > /tmp/layers.jsonl",
+		"while read -r layer <&3; do",
+		`name=$(echo "$layer" | jq -r '.annotations["org.cncf.model.filepath"]`,
+		`oras blob fetch  --output /tmp/layer "$repo@$digest"`,
+		`mkdir -p "$(dirname "/download/$name")"`,
+		"done 3< /tmp/layers.jsonl",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+	if strings.Contains(script, weightSelectorFilter) || strings.Contains(script, "basename") {
+		t.Errorf("expected every weight layer to be fetched under its filepath, got:\n%s", script)
+	}
+
+	script = handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{selector: "shard-*", all: true}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, nil)
+	if !strings.Contains(script, "Selecting 'all weight layers matching shard-*' from $ref") {
+		t.Errorf("expected selector in the log line, got:\n%s", script)
+	}
+
+	// The OCI image layout path shares the same loop.
+	script = handleOCILayoutModelPack("/context/models/pack:v1", weightSelection{all: true})
+	if !strings.Contains(script, `oras blob fetch --oci-layout --output /tmp/layer "$repo@$digest"`) || !strings.Contains(script, "done 3< /tmp/layers.jsonl") {
+		t.Errorf("expected layout pull to loop over weight layers, got:\n%s", script)
+	}
+}
+
+func TestOCILayoutRef(t *testing.T) {
+	tests := []struct {
+		source, want string
+	}{
+		{source: "oci-layout:///models/pack", want: "/context/models/pack:latest"},
+		{source: "oci-layout:///models/pack:v1", want: "/context/models/pack:v1"},
+		{source: "oci-layout:///models/pack@sha256:abc", want: "/context/models/pack@sha256:abc"},
+		{source: "oci-layout:///models/v1.0:dir/pack", want: "/context/models/v1.0:dir/pack:latest"},
+		{source: "oci-layout:///../outside:v1", want: "/context/outside:v1"},
+	}
+	for _, tt := range tests {
+		if got := ociLayoutRef(tt.source); got != tt.want {
+			t.Errorf("ociLayoutRef(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestHandleOCILayout(t *testing.T) {
+	script := handleOCILayoutModelPack("/context/models/pack:v1", weightSelection{})
+	for _, s := range []string{"ref=/context/models/pack:v1", `oras pull --oci-layout "$ref"`} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+	if strings.Contains(script, "/v2/") {
+		t.Errorf("expected no registry preflight for a local layout, got:\n%s", script)
+	}
+
+	script = handleOCILayoutModelPack("/context/models/pack:v1", weightSelection{selector: "Q4_K_M"})
+	for _, s := range []string{
+		`oras manifest fetch --oci-layout "$ref"`,
+		`oras blob fetch --oci-layout --output /tmp/layer "$repo@$digest"`,
+		"*.tar+gzip)",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("expected script to contain %q, got:\n%s", s, script)
+		}
+	}
+
+	c := &config.InferenceConfig{Models: []config.Model{{Name: "pack", Source: "oci-layout:///models/pack:v1", WeightSelector: "Q4_K_M"}}}
+	s, _, err := copyModels(c, llb.Scratch(), llb.Scratch(), specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64})
+	if err != nil {
+		t.Fatalf("copyModels failed: %v", err)
+	}
+	def := marshalState(t, s)
+	for _, want := range []string{"local://context", "/context", "apk add --no-cache jq &&", "oras blob fetch --oci-layout"} {
+		if !strings.Contains(def, want) {
+			t.Errorf("expected LLB to contain %q", want)
+		}
+	}
+}
+
+func TestWeightSelectorFilter_PicksMatchingLayer(t *testing.T) {
+	if _, err := exec.LookPath("jq"); err != nil {
+		t.Skip("jq not available")
+	}
+	manifest := `{"layers": [
+		{"mediaType": "application/vnd.cncf.model.weight.config.v1.raw", "digest": "sha256:cfg", "annotations": {"org.cncf.model.filepath": "config-Q4_K_M.json"}},
+		{"mediaType": "application/vnd.cncf.model.weight.v1.raw", "digest": "sha256:q8", "annotations": {"org.cncf.model.filepath": "model.Q8_0.gguf"}},
+		{"mediaType": "application/vnd.cncf.model.weight.v1.raw", "digest": "sha256:q4", "annotations": {"org.cncf.model.filepath": "model.Q4_K_M.gguf"}},
+		{"mediaType": "application/vnd.cncf.model.weight.v1.tar+gzip", "digest": "sha256:q4tar", "annotations": {"org.cncf.model.filepath": "model.Q4_K_M.gguf"}}
+	]}`
+	tests := []struct {
+		selector  string
+		mediaType string
+		want      string
+	}{
+		{selector: "Q4_K_M", want: "sha256:q4"},
+		{selector: "*Q8_0.gguf", want: "sha256:q8"},
+		{selector: "Q5", want: ""},
+		{mediaType: "tar+gzip", want: "sha256:q4tar"},
+		{selector: "Q4_K_M", mediaType: "tar+gzip", want: "sha256:q4tar"},
+		{selector: "Q8_0", mediaType: "tar+gzip", want: ""},
+		{mediaType: "raw", want: "sha256:q8"},
+		{mediaType: "tar", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector+"/"+tt.mediaType, func(t *testing.T) {
+			mt := ""
+			if tt.mediaType != "" {
+				mt = "." + tt.mediaType
+			}
+			cmd := exec.Command("jq", "-r", "--arg", "re", weightSelectorPattern(tt.selector), "--arg", "mt", mt, weightSelectorFilter+" | .digest // empty")
+			cmd.Stdin = strings.NewReader(manifest)
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("jq failed: %v", err)
+			}
+			if got := strings.TrimSpace(string(out)); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWeightLayersFilter_PicksEveryWeightLayer(t *testing.T) {
+	if _, err := exec.LookPath("jq"); err != nil {
+		t.Skip("jq not available")
+	}
+	manifest := `{"layers": [
+		{"mediaType": "application/vnd.cncf.model.config.v1+json", "digest": "sha256:cfg"},
+		{"mediaType": "application/vnd.cncf.model.weight.v1.raw", "digest": "sha256:s1", "annotations": {"org.cncf.model.filepath": "model-00001-of-00002.safetensors"}},
+		{"mediaType": "application/vnd.cncf.model.weight.v1.raw", "digest": "sha256:s2", "annotations": {"org.cncf.model.filepath": "model-00002-of-00002.safetensors"}},
+		{"mediaType": "application/vnd.cncf.model.weight.config.v1.raw", "digest": "sha256:tok", "annotations": {"org.cncf.model.filepath": "tokenizer.json"}}
+	]}`
+	cmd := exec.Command("jq", "-r", "--arg", "re", weightSelectorPattern(""), "--arg", "mt", "", weightLayersFilter+" | .digest")
+	cmd.Stdin = strings.NewReader(manifest)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("jq failed: %v", err)
+	}
+	if got, want := strings.Fields(string(out)), []string{"sha256:s1", "sha256:s2"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestAliasCopyScript_MaterializesAliases(t *testing.T) {
+	for _, tool := range []string{"sh", "jq"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	manifest := `{"layers": [
+		{"mediaType": "application/vnd.cncf.model.weight.config.v1.raw", "digest": "sha256:a", "annotations": {"org.cncf.model.filepath": "config.json", "org.cncf.model.filepath.aliases": "copies/config.json,generation.json"}},
+		{"mediaType": "application/vnd.cncf.model.weight.v1.raw", "digest": "sha256:b", "annotations": {"org.cncf.model.filepath": "model.gguf"}},
+		{"mediaType": "application/vnd.cncf.model.doc.v1.tar", "digest": "sha256:c", "annotations": {"org.cncf.model.filepath": "docs", "org.cncf.model.filepath.aliases": "other"}}
+	]}`
+	run := func(t *testing.T, manifest string) (string, string, error) {
+		dir := t.TempDir()
+		download, tmp := filepath.Join(dir, "download"), filepath.Join(dir, "tmp")
+		for _, d := range []string{download, tmp} {
+			if err := os.MkdirAll(d, 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(download, "config.json"), []byte(`{"a": 1}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tmp, "manifest.json"), []byte(manifest), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		script := strings.NewReplacer("/download", download, "/tmp/", tmp+"/").Replace(aliasCopyScript("/tmp/manifest.json", ".layers[]"))
+		out, err := exec.Command("sh", "-c", "set -e\n"+script).CombinedOutput()
+		return download, string(out), err
+	}
+
+	download, out, err := run(t, manifest)
+	if err != nil {
+		t.Fatalf("alias script failed: %v\n%s", err, out)
+	}
+	for _, alias := range []string{"copies/config.json", "generation.json"} {
+		if data, err := os.ReadFile(filepath.Join(download, alias)); err != nil || string(data) != `{"a": 1}` {
+			t.Errorf("expected %s to be recreated from config.json, got %q (%v)", alias, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(download, "other")); !os.IsNotExist(err) {
+		t.Errorf("expected tar layer aliases to be skipped, got %v", err)
+	}
+
+	escaping := `{"layers": [{"mediaType": "application/vnd.cncf.model.weight.config.v1.raw", "digest": "sha256:a", "annotations": {"org.cncf.model.filepath": "config.json", "org.cncf.model.filepath.aliases": "../escape.json"}}]}`
+	if _, out, err := run(t, escaping); err == nil || !strings.Contains(out, "Refusing to copy") {
+		t.Errorf("expected an alias outside /download to be refused, got %v: %s", err, out)
+	}
+}
+
+func TestHFFileDownloadScript_Quoting(t *testing.T) {
+	script := hfFileDownloadScript("https://huggingface.co/org/model/resolve/main/it's.gguf", "it's $HOME.gguf", 15)
+	want := `-o '/out/it'\''s $HOME.gguf' 'https://huggingface.co/org/model/resolve/main/it'\''s.gguf'`
+	if got := strings.Count(script, want); got != 2 {
+		t.Errorf("expected both curl invocations to shell-quote the URL and filename as %q, got %d in:\n%s", want, got, script)
+	}
+}
+
+func TestNetworkTimeout_HFAndOrasSteps(t *testing.T) {
+	hf := hfFileDownloadScript("https://huggingface.co/org/model/resolve/main/m.gguf", "m.gguf", 15)
+	if got := strings.Count(hf, "curl -fSL --connect-timeout 15 "); got != 2 {
+		t.Errorf("expected both hf curl invocations to carry --connect-timeout 15, got %d in:\n%s", got, hf)
+	}
+
+	for _, selector := range []string{"", "Q4_K_M"} {
+		oras := handleGenericModelPack("localhost:5000/org/pack:v1", weightSelection{selector: selector}, 15, 1, 0, 0, nil)
+		if !strings.Contains(oras, "curl -s -k -o /dev/null --connect-timeout 15 --max-time 30 https://localhost:5000/v2/") {
+			t.Errorf("expected registry preflight with a 15s timeout (selector %q), got:\n%s", selector, oras)
+		}
+	}
+
+	_, ollama, err := handleOllamaRegistry("registry.ollama.ai/library/llama3:8b", 15, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ollama, "curl --connect-timeout 15 https://registry.ollama.ai/") {
+		t.Errorf("expected ollama manifest fetch to carry --connect-timeout 15, got: %s", ollama)
+	}
+}
+
+func TestHandleOllamaRegistry(t *testing.T) {
+	tests := []struct {
+		name        string
+		artifactURL string
+		modelName   string
+		mustContain []string
+		expectError bool
+	}{
+		{
+			name:        "default tag",
+			artifactURL: "registry.ollama.ai/library/llama3",
+			modelName:   "llama3",
+			mustContain: []string{"oras blob fetch registry.ollama.ai/library/llama3@", "https://registry.ollama.ai/v2/library/llama3/manifests/latest", "--output llama3"},
+		},
+		{
+			name:        "tag",
+			artifactURL: "registry.ollama.ai/library/llama3:8b",
+			modelName:   "llama3",
+			mustContain: []string{"https://registry.ollama.ai/v2/library/llama3/manifests/8b"},
+		},
+		{
+			name:        "user namespace",
+			artifactURL: "registry.ollama.ai/jmorganca/mixtral:q4",
+			modelName:   "mixtral",
+			mustContain: []string{"oras blob fetch registry.ollama.ai/jmorganca/mixtral@", "https://registry.ollama.ai/v2/jmorganca/mixtral/manifests/q4", "--output mixtral"},
+		},
+		{
+			name:        "registry port",
+			artifactURL: "registry.ollama.ai:443/library/llama3:8b",
+			modelName:   "llama3",
+			mustContain: []string{"oras blob fetch registry.ollama.ai:443/library/llama3@", "https://registry.ollama.ai:443/v2/library/llama3/manifests/8b"},
+		},
+		{
+			name:        "digest",
+			artifactURL: "registry.ollama.ai/library/llama3@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			modelName:   "llama3",
+			mustContain: []string{"/v2/library/llama3/manifests/sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		},
+		{
+			name:        "default namespace",
+			artifactURL: "registry.ollama.ai/llama3:8b",
+			modelName:   "llama3",
+			mustContain: []string{"/v2/library/llama3/manifests/8b"},
+		},
+		{name: "malformed", artifactURL: "registry.ollama.ai/library/llama3:8b:extra", expectError: true},
+		{name: "empty model", artifactURL: "registry.ollama.ai/library/", expectError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modelName, cmd, err := handleOllamaRegistry(tt.artifactURL, utils.DefaultNetworkTimeout, utils.DefaultRetries, nil)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("expected error, got command %s", cmd)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if modelName != tt.modelName {
+				t.Errorf("expected model name %q, got %q", tt.modelName, modelName)
+			}
+			for _, want := range tt.mustContain {
+				if !strings.Contains(cmd, want) {
+					t.Errorf("expected command to contain %q, got: %s", want, cmd)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleGenericModelPack_Retries(t *testing.T) {
+	for _, selector := range []string{"", "Q4_K_M"} {
+		script := handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{selector: selector}, utils.DefaultNetworkTimeout, 4, 0, 0, nil)
+		if !strings.Contains(script, `until "$@"; do`) || !strings.Contains(script, `if [ "$attempt" -ge 4 ]`) {
+			t.Errorf("expected retry loop with 4 attempts (selector %q), got:\n%s", selector, script)
+		}
+		if !strings.Contains(script, "retry oras ") {
+			t.Errorf("expected oras fetches to be wrapped in retry (selector %q), got:\n%s", selector, script)
+		}
+	}
+	if got := downloadRetries(&config.InferenceConfig{}); got != utils.DefaultRetries {
+		t.Errorf("downloadRetries() = %d, want default %d", got, utils.DefaultRetries)
+	}
+}
+
+func TestHandleGenericModelPack_Concurrency(t *testing.T) {
+	script := handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 8, nil)
+	if !strings.Contains(script, `retry oras pull --concurrency 8 "$ref"`) {
+		t.Errorf("expected oras pull with --concurrency 8 inside the retry loop, got:\n%s", script)
+	}
+	if !strings.Contains(script, `if [ "$attempt" -ge 3 ]`) {
+		t.Errorf("expected %d attempts by default, got:\n%s", utils.DefaultRetries, script)
+	}
+	if script := handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, nil); strings.Contains(script, "--concurrency") {
+		t.Errorf("expected oras default concurrency when unset, got:\n%s", script)
+	}
+	if script := handleGenericModelPack("localhost:5000/org/pack:v1", weightSelection{}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 2, nil); !strings.Contains(script, `retry oras pull --insecure --concurrency 2 "$ref"`) {
+		t.Errorf("expected concurrency alongside --insecure, got:\n%s", script)
+	}
+}
+
+func TestHandleGenericModelPack_DownloadTimeout(t *testing.T) {
+	for _, weights := range []weightSelection{{}, {selector: "Q4_K_M"}} {
+		script := handleGenericModelPack("ghcr.io/org/pack:v1", weights, utils.DefaultNetworkTimeout, utils.DefaultRetries, 900, 0, nil)
+		for _, want := range []string{"timeout 900 \"$@\"", "timed out after 900s", "retry with_timeout oras "} {
+			if !strings.Contains(script, want) {
+				t.Errorf("expected script to contain %q (selector %q), got:\n%s", want, weights.selector, script)
+			}
+		}
+		if strings.Contains(script, "retry oras ") {
+			t.Errorf("expected every oras fetch to be bounded (selector %q), got:\n%s", weights.selector, script)
+		}
+	}
+	if script := handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, nil); strings.Contains(script, "with_timeout()") || strings.Contains(script, "retry with_timeout") {
+		t.Errorf("expected no download timeout unless configured, got:\n%s", script)
+	}
+}
+
+func TestHandleOllamaRegistry_Retries(t *testing.T) {
+	_, script, err := handleOllamaRegistry("registry.ollama.ai/library/llama3:8b", utils.DefaultNetworkTimeout, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`if [ "$attempt" -ge 5 ]`,
+		"digest=$(retry curl --connect-timeout",
+		"retry oras blob fetch registry.ollama.ai/library/llama3@$digest --output llama3",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected script to contain %q, got:\n%s", want, script)
+		}
+	}
+}
+
+func TestRegistryTransport(t *testing.T) {
+	insecure := []string{"registry.internal", "mirror.corp:5000", "http://plain.corp:8080", "https://tls.corp/"}
+	tests := []struct {
+		host, want string
+	}{
+		{"registry.internal", orasInsecureFlag},
+		{"registry.internal:8443", orasInsecureFlag},
+		{"mirror.corp:5000", orasInsecureFlag},
+		{"mirror.corp", ""},
+		{"plain.corp:8080", orasPlainHTTPFlag},
+		{"tls.corp", orasInsecureFlag},
+		{"localhost:5000", orasInsecureFlag},
+		{"127.0.0.1:5000", orasInsecureFlag},
+		{"::1:5000", orasInsecureFlag},
+		{"ghcr.io", ""},
+		{"registry.internal.example.com", ""},
+	}
+	for _, tt := range tests {
+		got, warning := registryTransport(tt.host, insecure)
+		if got != tt.want {
+			t.Errorf("registryTransport(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+		if (warning != "") != (tt.want != "") {
+			t.Errorf("registryTransport(%q) warning = %q, want a warning only for insecure hosts", tt.host, warning)
+		}
+	}
+}
+
+func TestInsecureRegistries(t *testing.T) {
+	insecure := []string{"registry.internal:5000", "http://plain.internal"}
+
+	script := handleGenericModelPack("registry.internal:5000/org/pack:v1", weightSelection{}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, insecure)
+	for _, want := range []string{`retry oras pull --insecure "$ref"`, "[WARNING] Using insecure connection for registry registry.internal:5000"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected private registry script to contain %q, got:\n%s", want, script)
+		}
+	}
+	script = handleGenericModelPack("plain.internal/org/pack:v1", weightSelection{selector: "Q4_K_M"}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, insecure)
+	for _, want := range []string{`oras manifest fetch --plain-http "$ref"`, `oras blob fetch --plain-http --output /tmp/layer`} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected plain HTTP script to contain %q, got:\n%s", want, script)
+		}
+	}
+	script = handleGenericModelPack("ghcr.io/org/pack:v1", weightSelection{}, utils.DefaultNetworkTimeout, utils.DefaultRetries, 0, 0, insecure)
+	if strings.Contains(script, "--insecure") || strings.Contains(script, "--plain-http") || strings.Contains(script, "WARNING") {
+		t.Errorf("expected public registry to keep TLS verification, got:\n%s", script)
+	}
+
+	_, ollama, err := handleOllamaRegistry("registry.ollama.ai/library/llama3:8b", utils.DefaultNetworkTimeout, utils.DefaultRetries, []string{"registry.ollama.ai"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"retry curl -k --connect-timeout", "https://registry.ollama.ai/v2/", "retry oras blob fetch --insecure registry.ollama.ai/library/llama3@$digest"} {
+		if !strings.Contains(ollama, want) {
+			t.Errorf("expected insecure ollama script to contain %q, got:\n%s", want, ollama)
+		}
+	}
+	_, ollama, err = handleOllamaRegistry("registry.ollama.ai:8080/library/llama3:8b", utils.DefaultNetworkTimeout, utils.DefaultRetries, []string{"http://registry.ollama.ai"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"retry curl --connect-timeout", "http://registry.ollama.ai:8080/v2/", "retry oras blob fetch --plain-http registry.ollama.ai:8080/library/llama3@$digest"} {
+		if !strings.Contains(ollama, want) {
+			t.Errorf("expected plain HTTP ollama script to contain %q, got:\n%s", want, ollama)
+		}
+	}
+	_, ollama, err = handleOllamaRegistry("registry.ollama.ai/library/llama3:8b", utils.DefaultNetworkTimeout, utils.DefaultRetries, insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ollama, "curl -k") || strings.Contains(ollama, "--insecure") || strings.Contains(ollama, "http://") {
+		t.Errorf("expected public ollama registry to keep TLS verification, got:\n%s", ollama)
+	}
+}
+
+func TestRegistryHostPort(t *testing.T) {
+	tests := []struct {
+		ref, host, port string
+	}{
+		{"ghcr.io/org/pack:v1", "ghcr.io", "443"},
+		{"localhost:5000/pack:v1", "localhost", "5000"},
+		{"127.0.0.1:5000/org/pack@sha256:abc", "127.0.0.1", "5000"},
+		{"org/pack:v1", "registry-1.docker.io", "443"},
+	}
+	for _, tt := range tests {
+		host, port := registryHostPort(tt.ref)
+		if host != tt.host || port != tt.port {
+			t.Errorf("registryHostPort(%q) = %s, %s, want %s, %s", tt.ref, host, port, tt.host, tt.port)
+		}
+	}
+}
+
+func TestRefRepository(t *testing.T) {
+	tests := []struct {
+		ref, want string
+	}{
+		{"ghcr.io/org/pack:v1", "ghcr.io/org/pack"},
+		{"localhost:5000/model:tag", "localhost:5000/model"},
+		{"localhost:5000/model", "localhost:5000/model"},
+		{"localhost:5000/org/model@sha256:abc", "localhost:5000/org/model"},
+		{"/context/models/pack:latest", "/context/models/pack"},
+	}
+	for _, tt := range tests {
+		if got := refRepository(tt.ref); got != tt.want {
+			t.Errorf("refRepository(%q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+	script := modelPackPullScript("localhost:5000/model:tag", "", "", weightSelection{all: true}, 1, 0, 0)
+	if !strings.Contains(script, "repo='localhost:5000/model'") {
+		t.Errorf("expected the repository to keep the registry port, got:\n%s", script)
+	}
+}
+
+func TestRegistryPreflight(t *testing.T) {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl not available")
+	}
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer registry.Close()
+	var proxied atomic.Bool
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Store(r.URL.Hostname() == "registry.invalid")
+	}))
+	defer proxy.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedHost := strings.TrimPrefix(closed.URL, "http://")
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		ref     string
+		env     []string
+		wantErr bool
+	}{
+		{name: "unauthorized registry is reachable", ref: strings.TrimPrefix(registry.URL, "http://") + "/org/pack:v1"},
+		{name: "closed port", ref: closedHost + "/org/pack:v1", wantErr: true},
+		{name: "through proxy", ref: "registry.invalid/org/pack:v1", env: []string{"http_proxy=" + proxy.URL}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", "set -e\n"+registryPreflight(tt.ref, orasPlainHTTPFlag, 5))
+			cmd.Env = append(os.Environ(), "http_proxy=", "HTTP_PROXY=", "no_proxy=")
+			cmd.Env = append(cmd.Env, tt.env...)
+			out, err := cmd.CombinedOutput()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("expected error %v, got %v: %s", tt.wantErr, err, out)
+			}
+			if tt.wantErr && !strings.Contains(string(out), "Cannot connect to registry") {
+				t.Errorf("expected a connection error message, got %s", out)
+			}
+		})
+	}
+	if !proxied.Load() {
+		t.Error("expected the preflight to reach the registry through http_proxy")
+	}
+}
+
+func TestNetworkTimeout_Default(t *testing.T) {
+	if got := networkTimeout(&config.InferenceConfig{}); got != utils.DefaultNetworkTimeout {
+		t.Errorf("networkTimeout() = %d, want default %d", got, utils.DefaultNetworkTimeout)
+	}
+	if got := networkTimeout(&config.InferenceConfig{NetworkTimeout: 3}); got != 3 {
+		t.Errorf("networkTimeout() = %d, want 3", got)
+	}
+}
+
+func TestHuggingFaceSpec_IsDir(t *testing.T) {
+	tests := []struct {
+		src     string
+		subPath string
+		isDir   bool
+	}{
+		{src: "huggingface://org/model", subPath: "", isDir: false},
+		{src: "huggingface://org/model@main/model.gguf", subPath: "model.gguf", isDir: false},
+		{src: "huggingface://org/model@main/checkpoints/", subPath: "checkpoints/", isDir: true},
+		{src: "huggingface://org/model/a/b/", subPath: "a/b/", isDir: true},
+	}
+	for _, tt := range tests {
+		spec, err := ParseHuggingFaceSpec(tt.src)
+		if err != nil {
+			t.Fatalf("ParseHuggingFaceSpec(%q) failed: %v", tt.src, err)
+		}
+		if spec.SubPath != tt.subPath || spec.IsDir() != tt.isDir {
+			t.Errorf("ParseHuggingFaceSpec(%q) = subpath %q, dir %v; want %q, %v", tt.src, spec.SubPath, spec.IsDir(), tt.subPath, tt.isDir)
+		}
+	}
+}
+
+func TestHuggingFaceSpec_Files(t *testing.T) {
+	tests := []struct {
+		src   string
+		files []string
+	}{
+		{src: "huggingface://org/model", files: nil},
+		{src: "huggingface://org/model@main/model.gguf", files: []string{"model.gguf"}},
+		{src: "huggingface://org/model@main/config.json,tokenizer.json", files: []string{"config.json", "tokenizer.json"}},
+		{src: "huggingface://org/model/config.json,sub/tokenizer.json,vocab.txt", files: []string{"config.json", "sub/tokenizer.json", "vocab.txt"}},
+	}
+	for _, tt := range tests {
+		spec, err := ParseHuggingFaceSpec(tt.src)
+		if err != nil {
+			t.Fatalf("ParseHuggingFaceSpec(%q) failed: %v", tt.src, err)
+		}
+		if got := spec.Files(); !reflect.DeepEqual(got, tt.files) {
+			t.Errorf("ParseHuggingFaceSpec(%q).Files() = %q, want %q", tt.src, got, tt.files)
+		}
+	}
+
+	for _, src := range []string{"huggingface://org/model@main/config.json,", "huggingface://org/model@main/a.json,sub/"} {
+		if _, err := ParseHuggingFaceSpec(src); err == nil {
+			t.Errorf("ParseHuggingFaceSpec(%q) succeeded, want error", src)
+		}
+	}
+}
+
+func TestParseHuggingFaceSpec_Errors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want error
+	}{
+		{src: "https://huggingface.co/org/model", want: ErrNotHuggingFace},
+		{src: "oci://registry/model:tag", want: ErrNotHuggingFace},
+		{src: "huggingface://", want: ErrInvalidHuggingFaceSpec},
+		{src: "huggingface://org", want: ErrInvalidHuggingFaceSpec},
+		{src: "huggingface://org/model@main/config.json,", want: ErrInvalidHuggingFaceSpec},
+		{src: "huggingface://org/model@main/a.json,sub/", want: ErrInvalidHuggingFaceSpec},
+	}
+	for _, tt := range tests {
+		_, err := ParseHuggingFaceSpec(tt.src)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("ParseHuggingFaceSpec(%q) error = %v, want %v", tt.src, err, tt.want)
+		}
+		other := ErrNotHuggingFace
+		if tt.want == ErrNotHuggingFace {
+			other = ErrInvalidHuggingFaceSpec
+		}
+		if errors.Is(err, other) {
+			t.Errorf("ParseHuggingFaceSpec(%q) error %v also matches %v", tt.src, err, other)
+		}
+	}
+}
+
+func TestDescribeDownload(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{source: "https://example.com/models/llama.Q4_K_M.gguf?download=true", want: "llama.Q4_K_M.gguf from example.com (large)"},
+		{source: "http://example.com/tokenizer.json", want: "tokenizer.json from example.com"},
+		{source: "huggingface://org/model@v1/sub/model.safetensors", want: "sub/model.safetensors from Hugging Face org/model@v1 (large)"},
+		{source: "huggingface://org/model/dev/model.gguf", want: "model.gguf from Hugging Face org/model (large)"},
+		{source: "huggingface://org/model/config.json", want: "config.json from Hugging Face org/model"},
+		{source: "oci://registry.ollama.ai/library/llama3:8b", want: "library/llama3:8b from Ollama registry"},
+		{source: "oci://registry.ollama.ai/jmorganca/mixtral:q4", want: "jmorganca/mixtral:q4 from Ollama registry"},
+		{source: "oci://ghcr.io/org/pack:v1", want: "modelpack ghcr.io/org/pack:v1"},
+		{source: "models/local.gguf", want: "models/local.gguf"},
+	}
+	for _, tt := range tests {
+		if got := describeDownload(tt.source); got != tt.want {
+			t.Errorf("describeDownload(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
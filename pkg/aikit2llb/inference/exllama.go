@@ -5,12 +5,20 @@ import (
 	"github.com/moby/buildkit/client/llb"
 )
 
+const (
+	// pythonBaseDepsCmd installs the minimal Python toolchain shared by all Python backends.
+	pythonBaseDepsCmd = "apt-get update && apt-get install --no-install-recommends -y git python3 python3-pip python3-venv python-is-python3 && pip install uv && pip install grpcio-tools==1.71.0 --no-dependencies && apt-get clean"
+
+	// exllamaDepsCmd installs Python plus the build tools exllama2 needs for compilation.
+	exllamaDepsCmd = "apt-get update && apt-get install --no-install-recommends -y bash git ca-certificates python3-pip python3-dev python3-venv python-is-python3 make g++ curl && pip install uv ninja && pip install grpcio-tools==1.71.0 --no-dependencies && apt-get clean"
+)
+
 // installPythonBaseDependencies installs minimal Python dependencies common to all Python backends.
 func installPythonBaseDependencies(s llb.State, merge llb.State) llb.State {
 	savedState := s
 
 	// Install minimal Python dependencies common to all Python backends
-	s = s.Run(utils.Sh("apt-get update && apt-get install --no-install-recommends -y git python3 python3-pip python3-venv python-is-python3 && pip install uv && pip install grpcio-tools==1.71.0 --no-dependencies && apt-get clean"), llb.IgnoreCache).Root()
+	s = s.Run(utils.Sh(pythonBaseDepsCmd), llb.IgnoreCache).Root()
 
 	diff := llb.Diff(savedState, s)
 	return llb.Merge([]llb.State{merge, diff})
@@ -22,7 +30,7 @@ func installExllamaDependencies(s llb.State, merge llb.State) llb.State {
 	savedState := s
 
 	// Install Python and build dependencies needed for exllama2
-	s = s.Run(utils.Sh("apt-get update && apt-get install --no-install-recommends -y bash git ca-certificates python3-pip python3-dev python3-venv python-is-python3 make g++ curl && pip install uv ninja && pip install grpcio-tools==1.71.0 --no-dependencies && apt-get clean"), llb.IgnoreCache).Root()
+	s = s.Run(utils.Sh(exllamaDepsCmd), llb.IgnoreCache).Root()
 
 	diff := llb.Diff(savedState, s)
 	return llb.Merge([]llb.State{merge, diff})
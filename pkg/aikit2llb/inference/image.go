@@ -1,13 +1,39 @@
 package inference
 
 import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/kaito-project/aikit/pkg/aikit/config"
 	"github.com/kaito-project/aikit/pkg/utils"
 	"github.com/moby/buildkit/util/system"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-func NewImageConfig(c *config.InferenceConfig, platform *specs.Platform) *specs.Image {
+// LabelPrefix is the label namespace reserved for labels set by aikit, which user labels
+// may not use.
+const LabelPrefix = "io.kaito-project.aikit."
+
+// localAIVersionLabel records the LocalAI version an inference image was built with.
+const localAIVersionLabel = LabelPrefix + "localai.version"
+
+const (
+	// defaultHealthcheckPath is the LocalAI endpoint probed by healthchecks without a path.
+	defaultHealthcheckPath = "/readyz"
+	// defaultHealthcheckPort is the port LocalAI listens on by default.
+	defaultHealthcheckPort = 8080
+)
+
+// NewImageConfig returns the image config of an inference image for c on platform. The
+// labels of c are applied first, so the labels set by aikit always win, while the env of c
+// overrides the variables set by aikit and adds the others sorted by name. A custom entrypoint
+// or cmd of c replaces the LocalAI entrypoint or the flags derived from c respectively.
+func NewImageConfig(c *config.InferenceConfig, platform *specs.Platform) *dockerspec.DockerOCIImage {
 	img := emptyImage(c, platform)
 	cmd := []string{}
 	if c.Debug {
@@ -16,17 +42,103 @@ func NewImageConfig(c *config.InferenceConfig, platform *specs.Platform) *specs.
 	if c.Config != "" {
 		cmd = append(cmd, "--config-file=/config.yaml")
 	}
+	if dir := modelsPath(c); dir != utils.DefaultModelsPath {
+		cmd = append(cmd, "--models-path="+dir)
+	}
 
 	img.Config.Entrypoint = []string{"local-ai"}
 	img.Config.Cmd = cmd
+	if len(c.Entrypoint) > 0 {
+		img.Config.Entrypoint = c.Entrypoint
+	}
+	if len(c.Cmd) > 0 {
+		img.Config.Cmd = c.Cmd
+	}
+	if c.Healthcheck != nil {
+		img.Config.Healthcheck = healthcheckConfig(c.Healthcheck)
+	}
+	for _, p := range c.Ports {
+		if port, err := ParsePort(p); err == nil {
+			if img.Config.ExposedPorts == nil {
+				img.Config.ExposedPorts = map[string]struct{}{}
+			}
+			img.Config.ExposedPorts[port] = struct{}{}
+		}
+	}
+
+	labels := maps.Clone(c.Labels)
+	if version, err := ParseLocalAIVersion(c.LocalAIVersion); err == nil {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[localAIVersionLabel] = version
+	}
+	img.Config.Labels = labels
 	return img
 }
 
-func emptyImage(c *config.InferenceConfig, platform *specs.Platform) *specs.Image {
-	img := &specs.Image{
-		Platform: specs.Platform{
-			Architecture: platform.Architecture,
-			OS:           utils.PlatformLinux,
+// ParsePort returns the exposed port key of an image config for spec, a port number with an
+// optional /tcp, /udp or /sctp protocol; a bare port number is tcp.
+func ParsePort(spec string) (string, error) {
+	port, proto, hasProto := strings.Cut(spec, "/")
+	if !hasProto {
+		proto = "tcp"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 || port != strconv.Itoa(n) {
+		return "", fmt.Errorf("invalid port %q, must be a port number between 1 and 65535 with an optional /tcp, /udp or /sctp protocol", spec)
+	}
+	if !slices.Contains([]string{"tcp", "udp", "sctp"}, proto) {
+		return "", fmt.Errorf("invalid port %q, protocol must be tcp, udp or sctp", spec)
+	}
+	return port + "/" + proto, nil
+}
+
+// mergeEnv returns env, in KEY=value form, with the variables of overrides: those already
+// in env are replaced in place and the rest are appended in sorted order, so rebuilds
+// produce the same image config.
+func mergeEnv(env []string, overrides map[string]string) []string {
+	merged := slices.Clone(env)
+	for i, kv := range merged {
+		k, _, _ := strings.Cut(kv, "=")
+		if v, ok := overrides[k]; ok {
+			merged[i] = k + "=" + v
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(overrides)) {
+		if !slices.ContainsFunc(env, func(kv string) bool { return strings.HasPrefix(kv, k+"=") }) {
+			merged = append(merged, k+"="+overrides[k])
+		}
+	}
+	return merged
+}
+
+// healthcheckConfig returns the image healthcheck probing the HTTP endpoint of h. The
+// request is sent with bash /dev/tcp, as the base images ship neither curl nor wget.
+func healthcheckConfig(h *config.Healthcheck) *dockerspec.HealthcheckConfig {
+	path, port := h.Path, h.Port
+	if path == "" {
+		path = defaultHealthcheckPath
+	}
+	if port == 0 {
+		port = defaultHealthcheckPort
+	}
+	probe := fmt.Sprintf(`exec 3<>/dev/tcp/127.0.0.1/%d && printf 'GET %s HTTP/1.0\r\nHost: localhost\r\n\r\n' >&3 && head -n 1 <&3 | grep -q ' 200 '`, port, path)
+	return &dockerspec.HealthcheckConfig{
+		Test:        []string{"CMD", "bash", "-c", probe},
+		Interval:    time.Duration(h.Interval) * time.Second,
+		Timeout:     time.Duration(h.Timeout) * time.Second,
+		StartPeriod: time.Duration(h.StartPeriod) * time.Second,
+		Retries:     h.Retries,
+	}
+}
+
+func emptyImage(c *config.InferenceConfig, platform *specs.Platform) *dockerspec.DockerOCIImage {
+	img := &dockerspec.DockerOCIImage{
+		Image: specs.Image{
+			Platform: specs.Platform{
+				Architecture: platform.Architecture,
+				OS:           utils.PlatformLinux,
+			},
 		},
 	}
 	img.RootFS.Type = "layers"
@@ -50,5 +162,15 @@ func emptyImage(c *config.InferenceConfig, platform *specs.Platform) *specs.Imag
 		img.Config.Env = append(img.Config.Env, cudaEnv...)
 	}
 
+	intelEnv := []string{
+		"LD_LIBRARY_PATH=/opt/intel/oneapi/redist/lib:/opt/intel/oneapi/compiler/latest/lib:/opt/intel/oneapi/mkl/latest/lib",
+		"ZES_ENABLE_SYSMAN=1",
+		"BUILD_TYPE=sycl_f16",
+	}
+	if c.Runtime == utils.RuntimeIntel {
+		img.Config.Env = append(img.Config.Env, intelEnv...)
+	}
+	img.Config.Env = mergeEnv(img.Config.Env, c.Env)
+
 	return img
 }
@@ -0,0 +1,215 @@
+package inference
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kaito-project/aikit/pkg/aikit/config"
+	"github.com/kaito-project/aikit/pkg/utils"
+	"github.com/moby/buildkit/util/system"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNewImageConfig_Labels(t *testing.T) {
+	platform := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	c := &config.InferenceConfig{
+		LocalAIVersion: "v3.7.0",
+		Labels: map[string]string{
+			"org.opencontainers.image.source": "https://github.com/org/repo",
+			"model.version":                   "2",
+			localAIVersionLabel:               "spoofed",
+		},
+	}
+	img := NewImageConfig(c, platform)
+	for k, want := range map[string]string{
+		"org.opencontainers.image.source": "https://github.com/org/repo",
+		"model.version":                   "2",
+		localAIVersionLabel:               "v3.7.0",
+	} {
+		if got := img.Config.Labels[k]; got != want {
+			t.Errorf("label %s = %q, want %q", k, got, want)
+		}
+	}
+	if c.Labels[localAIVersionLabel] != "spoofed" {
+		t.Error("expected the config labels to be left unmodified")
+	}
+	if img.Config.Entrypoint[0] != "local-ai" {
+		t.Errorf("expected labels to leave the entrypoint alone, got %v", img.Config.Entrypoint)
+	}
+
+	img = NewImageConfig(&config.InferenceConfig{}, platform)
+	if len(img.Config.Labels) != 1 || img.Config.Labels[localAIVersionLabel] != localAIVersion {
+		t.Errorf("expected only the LocalAI version label by default, got %v", img.Config.Labels)
+	}
+
+	df, err := Aikit2Dockerfile(&config.InferenceConfig{Labels: map[string]string{"model.version": "2"}}, platform)
+	if err != nil {
+		t.Fatalf("Aikit2Dockerfile failed: %v", err)
+	}
+	for _, want := range []string{`LABEL "model.version"="2"`, `LABEL "` + localAIVersionLabel + `"="` + localAIVersion + `"`} {
+		if !strings.Contains(df, want) {
+			t.Errorf("expected Dockerfile to contain %s", want)
+		}
+	}
+}
+
+func TestNewImageConfig_EntrypointCmdHealthcheck(t *testing.T) {
+	platform := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	img := NewImageConfig(&config.InferenceConfig{Config: "- name: m"}, platform)
+	if !reflect.DeepEqual(img.Config.Entrypoint, []string{"local-ai"}) || !reflect.DeepEqual(img.Config.Cmd, []string{"--config-file=/config.yaml"}) {
+		t.Errorf("expected the LocalAI entrypoint and flags by default, got %v %v", img.Config.Entrypoint, img.Config.Cmd)
+	}
+	if img.Config.Healthcheck != nil {
+		t.Errorf("expected no healthcheck by default, got %+v", img.Config.Healthcheck)
+	}
+
+	c := &config.InferenceConfig{
+		Config:      "- name: m",
+		Entrypoint:  []string{"/usr/bin/tini", "--", "local-ai"},
+		Cmd:         []string{"run", "--address=:9090"},
+		Healthcheck: &config.Healthcheck{Port: 9090, Interval: 30, Timeout: 5, StartPeriod: 120, Retries: 3},
+	}
+	img = NewImageConfig(c, platform)
+	if !reflect.DeepEqual(img.Config.Entrypoint, c.Entrypoint) || !reflect.DeepEqual(img.Config.Cmd, c.Cmd) {
+		t.Errorf("expected the custom entrypoint and cmd, got %v %v", img.Config.Entrypoint, img.Config.Cmd)
+	}
+	hc := img.Config.Healthcheck
+	if hc == nil {
+		t.Fatal("expected a healthcheck")
+	}
+	if hc.Interval != 30*time.Second || hc.Timeout != 5*time.Second || hc.StartPeriod != 2*time.Minute || hc.Retries != 3 {
+		t.Errorf("unexpected healthcheck timings %+v", hc)
+	}
+	if len(hc.Test) != 4 || hc.Test[0] != "CMD" || !strings.Contains(hc.Test[3], "/dev/tcp/127.0.0.1/9090") || !strings.Contains(hc.Test[3], "GET /readyz ") {
+		t.Errorf("unexpected healthcheck test %q", hc.Test)
+	}
+
+	df, err := Aikit2Dockerfile(c, platform)
+	if err != nil {
+		t.Fatalf("Aikit2Dockerfile failed: %v", err)
+	}
+	for _, want := range []string{
+		`HEALTHCHECK --interval=30s --timeout=5s --start-period=2m0s --retries=3 CMD ["bash", "-c", `,
+		`ENTRYPOINT ["/usr/bin/tini", "--", "local-ai"]`,
+		`CMD ["run", "--address=:9090"]`,
+	} {
+		if !strings.Contains(df, want) {
+			t.Errorf("expected Dockerfile to contain %s", want)
+		}
+	}
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	var ready atomic.Bool
+	ready.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := healthcheckConfig(&config.Healthcheck{Path: "/healthz", Port: port}).Test
+	if err := exec.Command(probe[1], probe[2:]...).Run(); err != nil {
+		t.Errorf("expected the healthcheck to pass against a healthy server: %v", err)
+	}
+	ready.Store(false)
+	if err := exec.Command(probe[1], probe[2:]...).Run(); err == nil {
+		t.Error("expected the healthcheck to fail against an unhealthy server")
+	}
+}
+
+func TestNewImageConfig_Env(t *testing.T) {
+	platform := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	c := &config.InferenceConfig{Env: map[string]string{
+		"LOCALAI_THREADS": "8",
+		"HF_HOME":         "/cache/hf",
+		"CONFIG_FILE":     "/etc/localai.yaml",
+		"A_FIRST":         "a=b",
+	}}
+	want := []string{
+		"PATH=" + system.DefaultPathEnv(utils.PlatformLinux),
+		"CONFIG_FILE=/etc/localai.yaml",
+		"A_FIRST=a=b",
+		"HF_HOME=/cache/hf",
+		"LOCALAI_THREADS=8",
+	}
+	for range 10 {
+		if got := NewImageConfig(c, platform).Config.Env; !reflect.DeepEqual(got, want) {
+			t.Fatalf("env = %q, want %q", got, want)
+		}
+	}
+
+	df, err := Aikit2Dockerfile(c, platform)
+	if err != nil {
+		t.Fatalf("Aikit2Dockerfile failed: %v", err)
+	}
+	if i, j := strings.Index(df, `ENV HF_HOME="/cache/hf"`), strings.Index(df, `ENV LOCALAI_THREADS="8"`); i < 0 || j < i {
+		t.Errorf("expected sorted ENV instructions in the Dockerfile, got:\n%s", df)
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{spec: "8080", want: "8080/tcp"},
+		{spec: "9090/tcp", want: "9090/tcp"},
+		{spec: "5353/udp", want: "5353/udp"},
+		{spec: "3868/sctp", want: "3868/sctp"},
+		{spec: "65535/tcp", want: "65535/tcp"},
+		{spec: "", wantErr: true},
+		{spec: "0", wantErr: true},
+		{spec: "65536/tcp", wantErr: true},
+		{spec: "-1/tcp", wantErr: true},
+		{spec: "08080/tcp", wantErr: true},
+		{spec: "http/tcp", wantErr: true},
+		{spec: "8080/", wantErr: true},
+		{spec: "8080/http", wantErr: true},
+		{spec: "8080-8090/tcp", wantErr: true},
+		{spec: "8080/tcp/udp", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePort(tt.spec)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePort(%q) = %q, %v, want %q, error %v", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNewImageConfig_Ports(t *testing.T) {
+	platform := &specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	if img := NewImageConfig(&config.InferenceConfig{}, platform); img.Config.ExposedPorts != nil {
+		t.Errorf("expected no exposed ports by default, got %v", img.Config.ExposedPorts)
+	}
+	c := &config.InferenceConfig{Ports: []string{"9090", "8080/tcp", "5353/udp"}}
+	want := map[string]struct{}{"8080/tcp": {}, "9090/tcp": {}, "5353/udp": {}}
+	if got := NewImageConfig(c, platform).Config.ExposedPorts; !reflect.DeepEqual(got, want) {
+		t.Errorf("exposed ports = %v, want %v", got, want)
+	}
+	df, err := Aikit2Dockerfile(c, platform)
+	if err != nil {
+		t.Fatalf("Aikit2Dockerfile failed: %v", err)
+	}
+	if !strings.Contains(df, "EXPOSE 5353/udp\nEXPOSE 8080/tcp\nEXPOSE 9090/tcp\n") {
+		t.Errorf("expected sorted EXPOSE instructions in the Dockerfile, got:\n%s", df)
+	}
+}
@@ -0,0 +1,110 @@
+package inference
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/kaito-project/aikit/pkg/aikit/config"
+	"github.com/kaito-project/aikit/pkg/utils"
+	"github.com/moby/buildkit/client/llb"
+)
+
+const (
+	// lockfileName is the name of the lockfile written to the models directory.
+	lockfileName = "aikit-lock.json"
+	// lockMountDir is where the downloaded files of every model are mounted when hashing them.
+	lockMountDir = "/lock"
+)
+
+// lockEntry describes a model recorded in the lockfile.
+type lockEntry struct {
+	name   string
+	source string
+	url    string
+}
+
+// writeLockfile returns the diff on top of s adding <modelsDir>/aikit-lock.json, which records
+// for every model of c its source, resolved URL and the path and sha256 of each file it added
+// to the image. downloads holds, in the order of c.Models, the diff of each model's download.
+func writeLockfile(c *config.InferenceConfig, downloads []llb.State, s llb.State) (llb.State, error) {
+	entries := make([]lockEntry, 0, len(c.Models))
+	runOpts := []llb.RunOption{llb.WithCustomName("Writing " + lockfileName)}
+	for i, model := range c.Models {
+		url, err := resolvedModelURL(c, model)
+		if err != nil {
+			return llb.State{}, err
+		}
+		entries = append(entries, lockEntry{name: model.Name, source: model.Source, url: url})
+		runOpts = append(runOpts, llb.AddMount(fmt.Sprintf("%s/%d", lockMountDir, i), downloads[i], llb.Readonly))
+	}
+	script := lockfileScript(entries, lockMountDir, "/out/"+lockfileName)
+	run := llb.Image(alpineImage).Run(append([]llb.RunOption{utils.Sh(script)}, runOpts...)...)
+
+	dest := path.Join(modelsPath(c), lockfileName)
+	lock := s.File(
+		llb.Copy(run.Root(), "/out/"+lockfileName, dest, &llb.CopyInfo{CreateDestPath: true}),
+		llb.WithCustomName("Copying "+lockfileName+" to "+dest),
+	)
+	return llb.Diff(s, lock), nil
+}
+
+// resolvedModelURL returns the URL model is actually downloaded from: the resolve URL on the
+// configured endpoint for huggingface:// sources and the source itself otherwise.
+func resolvedModelURL(c *config.InferenceConfig, model config.Model) (string, error) {
+	if !strings.HasPrefix(model.Source, "huggingface://") {
+		return model.Source, nil
+	}
+	if spec, err := ParseHuggingFaceSpec(model.Source); err == nil && spec.SubPath != "" && hasPinnedRevision(model.Source) {
+		return huggingFaceResolveURL(spec, c.HFEndpoint), nil
+	}
+	hfURL, _, err := ParseHuggingFaceURL(model.Source, c.HFEndpoint)
+	return hfURL, err
+}
+
+// lockfileScript returns the shell script writing the lockfile to outFile. The files of the
+// i-th entry are read from <lockDir>/<i>, whose layout mirrors the image root, and are
+// recorded by their path in the image, sorted.
+func lockfileScript(entries []lockEntry, lockDir, outFile string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `set -e
+mkdir -p %[1]s
+# hash_files: Print the path and sha256 of every file under a directory as JSON objects,
+# escaping backslashes and double quotes in paths. Files are hashed from stdin, since
+# sha256sum prefixes the digest of such paths with a backslash
+# Args: directory mirroring the image root
+hash_files() {
+	sep=""
+	find "$1" -type f | LC_ALL=C sort | while IFS= read -r f; do
+		p=$(printf '%%s' "${f#"$1"}" | sed 's/[\\"]/\\&/g')
+		printf '%%s\n        {"path": "%%s", "sha256": "%%s"}' "$sep" "$p" "$(sha256sum < "$f" | cut -d' ' -f1)"
+		sep=","
+	done
+}
+{
+echo '{'
+echo '  "models": ['
+`, utils.ShellQuote(path.Dir(outFile)))
+	for i, e := range entries {
+		sep := ","
+		if i == len(entries)-1 {
+			sep = ""
+		}
+		fmt.Fprintf(&b, `printf '    {\n      "name": %%s,\n      "source": %%s,\n      "url": %%s,\n      "files": [' %s %s %s
+hash_files %s
+printf '\n      ]\n    }%s\n'
+`, jsonShellArg(e.name), jsonShellArg(e.source), jsonShellArg(e.url), utils.ShellQuote(fmt.Sprintf("%s/%d", lockDir, i)), sep)
+	}
+	fmt.Fprintf(&b, `echo '  ]'
+echo '}'
+} > %s
+`, utils.ShellQuote(outFile))
+	return b.String()
+}
+
+// jsonShellArg returns s as a JSON string literal quoted for the shell.
+func jsonShellArg(s string) string {
+	q, _ := json.Marshal(s)
+	return utils.ShellQuote(string(q))
+}
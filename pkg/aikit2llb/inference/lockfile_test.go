@@ -0,0 +1,122 @@
+package inference
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kaito-project/aikit/pkg/aikit/config"
+	"github.com/kaito-project/aikit/pkg/utils"
+	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestLockfileScript(t *testing.T) {
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("sha256sum not available")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"0/models/llama.gguf":        "llama weights",
+		"1/models/phi/model.gguf":    "phi weights",
+		"1/models/phi/tokenizer.txt": "tokens",
+		`1/models/phi/we"ird\name`:   "quoted",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries := []lockEntry{
+		{name: "llama", source: "https://example.com/llama.gguf", url: "https://example.com/llama.gguf"},
+		{name: `phi "mini"`, source: "huggingface://org/phi@main/model.gguf", url: "https://huggingface.co/org/phi/resolve/main/model.gguf"},
+	}
+	out := filepath.Join(dir, "out", lockfileName)
+	if output, err := exec.Command("sh", "-c", lockfileScript(entries, dir, out)).CombinedOutput(); err != nil {
+		t.Fatalf("lockfile script failed: %v\n%s", err, output)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock struct {
+		Models []struct {
+			Name   string `json:"name"`
+			Source string `json:"source"`
+			URL    string `json:"url"`
+			Files  []struct {
+				Path   string `json:"path"`
+				SHA256 string `json:"sha256"`
+			} `json:"files"`
+		} `json:"models"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		t.Fatalf("lockfile is not valid JSON: %v\n%s", err, data)
+	}
+	if len(lock.Models) != len(entries) {
+		t.Fatalf("expected %d models, got %d:\n%s", len(entries), len(lock.Models), data)
+	}
+	wantFiles := [][]string{{"/models/llama.gguf"}, {"/models/phi/model.gguf", "/models/phi/tokenizer.txt", `/models/phi/we"ird\name`}}
+	for i, m := range lock.Models {
+		if m.Name != entries[i].name || m.Source != entries[i].source || m.URL != entries[i].url {
+			t.Errorf("model %d = %s %s %s, want %+v", i, m.Name, m.Source, m.URL, entries[i])
+		}
+		if len(m.Files) != len(wantFiles[i]) {
+			t.Fatalf("model %d: expected files %v, got %+v", i, wantFiles[i], m.Files)
+		}
+		for j, f := range m.Files {
+			sum := sha256.Sum256([]byte(files[filepath.Join(strconv.Itoa(i), f.Path)]))
+			if f.Path != wantFiles[i][j] || f.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("model %d file %d = %s %s, want %s %x", i, j, f.Path, f.SHA256, wantFiles[i][j], sum)
+			}
+		}
+	}
+}
+
+func TestCopyModels_Lockfile(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	c := &config.InferenceConfig{
+		WriteLockfile: true,
+		Models: []config.Model{
+			{Name: "llama", Source: "https://example.com/models/llama.gguf"},
+			{Name: "phi", Source: "huggingface://org/phi/phi.Q4_K_M.gguf"},
+			{Name: "mistral", Source: "huggingface://org/mistral@v1/gguf/mistral.gguf"},
+		},
+	}
+	s, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+	if err != nil {
+		t.Fatalf("copyModels failed: %v", err)
+	}
+	def := marshalState(t, s)
+	for _, want := range []string{
+		"/models/aikit-lock.json",
+		`'"llama"' '"https://example.com/models/llama.gguf"' '"https://example.com/models/llama.gguf"'`,
+		`'"phi"' '"huggingface://org/phi/phi.Q4_K_M.gguf"' '"https://huggingface.co/org/phi/resolve/main/phi.Q4_K_M.gguf"'`,
+		`'"https://huggingface.co/org/mistral/resolve/v1/gguf/mistral.gguf"'`,
+		"hash_files '/lock/2'",
+	} {
+		if !strings.Contains(def, want) {
+			t.Errorf("expected LLB to contain %q", want)
+		}
+	}
+
+	c.WriteLockfile = false
+	s, _, err = copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+	if err != nil {
+		t.Fatalf("copyModels failed: %v", err)
+	}
+	if strings.Contains(marshalState(t, s), lockfileName) {
+		t.Error("expected no lockfile unless writeLockfile is set")
+	}
+}
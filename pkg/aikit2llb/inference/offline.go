@@ -0,0 +1,60 @@
+package inference
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/kaito-project/aikit/pkg/aikit/config"
+)
+
+// publicRegistries are the public registry domains that oci:// model sources may not use in
+// offline mode. Their subdomains (e.g. us.gcr.io) are public as well.
+var publicRegistries = []string{
+	"docker.io", "ghcr.io", "quay.io", "gcr.io", "pkg.dev", "mcr.microsoft.com",
+	"public.ecr.aws", "nvcr.io", "registry.k8s.io", ollamaRegistryURL,
+}
+
+// publicHFEndpoints are the public Hugging Face hosts that huggingface:// sources may not be
+// downloaded from in offline mode.
+var publicHFEndpoints = []string{"huggingface.co", "hf.co", "hf-mirror.com"}
+
+// checkOfflineSource returns an error when fetching the source of model needs internet
+// access, which offline builds forbid. These are http(s):// and gs:// sources, oci:// sources
+// on public registries, and huggingface:// sources unless hfEndpoint points at a private
+// mirror. Local paths, oci-layout:// and oci:// sources on other registries are allowed.
+func checkOfflineSource(c *config.InferenceConfig, model config.Model) error {
+	source := model.Source
+	if _, err := url.ParseRequestURI(source); err != nil {
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"), strings.HasPrefix(source, "gs://"):
+	case strings.HasPrefix(source, "huggingface://"):
+		endpoint, err := url.Parse(c.HFEndpoint)
+		if c.HFEndpoint != "" && err == nil && !isPublicHost(endpoint.Hostname(), publicHFEndpoints) {
+			return nil
+		}
+	case strings.HasPrefix(source, "oci://"):
+		named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(source, "oci://"))
+		if err != nil {
+			return fmt.Errorf("model %s: invalid oci source %s: %w", model.Name, source, err)
+		}
+		if !isPublicHost(registryHostname(reference.Domain(named)), publicRegistries) {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return fmt.Errorf("model %s: source %s needs internet access, which offline mode forbids; use a path in the build context, an oci-layout:// directory, a private registry or an hfEndpoint mirror", model.Name, source)
+}
+
+// isPublicHost reports whether host is one of publicHosts or a subdomain of one.
+func isPublicHost(host string, publicHosts []string) bool {
+	host = strings.ToLower(host)
+	return slices.ContainsFunc(publicHosts, func(p string) bool {
+		return host == p || strings.HasSuffix(host, "."+p)
+	})
+}
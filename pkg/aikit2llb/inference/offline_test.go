@@ -0,0 +1,74 @@
+package inference
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kaito-project/aikit/pkg/aikit/config"
+	"github.com/kaito-project/aikit/pkg/utils"
+	"github.com/moby/buildkit/client/llb"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCheckOfflineSource(t *testing.T) {
+	tests := []struct {
+		source     string
+		hfEndpoint string
+		wantErr    bool
+	}{
+		{source: "models/llama.gguf"},
+		{source: "llama.gguf"},
+		{source: "oci-layout:///packs/llama"},
+		{source: "oci://registry.internal:5000/models/llama:v1"},
+		{source: "oci://localhost:5000/llama:v1"},
+		{source: "oci://harbor.corp.example.com/ai/llama@sha256:" + strings.Repeat("a", 64)},
+		{source: "huggingface://org/repo/model.gguf", hfEndpoint: "https://hf.mirror.internal"},
+		{source: "https://example.com/llama.gguf", wantErr: true},
+		{source: "http://files.internal/llama.gguf", wantErr: true},
+		{source: "gs://bucket/llama.gguf", wantErr: true},
+		{source: "huggingface://org/repo/model.gguf", wantErr: true},
+		{source: "huggingface://org/repo/model.gguf", hfEndpoint: "https://huggingface.co", wantErr: true},
+		{source: "huggingface://org/repo/model.gguf", hfEndpoint: "https://hf-mirror.com", wantErr: true},
+		{source: "oci://ghcr.io/org/pack:v1", wantErr: true},
+		{source: "oci://docker.io/org/pack:v1", wantErr: true},
+		{source: "oci://org/pack:v1", wantErr: true},
+		{source: "oci://us-docker.pkg.dev/project/repo/pack:v1", wantErr: true},
+		{source: "oci://us.gcr.io/project/pack:v1", wantErr: true},
+		{source: "oci://registry.ollama.ai/library/llama3:8b", wantErr: true},
+	}
+	for _, tt := range tests {
+		c := &config.InferenceConfig{HFEndpoint: tt.hfEndpoint}
+		err := checkOfflineSource(c, config.Model{Name: "m", Source: tt.source})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkOfflineSource(%s, hfEndpoint %q) = %v, want error %v", tt.source, tt.hfEndpoint, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "offline mode") {
+			t.Errorf("expected an offline mode error for %s, got %v", tt.source, err)
+		}
+	}
+}
+
+func TestCopyModels_Offline(t *testing.T) {
+	platform := specs.Platform{OS: utils.PlatformLinux, Architecture: utils.PlatformAMD64}
+	c := &config.InferenceConfig{
+		Offline: true,
+		Models: []config.Model{
+			{Name: "local", Source: "models/llama.gguf"},
+			{Name: "mirrored", Source: "oci://registry.internal/models/llama:v1"},
+		},
+	}
+	if _, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform); err != nil {
+		t.Fatalf("expected local and mirrored sources to be allowed offline: %v", err)
+	}
+
+	c.Models = append(c.Models, config.Model{Name: "remote", Source: "https://example.com/llama.gguf"})
+	_, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform)
+	if err == nil || !strings.Contains(err.Error(), "model remote: source https://example.com/llama.gguf needs internet access") {
+		t.Errorf("expected offline mode to reject the remote source, got %v", err)
+	}
+
+	c.Offline = false
+	if _, _, err := copyModels(c, llb.Scratch(), llb.Image(utils.UbuntuBase), platform); err != nil {
+		t.Errorf("expected remote sources to be allowed unless offline: %v", err)
+	}
+}
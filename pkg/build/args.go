@@ -3,6 +3,7 @@ package build
 import (
 	"fmt"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/kaito-project/aikit/pkg/aikit/config"
@@ -25,6 +26,63 @@ func parseBuildArgs(opts map[string]string, inferenceCfg *config.InferenceConfig
 		inferenceCfg.Runtime = runtimeArg
 	}
 
+	// Set the HTTP downloader if provided
+	if downloaderArg := getBuildArg(opts, "http_downloader"); downloaderArg != "" {
+		inferenceCfg.HTTPDownloader = downloaderArg
+	}
+
+	// Install CPU variants of all GPU backends if requested
+	if fallbackArg := getBuildArg(opts, "backend_cpu_fallback"); fallbackArg != "" {
+		inferenceCfg.BackendCPUFallback = fallbackArg == "true" || fallbackArg == "1"
+	}
+
+	// Fetch http(s) models with the http-auth secret if requested
+	if authArg := getBuildArg(opts, "http_auth"); authArg != "" {
+		inferenceCfg.HTTPAuth = authArg == "true" || authArg == "1"
+	}
+
+	// Reject model sources that need internet access if requested
+	if offlineArg := getBuildArg(opts, "offline"); offlineArg != "" {
+		inferenceCfg.Offline = offlineArg == "true" || offlineArg == "1"
+	}
+
+	// Set the network connect timeout if provided
+	if timeoutArg := getBuildArg(opts, "network_timeout"); timeoutArg != "" {
+		timeout, err := strconv.Atoi(timeoutArg)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid network_timeout %q, must be a positive number of seconds", timeoutArg)
+		}
+		inferenceCfg.NetworkTimeout = timeout
+	}
+
+	// Set the download retry attempts if provided
+	if retriesArg := getBuildArg(opts, "retries"); retriesArg != "" {
+		retries, err := strconv.Atoi(retriesArg)
+		if err != nil || retries <= 0 {
+			return fmt.Errorf("invalid retries %q, must be a positive number of attempts", retriesArg)
+		}
+		inferenceCfg.Retries = retries
+	}
+
+	// Set the time limit of each download attempt if provided
+	if timeoutArg := getBuildArg(opts, "download_timeout"); timeoutArg != "" {
+		timeout, err := strconv.Atoi(timeoutArg)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid download_timeout %q, must be a positive number of seconds", timeoutArg)
+		}
+		inferenceCfg.DownloadTimeout = timeout
+	}
+
+	// Set the Hugging Face endpoint (e.g. a mirror) if provided
+	if endpointArg := getBuildArg(opts, "hf_endpoint"); endpointArg != "" {
+		inferenceCfg.HFEndpoint = endpointArg
+	}
+
+	// Pull the LocalAI binary from another repository (e.g. a mirror) if provided
+	if registryArg := getBuildArg(opts, "localai_registry"); registryArg != "" {
+		inferenceCfg.LocalAIRegistry = registryArg
+	}
+
 	// Set the model if provided
 	if modelArg != "" {
 		var modelName, modelSource string
@@ -34,7 +92,7 @@ func parseBuildArgs(opts map[string]string, inferenceCfg *config.InferenceConfig
 		switch {
 		case strings.HasPrefix(modelArg, "huggingface://"):
 			// Handle Hugging Face URLs with optional branch
-			modelSource, modelName, err = inference.ParseHuggingFaceURL(modelArg)
+			modelSource, modelName, err = inference.ParseHuggingFaceURL(modelArg, inferenceCfg.HFEndpoint)
 			if err != nil {
 				return err
 			}
@@ -65,6 +123,30 @@ func parseBuildArgs(opts map[string]string, inferenceCfg *config.InferenceConfig
 		inferenceCfg.Config = generateInferenceConfig(modelName)
 	}
 
+	// Select the weight layers of OCI modelpack sources if requested
+	if selectorArg := getBuildArg(opts, "weight_selector"); selectorArg != "" {
+		for i := range inferenceCfg.Models {
+			inferenceCfg.Models[i].WeightSelector = selectorArg
+		}
+	}
+	if mediaTypeArg := getBuildArg(opts, "weight_media_type"); mediaTypeArg != "" {
+		for i := range inferenceCfg.Models {
+			inferenceCfg.Models[i].WeightMediaType = mediaTypeArg
+		}
+	}
+	if shardsArg := getBuildArg(opts, "fetch_shards"); shardsArg == "true" || shardsArg == "1" {
+		for i, m := range inferenceCfg.Models {
+			if strings.HasPrefix(m.Source, "http://") || strings.HasPrefix(m.Source, "https://") {
+				inferenceCfg.Models[i].FetchShards = true
+			}
+		}
+	}
+	if allArg := getBuildArg(opts, "fetch_all_weights"); allArg == "true" || allArg == "1" {
+		for i := range inferenceCfg.Models {
+			inferenceCfg.Models[i].FetchAllWeights = true
+		}
+	}
+
 	return nil
 }
 
@@ -77,22 +159,10 @@ func generateInferenceConfig(modelName string) string {
     model: %[1]s`, modelName)
 }
 
-// parseOCIURL extracts model name for OCI-based models.
+// parseOCIURL extracts model name for OCI-based models, including Ollama registry
+// references: the last path component without its tag or digest.
 func parseOCIURL(source string) string {
-	const ollamaRegistryURL = "registry.ollama.ai"
-	artifactURL := strings.TrimPrefix(source, "oci://")
-	var modelName string
-
-	if strings.HasPrefix(artifactURL, ollamaRegistryURL) {
-		// Special handling for Ollama registry
-		artifactURLWithoutTag := strings.Split(artifactURL, ":")[0]
-		modelName = strings.Split(artifactURLWithoutTag, "/")[2]
-	} else {
-		// Generic OCI artifact
-		modelName = path.Base(artifactURL)
-		modelName = strings.Split(modelName, ":")[0]
-		modelName = strings.Split(modelName, "@")[0]
-	}
-
-	return modelName
+	modelName := path.Base(strings.TrimPrefix(source, "oci://"))
+	modelName = strings.Split(modelName, ":")[0]
+	return strings.Split(modelName, "@")[0]
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"path"
 	"slices"
 	"strings"
 
@@ -34,6 +36,9 @@ const (
 	keyOutput         = "output"
 	keyTargetPlatform = "platform"
 	keyCacheImports   = "cache-imports"
+
+	// keyDockerfileMeta is the result metadata key holding the emitted Dockerfile.
+	keyDockerfileMeta = "aikit.dockerfile"
 )
 
 func Build(ctx context.Context, c client.Client) (*client.Result, error) {
@@ -44,6 +49,8 @@ func Build(ctx context.Context, c client.Client) (*client.Result, error) {
 			return packager.BuildModelpack(ctx, c)
 		case "packager/generic":
 			return packager.BuildGeneric(ctx, c)
+		case "packager/ollama":
+			return packager.BuildOllama(ctx, c)
 		}
 	}
 
@@ -147,6 +154,8 @@ func buildInference(ctx context.Context, c client.Client, cfg *config.InferenceC
 		}
 	}
 
+	emitDockerfile := getBuildArg(opts, "emit_dockerfile") == "true"
+
 	isMultiPlatform := len(targetPlatforms) > 1
 	exportPlatforms := &exptypes.Platforms{
 		Platforms: make([]exptypes.Platform, len(targetPlatforms)),
@@ -167,7 +176,7 @@ func buildInference(ctx context.Context, c client.Client, cfg *config.InferenceC
 						MultiPlatformRequested: isMultiPlatform,
 						CacheImports:           cacheImports,
 					},
-				})
+				}, emitDockerfile)
 				if err != nil {
 					return errors.Wrap(err, "failed to build image")
 				}
@@ -211,6 +220,9 @@ type buildResult struct {
 
 	// Exportable platform information (platform and platform ID)
 	ExportPlatform exptypes.Platform
+
+	// Approximate Dockerfile equivalent of the build, if requested
+	Dockerfile []byte
 }
 
 // AddToClientResult adds the build result to a client result.
@@ -221,14 +233,21 @@ func (br *buildResult) AddToClientResult(cr *client.Result) {
 			br.ImageConfig,
 		)
 		cr.AddRef(br.ExportPlatform.ID, br.Reference)
+		if len(br.Dockerfile) > 0 {
+			cr.AddMeta(fmt.Sprintf("%s/%s", keyDockerfileMeta, br.ExportPlatform.ID), br.Dockerfile)
+		}
 	} else {
 		cr.AddMeta(exptypes.ExporterImageConfigKey, br.ImageConfig)
 		cr.SetRef(br.Reference)
+		if len(br.Dockerfile) > 0 {
+			cr.AddMeta(keyDockerfileMeta, br.Dockerfile)
+		}
 	}
 }
 
 // buildImage builds an image from the given aikitfile config.
-func buildImage(ctx context.Context, c client.Client, cfg *config.InferenceConfig, convertOpts *d2llb.ConvertOpt) (*buildResult, error) {
+// When emitDockerfile is set, an approximate Dockerfile of the build is attached to the result.
+func buildImage(ctx context.Context, c client.Client, cfg *config.InferenceConfig, convertOpts *d2llb.ConvertOpt, emitDockerfile bool) (*buildResult, error) {
 	result := buildResult{
 		Platform:      convertOpts.TargetPlatform,
 		MultiPlatform: convertOpts.MultiPlatformRequested,
@@ -244,6 +263,14 @@ func buildImage(ctx context.Context, c client.Client, cfg *config.InferenceConfi
 		return nil, errors.Wrapf(err, "failed to marshal image config")
 	}
 
+	if emitDockerfile {
+		dockerfile, err := inference.Aikit2Dockerfile(cfg, convertOpts.TargetPlatform)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to emit dockerfile")
+		}
+		result.Dockerfile = []byte(dockerfile)
+	}
+
 	def, err := state.Marshal(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to marshal definition")
@@ -488,11 +515,173 @@ func validateInferenceConfig(c *config.InferenceConfig) error {
 		}
 	}
 
-	runtimes := []string{"", utils.RuntimeNVIDIA, utils.RuntimeAppleSilicon}
+	runtimes := []string{"", utils.RuntimeNVIDIA, utils.RuntimeAppleSilicon, utils.RuntimeIntel}
 	if !slices.Contains(runtimes, c.Runtime) {
 		return errors.Errorf("runtime %s is not supported", c.Runtime)
 	}
 
+	downloaders := []string{"", utils.HTTPDownloaderAria2}
+	if !slices.Contains(downloaders, c.HTTPDownloader) {
+		return errors.Errorf("http downloader %s is not supported", c.HTTPDownloader)
+	}
+	if c.HTTPAuth && c.HTTPDownloader != "" {
+		return errors.Errorf("http downloader %s cannot be used with httpAuth", c.HTTPDownloader)
+	}
+
+	if c.NetworkTimeout < 0 {
+		return errors.Errorf("network timeout %d is not supported, must be a positive number of seconds", c.NetworkTimeout)
+	}
+
+	if c.Retries < 0 {
+		return errors.Errorf("retries %d is not supported, must be a positive number of attempts", c.Retries)
+	}
+
+	if c.DownloadTimeout < 0 {
+		return errors.Errorf("download timeout %d is not supported, must be a positive number of seconds", c.DownloadTimeout)
+	}
+
+	if c.OCIConcurrency < 0 {
+		return errors.Errorf("oci concurrency %d is not supported, must be a positive number of parallel layer downloads", c.OCIConcurrency)
+	}
+
+	for _, r := range c.InsecureRegistries {
+		host := strings.TrimPrefix(strings.TrimPrefix(r, "http://"), "https://")
+		if host = strings.TrimSuffix(host, "/"); host == "" || strings.ContainsAny(host, "/@ ") {
+			return errors.Errorf("insecure registry %q is not supported, must be a registry host with an optional port and http:// prefix", r)
+		}
+	}
+
+	if c.HFEndpoint != "" {
+		if u, err := url.Parse(c.HFEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.Errorf("hugging face endpoint %q is not supported, must be an http(s) URL", c.HFEndpoint)
+		}
+	}
+
+	if c.ModelsPath != "" && (!path.IsAbs(c.ModelsPath) || path.Clean(c.ModelsPath) == "/" || strings.ContainsAny(c.ModelsPath, " \t\n\"'$`\\")) {
+		return errors.Errorf("models path %q is not supported, must be an absolute directory other than / without spaces or quotes", c.ModelsPath)
+	}
+
+	if _, err := inference.ParseLocalAIVersion(c.LocalAIVersion); err != nil {
+		return err
+	}
+	if err := validateRegistry("localAIRegistry", c.LocalAIRegistry); err != nil {
+		return err
+	}
+
+	for _, p := range c.Ports {
+		if _, err := inference.ParsePort(p); err != nil {
+			return err
+		}
+	}
+
+	for k := range c.Env {
+		if k == "" || strings.ContainsAny(k, "= \t\n") {
+			return errors.Errorf("env variable name %q is not supported, must be non-empty without = or spaces", k)
+		}
+	}
+
+	if len(c.Entrypoint) > 0 && strings.TrimSpace(c.Entrypoint[0]) == "" {
+		return errors.New("entrypoint must start with an executable")
+	}
+
+	if h := c.Healthcheck; h != nil {
+		if h.Path != "" && (!strings.HasPrefix(h.Path, "/") || strings.ContainsAny(h.Path, " \t\n\"'%\\")) {
+			return errors.Errorf("healthcheck path %q is not supported, must start with / and contain no spaces, quotes or %%", h.Path)
+		}
+		if h.Port < 0 || h.Port > 65535 {
+			return errors.Errorf("healthcheck port %d is not supported, must be between 1 and 65535", h.Port)
+		}
+		if h.Interval < 0 || h.Timeout < 0 || h.StartPeriod < 0 || h.Retries < 0 {
+			return errors.New("healthcheck interval, timeout, startPeriod and retries must not be negative")
+		}
+	}
+
+	for k := range c.Labels {
+		if strings.TrimSpace(k) == "" {
+			return errors.New("label keys must not be empty")
+		}
+		if strings.HasPrefix(k, inference.LabelPrefix) {
+			return errors.Errorf("label %s is not supported, the %s namespace is reserved for labels set by aikit", k, inference.LabelPrefix)
+		}
+	}
+
+	if err := validateRegistry("backend registry", c.BackendRegistry); err != nil {
+		return err
+	}
+	for b, registry := range c.BackendRegistries {
+		if !slices.Contains(backends, b) {
+			return errors.Errorf("backend registry override for %s is not supported, backend must be one of %s", b, strings.Join(backends, ", "))
+		}
+		if err := validateRegistry("backend registry", registry); err != nil {
+			return err
+		}
+	}
+
+	for arch, sha256 := range c.LocalAISHA256 {
+		if arch != utils.PlatformAMD64 && arch != utils.PlatformARM64 {
+			return errors.Errorf("localAISHA256 architecture %s is not supported, must be %s or %s", arch, utils.PlatformAMD64, utils.PlatformARM64)
+		}
+		if !utils.SHA256Pattern.MatchString(sha256) {
+			return errors.Errorf("localAISHA256 for %s must be 64 lowercase hex characters", arch)
+		}
+	}
+
+	formats := []string{"", utils.PromptTemplateFormatGo, utils.PromptTemplateFormatJinja}
+	weightMediaTypes := []string{"raw", "tar", "tar+gzip", "tar+zstd", "tar+lz4"}
+	for _, m := range c.Models {
+		if _, err := inference.ParseModelFileMode(m.FileMode); err != nil {
+			return errors.Wrapf(err, "model %s", m.Name)
+		}
+		if m.WeightMediaType != "" && !slices.Contains(weightMediaTypes, m.WeightMediaType) {
+			return errors.Errorf("model %s: weight media type %s is not supported, must be one of %s", m.Name, m.WeightMediaType, strings.Join(weightMediaTypes, ", "))
+		}
+		if m.Decompress {
+			if !strings.HasPrefix(m.Source, "http://") && !strings.HasPrefix(m.Source, "https://") {
+				return errors.Errorf("model %s: decompress is only supported for http(s) sources", m.Name)
+			}
+			if _, err := inference.DecompressedName(utils.FileNameFromURL(m.Source)); err != nil {
+				return errors.Wrapf(err, "model %s", m.Name)
+			}
+		}
+		if m.FetchShards {
+			if !strings.HasPrefix(m.Source, "http://") && !strings.HasPrefix(m.Source, "https://") {
+				return errors.Errorf("model %s: fetchShards is only supported for http(s) sources", m.Name)
+			}
+			if _, err := inference.GGUFShardURLs(m.Source); err != nil {
+				return errors.Wrapf(err, "model %s", m.Name)
+			}
+		}
+		if c.ModelSubdirs && m.Name != "" && (path.IsAbs(m.Name) || path.Clean(m.Name) != m.Name || strings.HasPrefix(m.Name, "..") || strings.ContainsAny(m.Name, " \t\n\"'$`\\")) {
+			return errors.Errorf("model name %q cannot be used as a directory with modelSubdirs, must be a relative path without spaces or quotes", m.Name)
+		}
+		for _, pt := range m.PromptTemplates {
+			if !slices.Contains(formats, pt.Format) {
+				return errors.Errorf("prompt template %s format %s is not supported, must be %s or %s", pt.Name, pt.Format, utils.PromptTemplateFormatGo, utils.PromptTemplateFormatJinja)
+			}
+			if pt.Validate && pt.Format != utils.PromptTemplateFormatJinja {
+				return errors.Errorf("prompt template %s validation is only supported for the %s format", pt.Name, utils.PromptTemplateFormatJinja)
+			}
+			if pt.Template != "" && pt.TemplateSource != "" {
+				return errors.Errorf("prompt template %s cannot set both template and templateSource", pt.Name)
+			}
+			if u, err := url.ParseRequestURI(pt.TemplateSource); err == nil && u.Scheme != "http" && u.Scheme != "https" {
+				return errors.Errorf("prompt template %s templateSource %s is not supported, must be an http(s) URL or a path in the build context", pt.Name, pt.TemplateSource)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRegistry checks that a backend or LocalAI registry override, described by kind, is
+// a repository without a tag or digest, since their tags are derived from the LocalAI version.
+func validateRegistry(kind, registry string) error {
+	if registry == "" {
+		return nil
+	}
+	if strings.Contains(registry, "@") || strings.Contains(path.Base(registry), ":") {
+		return errors.Errorf("%s %s must be a repository without a tag or digest", kind, registry)
+	}
 	return nil
 }
 
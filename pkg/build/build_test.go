@@ -2,9 +2,11 @@ package build
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/kaito-project/aikit/pkg/aikit/config"
+	"github.com/kaito-project/aikit/pkg/aikit2llb/inference"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -109,6 +111,452 @@ func Test_validateConfig(t *testing.T) {
 			}},
 			wantErr: true,
 		},
+		{
+			name: "aria2 http downloader",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:     "v1alpha1",
+				HTTPDownloader: "aria2",
+			}},
+			wantErr: false,
+		},
+		{
+			name: "http auth",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				HTTPAuth:   true,
+			}},
+			wantErr: false,
+		},
+		{
+			name: "http auth with aria2",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:     "v1alpha1",
+				HTTPDownloader: "aria2",
+				HTTPAuth:       true,
+			}},
+			wantErr: true,
+		},
+		{
+			name: "invalid http downloader",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:     "v1alpha1",
+				HTTPDownloader: "wget",
+			}},
+			wantErr: true,
+		},
+		{
+			name: "model file mode",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models: []config.Model{
+					{Name: "a", Source: "a.gguf", FileMode: "0644"},
+					{Name: "b", Source: "b.gguf", FileMode: "preserve"},
+				},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "invalid model file mode",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models:     []config.Model{{Name: "a", Source: "a.gguf", FileMode: "rwx"}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "negative network timeout",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:     "v1alpha1",
+				NetworkTimeout: -1,
+			}},
+			wantErr: true,
+		},
+		{
+			name: "hugging face mirror",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				HFEndpoint: "https://hf-mirror.com",
+			}},
+			wantErr: false,
+		},
+		{
+			name: "invalid hugging face endpoint",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				HFEndpoint: "hf-mirror.com",
+			}},
+			wantErr: true,
+		},
+		{
+			name: "custom models path",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				ModelsPath: "/data/models",
+			}},
+			wantErr: false,
+		},
+		{
+			name: "relative models path",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				ModelsPath: "data/models",
+			}},
+			wantErr: true,
+		},
+		{
+			name: "root models path",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				ModelsPath: "/",
+			}},
+			wantErr: true,
+		},
+		{
+			name: "model subdirs",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:   "v1alpha1",
+				ModelSubdirs: true,
+				Models:       []config.Model{{Name: "org/llama", Source: "llama.gguf"}},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "model subdirs with escaping name",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:   "v1alpha1",
+				ModelSubdirs: true,
+				Models:       []config.Model{{Name: "../llama", Source: "llama.gguf"}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "decompress gzipped model",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models:     []config.Model{{Name: "llama", Source: "https://example.com/llama.gguf.gz", Decompress: true}},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "decompress uncompressed model",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models:     []config.Model{{Name: "llama", Source: "https://example.com/llama.gguf", Decompress: true}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "decompress local model",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models:     []config.Model{{Name: "llama", Source: "llama.gguf.gz", Decompress: true}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "weight media type",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models:     []config.Model{{Name: "llama", Source: "oci://ghcr.io/org/pack:v1", WeightMediaType: "tar+zstd"}},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "invalid weight media type",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models:     []config.Model{{Name: "llama", Source: "oci://ghcr.io/org/pack:v1", WeightMediaType: "gguf"}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "insecure registries",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:         "v1alpha1",
+				InsecureRegistries: []string{"registry.internal:5000", "http://plain.internal"},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "insecure registry with path",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:         "v1alpha1",
+				InsecureRegistries: []string{"registry.internal/org/pack"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "fetch shards",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models:     []config.Model{{Name: "llama", Source: "https://example.com/llama-00001-of-00002.gguf", FetchShards: true}},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "fetch shards without shard file name",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models:     []config.Model{{Name: "llama", Source: "https://example.com/llama.gguf", FetchShards: true}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "negative download timeout",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:      "v1alpha1",
+				DownloadTimeout: -1,
+			}},
+			wantErr: true,
+		},
+		{
+			name: "negative retries",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Retries:    -1,
+			}},
+			wantErr: true,
+		},
+		{
+			name: "pinned localai version",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:     "v1alpha1",
+				LocalAIVersion: "sha-1a0d06f",
+			}},
+			wantErr: false,
+		},
+		{
+			name: "invalid localai version",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:     "v1alpha1",
+				LocalAIVersion: "latest",
+			}},
+			wantErr: true,
+		},
+		{
+			name: "localai sha256",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:    "v1alpha1",
+				LocalAISHA256: map[string]string{"amd64": strings.Repeat("a", 64)},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "invalid localai sha256",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:    "v1alpha1",
+				LocalAISHA256: map[string]string{"amd64": "abc"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "localai sha256 for unsupported architecture",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:    "v1alpha1",
+				LocalAISHA256: map[string]string{"riscv64": strings.Repeat("a", 64)},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "jinja prompt template with validation",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models: []config.Model{{Name: "a", Source: "a.gguf", PromptTemplates: []config.PromptTemplate{
+					{Name: "chat", Template: "{{ messages }}", Format: "jinja", Validate: true},
+				}}},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "unsupported prompt template format",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models: []config.Model{{Name: "a", Source: "a.gguf", PromptTemplates: []config.PromptTemplate{
+					{Name: "chat", Template: "x", Format: "mustache"},
+				}}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "prompt template validation without jinja",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models: []config.Model{{Name: "a", Source: "a.gguf", PromptTemplates: []config.PromptTemplate{
+					{Name: "chat", Template: "{{.Input}}", Validate: true},
+				}}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "prompt template sources",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models: []config.Model{{Name: "a", Source: "a.gguf", PromptTemplates: []config.PromptTemplate{
+					{Name: "chat", TemplateSource: "templates/chat.tmpl"},
+					{Name: "jinja", TemplateSource: "https://example.com/chat_template.jinja", Format: "jinja", Validate: true},
+				}}},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "prompt template with template and templateSource",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models: []config.Model{{Name: "a", Source: "a.gguf", PromptTemplates: []config.PromptTemplate{
+					{Name: "chat", Template: "{{.Input}}", TemplateSource: "templates/chat.tmpl"},
+				}}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "unsupported prompt template source scheme",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Models: []config.Model{{Name: "a", Source: "a.gguf", PromptTemplates: []config.PromptTemplate{
+					{Name: "chat", TemplateSource: "s3://bucket/chat.tmpl"},
+				}}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "labels",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Labels:     map[string]string{"org.opencontainers.image.source": "https://github.com/org/repo"},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "reserved label",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Labels:     map[string]string{inference.LabelPrefix + "localai.version": "v1.0.0"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "empty label key",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Labels:     map[string]string{" ": "x"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "custom entrypoint, cmd and healthcheck",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:  "v1alpha1",
+				Entrypoint:  []string{"local-ai"},
+				Cmd:         []string{"run", "--address=:9090"},
+				Healthcheck: &config.Healthcheck{Path: "/healthz", Port: 9090, Interval: 30},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "empty entrypoint executable",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Entrypoint: []string{"", "run"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "healthcheck path with quotes",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:  "v1alpha1",
+				Healthcheck: &config.Healthcheck{Path: "/readyz'"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "healthcheck port out of range",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:  "v1alpha1",
+				Healthcheck: &config.Healthcheck{Port: 70000},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "negative healthcheck interval",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:  "v1alpha1",
+				Healthcheck: &config.Healthcheck{Interval: -1},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "env",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Env:        map[string]string{"LOCALAI_THREADS": "8", "HF_HOME": "/cache"},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "env name with =",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Env:        map[string]string{"A=B": "c"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "ports",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Ports:      []string{"8080", "9090/tcp", "5353/udp"},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "invalid port",
+			args: args{c: &config.InferenceConfig{
+				APIVersion: "v1alpha1",
+				Ports:      []string{"http/tcp"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "backend registry overrides",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:        "v1alpha1",
+				BackendRegistry:   "registry.internal:5000/backends",
+				BackendRegistries: map[string]string{"exllama2": "registry.internal/exllama"},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "backend registry with tag",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:      "v1alpha1",
+				BackendRegistry: "registry.internal/backends:latest",
+			}},
+			wantErr: true,
+		},
+		{
+			name: "localai registry override",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:      "v1alpha1",
+				LocalAIRegistry: "registry.internal:5000/localai",
+			}},
+			wantErr: false,
+		},
+		{
+			name: "localai registry with tag",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:      "v1alpha1",
+				LocalAIRegistry: "registry.internal/localai:v3.8.0",
+			}},
+			wantErr: true,
+		},
+		{
+			name: "backend registry override for unknown backend",
+			args: args{c: &config.InferenceConfig{
+				APIVersion:        "v1alpha1",
+				BackendRegistries: map[string]string{"vllm": "registry.internal/vllm"},
+			}},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -391,3 +839,13 @@ func Test_defaultsUnslothConfig(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseBuildArgs_LocalAIRegistry(t *testing.T) {
+	cfg := &config.InferenceConfig{LocalAIRegistry: "registry.internal/localai"}
+	if err := parseBuildArgs(map[string]string{"build-arg:localai_registry": "mirror.example.com/localai"}, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.LocalAIRegistry != "mirror.example.com/localai" {
+		t.Errorf("expected the build-arg to override localAIRegistry, got %q", cfg.LocalAIRegistry)
+	}
+}
@@ -4,13 +4,35 @@
 package packager
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/containerd/platforms"
+	"github.com/kaito-project/aikit/pkg/utils"
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/solver/pb"
 	v1 "github.com/modelpack/model-spec/specs-go/v1"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -18,8 +40,35 @@ const (
 	packModeRaw         = "raw"
 	defaultPlatformOS   = "linux"
 	defaultPlatformArch = "amd64"
+
+	// platformNone is the platform build-arg value for platform-agnostic generic artifacts.
+	platformNone = "none"
+
+	// dryRunScriptKey and dryRunLLBKey are the result metadata keys holding the rendered
+	// packaging script and the JSON dump of the LLB definition in dry-run mode. BuildKit
+	// copies frontend.* keys into the solve response, so they reach --metadata-file.
+	dryRunScriptKey = "frontend.packager.script"
+	dryRunLLBKey    = "frontend.packager.llb"
+
+	// defaultDiskHeadroom is the free space, in percent of the source size, required beyond it before packaging.
+	defaultDiskHeadroom = 10
 )
 
+// includePresets maps preset build-arg values to the Hugging Face include patterns they expand to.
+var includePresets = map[string]string{
+	// tokenizer fetches only the files needed to tokenize, for preprocessing images without weights.
+	"tokenizer": "'tokenizer*' '*.model' 'merges.txt' 'vocab.json' 'special_tokens_map.json'",
+}
+
+// packModes lists the supported layer_packaging values.
+var packModes = []string{packModeRaw, "tar", "tar+gzip", "tar+zstd", "tar+lz4"}
+
+// compressionLevels maps compressed pack modes to the highest compression_level they accept.
+var compressionLevels = map[string]int{"tar+gzip": 9, "tar+zstd": 19, "tar+lz4": 12}
+
+// solveRetryBackoff is the delay before the first solve retry; it doubles with each further retry.
+var solveRetryBackoff = 2 * time.Second
+
 // buildConfig holds common build parameters extracted from BuildKit options.
 type buildConfig struct {
 	source            string
@@ -30,6 +79,15 @@ type buildConfig struct {
 	sessionID         string
 	genericOutputMode string
 	debug             bool
+	// dryRun returns the rendered script and LLB as result metadata instead of solving.
+	dryRun       bool
+	solveRetries int
+	// platform is the OS/architecture recorded in the image config; zero for platform-agnostic artifacts.
+	platform ocispec.Platform
+	// sourceDate is the source_date_epoch time recorded as the image config created time; nil omits it.
+	sourceDate *time.Time
+	scriptOptions
+	sourceOptions
 }
 
 // parseBuildConfig extracts and validates build configuration from BuildKit options.
@@ -39,9 +97,11 @@ func parseBuildConfig(opts map[string]string, sessionID string, isModelpack bool
 		exclude:   getBuildArg(opts, "exclude"),
 		packMode:  getBuildArg(opts, "layer_packaging"),
 		name:      determineName(opts),
+		platform:  ocispec.Platform{OS: defaultPlatformOS, Architecture: defaultPlatformArch},
 		refName:   determineRefName(opts),
 		sessionID: sessionID,
 		debug:     getBuildArg(opts, "debug") == "1",
+		dryRun:    getBoolBuildArg(opts, "dry_run"),
 	}
 
 	if cfg.source == "" {
@@ -55,24 +115,330 @@ func parseBuildConfig(opts map[string]string, sessionID string, isModelpack bool
 	if cfg.packMode == "" {
 		cfg.packMode = packModeRaw
 	}
+	if !slices.Contains(packModes, cfg.packMode) {
+		return nil, fmt.Errorf("invalid pack mode %q, must be one of %s", cfg.packMode, strings.Join(packModes, ", "))
+	}
+
+	cfg.include = getBuildArg(opts, "include")
+	if v := getBuildArg(opts, "preset"); v != "" {
+		patterns, ok := includePresets[v]
+		if !ok {
+			return nil, fmt.Errorf("invalid preset %q, must be tokenizer", v)
+		}
+		cfg.include = strings.TrimSpace(cfg.include + " " + patterns)
+	}
+	cfg.prune = getBuildArg(opts, "prune")
+
+	cfg.httpDownloader = getBuildArg(opts, "http_downloader")
+	if cfg.httpDownloader != "" && cfg.httpDownloader != utils.HTTPDownloaderAria2 {
+		return nil, fmt.Errorf("invalid http_downloader %q, must be %s", cfg.httpDownloader, utils.HTTPDownloaderAria2)
+	}
+	cfg.httpAuth = getBoolBuildArg(opts, "http_auth")
+	if cfg.httpAuth && cfg.httpDownloader != "" {
+		return nil, fmt.Errorf("http_downloader %s cannot be used with http_auth", cfg.httpDownloader)
+	}
+
+	cfg.networkTimeout = utils.DefaultNetworkTimeout
+	if v := getBuildArg(opts, "network_timeout"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid network_timeout %q, must be a positive number of seconds", v)
+		}
+		cfg.networkTimeout = n
+	}
+
+	cfg.retries = utils.DefaultRetries
+	if v := getBuildArg(opts, "retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid retries %q, must be a positive number of attempts", v)
+		}
+		cfg.retries = n
+	}
+
+	if v := getBuildArg(opts, "download_timeout"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid download_timeout %q, must be a positive number of seconds", v)
+		}
+		cfg.downloadTimeout = n
+	}
+
+	cfg.hfEndpoint = getBuildArg(opts, "hf_endpoint")
+	if cfg.hfEndpoint != "" {
+		if u, err := url.Parse(cfg.hfEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid hf_endpoint %q, must be an http(s) URL", cfg.hfEndpoint)
+		}
+	}
+
+	if v := getBuildArg(opts, "hf_workers"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid hf_workers %q, must be a positive integer", v)
+		}
+		cfg.hfWorkers = n
+	}
+
+	if v := getBuildArg(opts, "solve_retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid solve_retries %q, must be a non-negative integer", v)
+		}
+		cfg.solveRetries = n
+	}
+
+	cfg.sha256 = getBuildArg(opts, "sha256")
+	if cfg.sha256 != "" && !utils.SHA256Pattern.MatchString(cfg.sha256) {
+		return nil, fmt.Errorf("invalid sha256 %q, must be 64 lowercase hex characters", cfg.sha256)
+	}
+
+	if v := getBuildArg(opts, "subject"); v != "" {
+		subject, err := parseSubject(v, getBuildArg(opts, "subject_size"), getBuildArg(opts, "subject_media_type"))
+		if err != nil {
+			return nil, err
+		}
+		cfg.subject = subject
+	}
+
+	if v := getBuildArg(opts, "inline_data"); v != "" {
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inline_data, must be base64 encoded: %w", err)
+		}
+		cfg.inlineData = data
+	}
+
+	if v := getBuildArg(opts, "source_date_epoch"); v != "" {
+		epoch, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || epoch < 0 {
+			return nil, fmt.Errorf("invalid source_date_epoch %q, must be a non-negative unix timestamp", v)
+		}
+		cfg.sourceDateEpoch = epoch
+		date := time.Unix(epoch, 0).UTC()
+		cfg.sourceDate = &date
+		cfg.created = date.Format(time.RFC3339)
+	}
+
+	cfg.diskHeadroom = defaultDiskHeadroom
+	if v := getBuildArg(opts, "disk_headroom"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid disk_headroom %q, must be a non-negative percentage", v)
+		}
+		cfg.diskHeadroom = n
+	}
+
+	if v := getBuildArg(opts, "deterministic"); v != "" {
+		switch v {
+		case "true", "1":
+		case "false", "0":
+			cfg.nondeterministic = true
+		default:
+			return nil, fmt.Errorf("invalid deterministic %q, must be true or false", v)
+		}
+	}
+
+	cfg.allowEmpty = getBoolBuildArg(opts, "allow_empty")
+	cfg.allowEmptyDownload = cfg.allowEmpty
+
+	if v := getBuildArg(opts, "precheck"); v != "" {
+		switch v {
+		case "true", "1":
+		case "false", "0":
+			cfg.skipPrecheck = true
+		default:
+			return nil, fmt.Errorf("invalid precheck %q, must be true or false", v)
+		}
+	}
+
+	if v := getBuildArg(opts, "strip_xattrs"); v != "" {
+		switch v {
+		case "true", "1":
+		case "false", "0":
+			cfg.keepXattrs = true
+		default:
+			return nil, fmt.Errorf("invalid strip_xattrs %q, must be true or false", v)
+		}
+	}
+
+	for _, bound := range []struct {
+		arg  string
+		dest *int64
+	}{{"min_size", &cfg.minSize}, {"max_size", &cfg.maxSize}} {
+		if v := getBuildArg(opts, bound.arg); v != "" {
+			n, err := parseByteSize(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q, must be a positive size in bytes or with a K, M, G or T suffix such as 50G", bound.arg, v)
+			}
+			*bound.dest = n
+		}
+	}
+	if cfg.minSize > 0 && cfg.maxSize > 0 && cfg.minSize > cfg.maxSize {
+		return nil, fmt.Errorf("min_size %d exceeds max_size %d, no file could be packaged", cfg.minSize, cfg.maxSize)
+	}
+
+	if isModelpack {
+		// without source_date_epoch there is no build time to record, so the annotation is omitted
+		cfg.layerCreatedAnnotation = cfg.sourceDate != nil && getBoolBuildArg(opts, "layer_created")
+		if getBoolBuildArg(opts, "layer_source") {
+			src, err := annotationSourceURL(cfg.source)
+			if err != nil {
+				return nil, err
+			}
+			cfg.layerSource = src
+		}
+		cfg.mimeCategorization = getBoolBuildArg(opts, "mime_categorization")
+		cfg.singleLayer = getBoolBuildArg(opts, "single_layer")
+		cfg.skipEmptyFiles = getBoolBuildArg(opts, "skip_empty_files")
+		if v := getBuildArg(opts, "large_file_threshold"); v != "" {
+			n, err := parseByteSize(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid large_file_threshold %q, must be a positive size in bytes or with a K, M, G or T suffix such as 50M", v)
+			}
+			cfg.largeFileThreshold = n
+		}
+		if v := getBuildArg(opts, "category_overrides"); v != "" {
+			overrides, err := parseCategoryOverrides(v)
+			if err != nil {
+				return nil, err
+			}
+			cfg.categoryOverrides = overrides
+		}
+		if v := getBuildArg(opts, "category_pack_modes"); v != "" {
+			if cfg.singleLayer {
+				return nil, fmt.Errorf("category_pack_modes cannot be used with single_layer")
+			}
+			modes, err := parseCategoryPackModes(v)
+			if err != nil {
+				return nil, err
+			}
+			cfg.categoryPackModes = modes
+		}
+		cfg.configFrom = getBuildArg(opts, "config_from")
+		if cfg.configFrom != "" && (path.IsAbs(cfg.configFrom) || strings.HasPrefix(path.Clean(cfg.configFrom), "..")) {
+			return nil, fmt.Errorf("config_from %q must be a relative path inside the source", cfg.configFrom)
+		}
+		switch v := getBuildArg(opts, "model_card"); {
+		case v == "":
+			cfg.modelCard = defaultModelCard
+			cfg.modelCardOptional = true
+		case v == "none":
+		case path.IsAbs(v) || strings.HasPrefix(path.Clean(v), ".."):
+			return nil, fmt.Errorf("model_card %q must be a relative path inside the source", v)
+		default:
+			cfg.modelCard = v
+		}
+		if v := getBuildArg(opts, "category_parallelism"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid category_parallelism %q, must be a positive integer", v)
+			}
+			cfg.categoryJobs = n
+		}
+	}
+
+	// Compression settings apply to every layer written with a compressed mode, whether it
+	// comes from layer_packaging or a category_pack_modes entry
+	modes := cfg.packModeUses()
+	if v := getBuildArg(opts, "compression_level"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid compression_level %q, must be a positive integer", v)
+		}
+		compressed := false
+		for _, u := range modes {
+			maxLevel, ok := compressionLevels[u.mode]
+			if !ok {
+				continue
+			}
+			compressed = true
+			switch {
+			case n <= maxLevel:
+			case u.category == "":
+				return nil, fmt.Errorf("invalid compression_level %q for %s, must be between 1 and %d", v, u.mode, maxLevel)
+			default:
+				return nil, fmt.Errorf("compression_level %d is too high for %s layers packed as %s, must be at most %d", n, u.category, u.mode, maxLevel)
+			}
+		}
+		if !compressed {
+			return nil, fmt.Errorf("compression_level requires layer_packaging or a category_pack_modes entry of tar+gzip, tar+zstd or tar+lz4, got %s", cfg.packMode)
+		}
+		cfg.compressionLevel = n
+	}
+
+	if getBoolBuildArg(opts, "zstd_long") {
+		if !slices.ContainsFunc(modes, func(u packModeUse) bool { return u.mode == "tar+zstd" }) {
+			return nil, fmt.Errorf("zstd_long requires layer_packaging tar+zstd or a category_pack_modes entry using it, got %s", cfg.packMode)
+		}
+		cfg.zstdLong = true
+	}
 
 	if !isModelpack {
 		cfg.genericOutputMode = getBuildArg(opts, "generic_output_mode")
+		switch cfg.genericOutputMode {
+		case "", "files", "tar":
+		default:
+			return nil, fmt.Errorf("invalid generic_output_mode %q, must be files or tar", cfg.genericOutputMode)
+		}
+		switch v := getBuildArg(opts, "platform"); v {
+		case "":
+		case platformNone:
+			cfg.platform = ocispec.Platform{}
+		default:
+			p, err := platforms.Parse(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid platform %q, must be os/arch[/variant] or %s: %w", v, platformNone, err)
+			}
+			cfg.platform = platforms.Normalize(p)
+		}
+		switch v := getBuildArg(opts, "empty_config"); v {
+		case "", "blob":
+		case "inline":
+			cfg.inlineEmptyConfig = true
+		default:
+			return nil, fmt.Errorf("invalid empty_config %q, must be blob or inline", v)
+		}
 	}
 
 	return cfg, nil
 }
 
+// packModeUse is a pack mode layers are written with: the global layer_packaging mode when
+// category is empty, otherwise the category_pack_modes entry of category.
+type packModeUse struct {
+	category string
+	mode     string
+}
+
+// packModeUses returns the pack modes the build writes layers with, in category order. The
+// global mode is left out when category_pack_modes overrides it for every category.
+func (c *buildConfig) packModeUses() []packModeUse {
+	var uses []packModeUse
+	for _, cat := range modelpackCategories {
+		if m, ok := c.categoryPackModes[cat]; ok {
+			uses = append(uses, packModeUse{category: cat, mode: m})
+		}
+	}
+	if len(uses) < len(modelpackCategories) {
+		uses = append([]packModeUse{{mode: c.packMode}}, uses...)
+	}
+	return uses
+}
+
 // solveAndBuildResult is a helper that marshals an LLB state, solves it,
 // and constructs a client.Result with the appropriate image config.
 // This eliminates the repeated marshal→solve→getRef→createConfig→buildResult pattern.
-func solveAndBuildResult(ctx context.Context, c client.Client, state llb.State, customName string) (*client.Result, error) {
+// A failed solve is retried up to retries times with exponential backoff. platform and
+// created, if not nil, are recorded in the image config.
+func solveAndBuildResult(ctx context.Context, c client.Client, state llb.State, customName string, retries int, platform ocispec.Platform, created *time.Time) (*client.Result, error) {
 	def, err := state.Marshal(ctx, llb.WithCustomName(customName))
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal %s LLB definition: %w", customName, err)
 	}
 
-	resSolve, err := c.Solve(ctx, client.SolveRequest{Definition: def.ToPB()})
+	resSolve, err := retrySolve(ctx, retries, func(ctx context.Context) (*client.Result, error) {
+		return c.Solve(ctx, client.SolveRequest{Definition: def.ToPB()})
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to solve %s build: %w", customName, err)
 	}
@@ -82,7 +448,7 @@ func solveAndBuildResult(ctx context.Context, c client.Client, state llb.State,
 		return nil, fmt.Errorf("failed to get %s result reference: %w", customName, err)
 	}
 
-	bCfg, err := createMinimalImageConfig(defaultPlatformOS, defaultPlatformArch)
+	bCfg, err := createMinimalImageConfig(platform, created)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create image config: %w", err)
 	}
@@ -93,6 +459,99 @@ func solveAndBuildResult(ctx context.Context, c client.Client, state llb.State,
 	return out, nil
 }
 
+// dryRunResult marshals state without solving it and returns a result without a reference
+// whose metadata carries the rendered script (empty when none runs) and one JSON line per
+// LLB op, as printed by buildctl debug dump-llb.
+func dryRunResult(ctx context.Context, state llb.State, customName, script string) (*client.Result, error) {
+	def, err := state.Marshal(ctx, llb.WithCustomName(customName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s LLB definition: %w", customName, err)
+	}
+
+	var dump bytes.Buffer
+	enc := json.NewEncoder(&dump)
+	for _, dt := range def.Def {
+		var op pb.Op
+		if err := op.UnmarshalVT(dt); err != nil {
+			return nil, fmt.Errorf("failed to parse %s LLB op: %w", customName, err)
+		}
+		dgst := digest.FromBytes(dt)
+		if err := enc.Encode(struct {
+			Op         *pb.Op
+			Digest     digest.Digest
+			OpMetadata *pb.OpMetadata
+		}{&op, dgst, def.Metadata[dgst].ToPB()}); err != nil {
+			return nil, fmt.Errorf("failed to encode %s LLB op: %w", customName, err)
+		}
+	}
+
+	out := client.NewResult()
+	out.AddMeta(dryRunScriptKey, []byte(script))
+	out.AddMeta(dryRunLLBKey, dump.Bytes())
+	return out, nil
+}
+
+// transientSolveErrorPatterns are lowercase message fragments of network and registry
+// failures that are worth retrying. Errors crossing the gateway often lose their type,
+// so matching the message is the fallback.
+var transientSolveErrorPatterns = []string{
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"i/o timeout",
+	"tls handshake timeout",
+	"temporary failure",
+	"unexpected eof",
+	"too many requests",
+	"service unavailable",
+	"bad gateway",
+	"gateway timeout",
+}
+
+// isTransientSolveError reports whether err looks like a transient network or registry
+// failure rather than a deterministic build error such as a failing script.
+func isTransientSolveError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+			return true
+		}
+	}
+	msg := strings.ToLower(err.Error())
+	for _, p := range transientSolveErrorPatterns {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// retrySolve calls solve, retrying up to retries more times after a transient failure
+// (see isTransientSolveError); other errors are returned immediately. The delay between
+// attempts starts at solveRetryBackoff and doubles; waiting stops early when ctx is done.
+func retrySolve(ctx context.Context, retries int, solve func(context.Context) (*client.Result, error)) (*client.Result, error) {
+	backoff := solveRetryBackoff
+	for attempt := 0; ; attempt++ {
+		res, err := solve(ctx)
+		if err == nil || attempt >= retries || ctx.Err() != nil || !isTransientSolveError(err) {
+			return res, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (retry canceled: %w)", err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
 // BuildModelpack builds a modelpack OCI layout (target packager/modelpack).
 func BuildModelpack(ctx context.Context, c client.Client) (*client.Result, error) {
 	opts := c.BuildOpts().Opts
@@ -103,22 +562,30 @@ func BuildModelpack(ctx context.Context, c client.Client) (*client.Result, error
 		return nil, err
 	}
 
-	modelState, err := resolveSourceState(cfg.source, cfg.sessionID, true, cfg.exclude)
+	modelState, err := resolveSourceState(cfg.source, cfg.sessionID, true, cfg.exclude, cfg.sourceOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve modelpack source %q: %w", cfg.source, err)
 	}
 
 	artifactType := v1.ArtifactTypeModelManifest
 	mtManifest := v1.MediaTypeModelConfig
-	script := generateModelpackScript(cfg.packMode, artifactType, mtManifest, cfg.name, cfg.refName)
+	script := generateModelpackScript(cfg.packMode, artifactType, mtManifest, cfg.name, cfg.refName, cfg.scriptOptions)
 
-	run := llb.Image(bashImage).Run(
+	image := bashImage
+	if cfg.mimeCategorization {
+		// file(1) is installed with apk, which only the dev variant ships
+		image = bashDevImage
+	}
+	run := llb.Image(image).Run(
 		llb.Args([]string{"bash", "-c", script}),
 		llb.AddMount("/src", modelState, llb.Readonly),
 	)
 	final := llb.Scratch().File(llb.Copy(run.Root(), "/layout/", "/"))
 
-	return solveAndBuildResult(ctx, c, final, "packager:modelpack")
+	if cfg.dryRun {
+		return dryRunResult(ctx, final, "packager:modelpack", script)
+	}
+	return solveAndBuildResult(ctx, c, final, "packager:modelpack", cfg.solveRetries, cfg.platform, cfg.sourceDate)
 }
 
 // BuildGeneric builds a generic artifact layout (target packager/generic).
@@ -131,7 +598,7 @@ func BuildGeneric(ctx context.Context, c client.Client) (*client.Result, error)
 		return nil, err
 	}
 
-	srcState, err := resolveSourceState(cfg.source, cfg.sessionID, false, cfg.exclude)
+	srcState, err := resolveSourceState(cfg.source, cfg.sessionID, false, cfg.exclude, cfg.sourceOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve generic source %q: %w", cfg.source, err)
 	}
@@ -141,11 +608,29 @@ func BuildGeneric(ctx context.Context, c client.Client) (*client.Result, error)
 		// This avoids relying on an intermediate run mount (which previously caused
 		// missing /src path errors in some remote source scenarios).
 		final := llb.Scratch().File(llb.Copy(srcState, "/", "/"))
-		return solveAndBuildResult(ctx, c, final, "packager:generic-files")
+		if cfg.dryRun {
+			return dryRunResult(ctx, final, "packager:generic-files", "")
+		}
+		return solveAndBuildResult(ctx, c, final, "packager:generic-files", cfg.solveRetries, cfg.platform, cfg.sourceDate)
+	}
+
+	if cfg.genericOutputMode == "tar" {
+		// Single flattened tarball of the source files, exported as is without an OCI layout.
+		tarName := strings.ReplaceAll(cfg.name, "/", "_") + ".tar"
+		script := generateSingleTarScript(tarName, cfg.debug, cfg.scriptOptions)
+		run := llb.Image(bashImage).Run(
+			llb.Args([]string{"bash", "-c", script}),
+			llb.AddMount("/src", srcState, llb.Readonly),
+		)
+		final := llb.Scratch().File(llb.Copy(run.Root(), "/out/"+tarName, "/"+tarName))
+		if cfg.dryRun {
+			return dryRunResult(ctx, final, "packager:generic-tar", script)
+		}
+		return solveAndBuildResult(ctx, c, final, "packager:generic-tar", cfg.solveRetries, cfg.platform, cfg.sourceDate)
 	}
 
 	artifactType := "application/vnd.unknown.artifact.v1"
-	script := generateGenericScript(cfg.packMode, artifactType, cfg.name, cfg.refName, cfg.debug)
+	script := generateGenericScript(cfg.packMode, artifactType, cfg.name, cfg.refName, cfg.debug, cfg.scriptOptions)
 
 	run := llb.Image(bashImage).Run(
 		llb.Args([]string{"bash", "-c", script}),
@@ -153,7 +638,130 @@ func BuildGeneric(ctx context.Context, c client.Client) (*client.Result, error)
 	)
 	final := llb.Scratch().File(llb.Copy(run.Root(), "/layout/", "/"))
 
-	return solveAndBuildResult(ctx, c, final, "packager:generic")
+	if cfg.dryRun {
+		return dryRunResult(ctx, final, "packager:generic", script)
+	}
+	return solveAndBuildResult(ctx, c, final, "packager:generic", cfg.solveRetries, cfg.platform, cfg.sourceDate)
+}
+
+// byteSizePattern matches an upper-cased size such as 1073741824, 50M, 50MB or 50MIB.
+var byteSizePattern = regexp.MustCompile(`^([0-9]+)(?:([KMGT])(?:I?B)?)?$`)
+
+// parseByteSize parses a positive size in bytes, optionally with a binary K, M, G or T suffix.
+func parseByteSize(v string) (int64, error) {
+	m := byteSizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(v)))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", v, err)
+	}
+	if m[2] != "" {
+		shift := 10 * (strings.Index("KMGT", m[2]) + 1)
+		if n > math.MaxInt64>>shift {
+			return 0, fmt.Errorf("size %q is too large", v)
+		}
+		n <<= shift
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("size %q must be positive", v)
+	}
+	return n, nil
+}
+
+// modelpackCategories lists the modelpack file categories, in layer order.
+var modelpackCategories = []string{"weights", "config", "docs", "code", "dataset"}
+
+// categoryGlobPattern matches a file name glob safe to embed in the categorization case statement.
+var categoryGlobPattern = regexp.MustCompile(`^[a-z0-9._*?\[\]!+-]+$`)
+
+// parseCategoryOverrides parses the category_overrides build-arg, a semicolon-separated
+// list of category:pattern[,pattern...] entries such as "weights:*.onnx,*.mlmodel;config:*.yaml".
+// Patterns are globs matched against the lowercased file name.
+func parseCategoryOverrides(v string) ([]categoryPatterns, error) {
+	var overrides []categoryPatterns
+	for _, entry := range strings.Split(v, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		category, list, ok := strings.Cut(entry, ":")
+		category = strings.TrimSpace(category)
+		if !ok || !slices.Contains(modelpackCategories, category) {
+			return nil, fmt.Errorf("invalid category_overrides entry %q, must be <category>:<pattern>[,<pattern>...] with category one of %s", entry, strings.Join(modelpackCategories, ", "))
+		}
+		c := categoryPatterns{category: category}
+		for _, p := range strings.Split(list, ",") {
+			p = strings.ToLower(strings.TrimSpace(p))
+			if !categoryGlobPattern.MatchString(p) {
+				return nil, fmt.Errorf("invalid category_overrides pattern %q for %s, must be a file name glob such as *.onnx", p, category)
+			}
+			c.patterns = append(c.patterns, p)
+		}
+		overrides = append(overrides, c)
+	}
+	return overrides, nil
+}
+
+// parseCategoryPackModes parses the category_pack_modes build-arg, a semicolon-separated
+// list of category:mode entries such as "weights:raw;docs:tar+zstd".
+func parseCategoryPackModes(v string) (map[string]string, error) {
+	modes := map[string]string{}
+	for _, entry := range strings.Split(v, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		category, mode, ok := strings.Cut(entry, ":")
+		category, mode = strings.TrimSpace(category), strings.TrimSpace(mode)
+		if !ok || !slices.Contains(modelpackCategories, category) {
+			return nil, fmt.Errorf("invalid category_pack_modes entry %q, must be <category>:<mode> with category one of %s", entry, strings.Join(modelpackCategories, ", "))
+		}
+		if !slices.Contains(packModes, mode) {
+			return nil, fmt.Errorf("invalid category_pack_modes mode %q for %s, must be one of %s", mode, category, strings.Join(packModes, ", "))
+		}
+		if _, dup := modes[category]; dup {
+			return nil, fmt.Errorf("invalid category_pack_modes, %s is given more than once", category)
+		}
+		modes[category] = mode
+	}
+	return modes, nil
+}
+
+// annotationSourceURL returns source as recorded in the org.opencontainers.image.source
+// layer annotation, dropping user info, query and fragment as they may carry credentials.
+func annotationSourceURL(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("layer_source requires a remote source URL, got %q", source)
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// mediaTypePattern matches an RFC 6838 media type such as application/vnd.oci.image.manifest.v1+json.
+var mediaTypePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*$`)
+
+// parseSubject builds the manifest subject descriptor from the subject, subject_size and
+// subject_media_type build-args. The media type defaults to an OCI image manifest.
+func parseSubject(dgst, size, mediaType string) (*ocispec.Descriptor, error) {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject %q, must be a digest such as sha256:<hex>: %w", dgst, err)
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid subject_size %q, must be the positive size in bytes of the subject manifest", size)
+	}
+	if mediaType == "" {
+		mediaType = ocispec.MediaTypeImageManifest
+	}
+	if !mediaTypePattern.MatchString(mediaType) {
+		return nil, fmt.Errorf("invalid subject_media_type %q", mediaType)
+	}
+	return &ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: n}, nil
 }
 
 func getBuildArg(opts map[string]string, k string) string {
@@ -165,6 +773,12 @@ func getBuildArg(opts map[string]string, k string) string {
 	return ""
 }
 
+// getBoolBuildArg reports whether the build arg k is set to "true" or "1".
+func getBoolBuildArg(opts map[string]string, k string) bool {
+	v := getBuildArg(opts, k)
+	return v == "true" || v == "1"
+}
+
 // determineRefName returns the reference name to use for index annotations.
 // Only uses build-arg:name if present; otherwise returns "latest".
 func determineRefName(opts map[string]string) string {
@@ -0,0 +1,84 @@
+package packager
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+)
+
+// azureBlobSpec represents a parsed azblob:// reference.
+// Supported forms:
+//
+//	azblob://account/container            -> whole container
+//	azblob://account/container/prefix/    -> every blob under the prefix
+//	azblob://account/container/path/blob  -> single blob
+type azureBlobSpec struct {
+	Account   string
+	Container string
+	BlobPath  string // optional; empty means whole container
+}
+
+var (
+	azureAccountPattern   = regexp.MustCompile(`^[a-z0-9]{3,24}$`)
+	azureContainerPattern = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9]|-[a-z0-9]){2,62}$`)
+)
+
+// parseAzureBlobSpec parses an azblob:// reference into its components, validating the
+// account and container names against Azure Storage naming rules.
+func parseAzureBlobSpec(src string) (*azureBlobSpec, error) {
+	if !strings.HasPrefix(src, "azblob://") {
+		return nil, fmt.Errorf("not an azblob source: %s", src)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(src, "azblob://"), "/", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid azblob spec %s: expected azblob://account/container[/path]", src)
+	}
+	spec := &azureBlobSpec{Account: parts[0], Container: parts[1]}
+	if len(parts) == 3 {
+		spec.BlobPath = parts[2]
+	}
+	if !azureAccountPattern.MatchString(spec.Account) {
+		return nil, fmt.Errorf("invalid azblob storage account %q: must be 3-24 lowercase letters or digits", spec.Account)
+	}
+	if !azureContainerPattern.MatchString(spec.Container) {
+		return nil, fmt.Errorf("invalid azblob container %q: must be 3-63 lowercase letters, digits or single hyphens", spec.Container)
+	}
+	if strings.HasPrefix(spec.BlobPath, "/") || strings.Contains("/"+spec.BlobPath, "/../") {
+		return nil, fmt.Errorf("invalid azblob blob path %q", spec.BlobPath)
+	}
+	return spec, nil
+}
+
+// isPrefix reports whether the spec refers to a container or a prefix rather than a single blob.
+func (s *azureBlobSpec) isPrefix() bool {
+	return s.BlobPath == "" || strings.HasSuffix(s.BlobPath, "/")
+}
+
+// url returns the https endpoint of the referenced blob or prefix.
+func (s *azureBlobSpec) url() string {
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", s.Account, s.Container, s.BlobPath)
+}
+
+// buildAzureBlobState returns an llb.State containing the blobs referenced by an
+// azblob:// source rooted at /. A SAS token or connection string is read from the
+// azure-storage secret if available.
+func buildAzureBlobState(source string) (llb.State, error) {
+	spec, err := parseAzureBlobSpec(source)
+	if err != nil {
+		return llb.State{}, err
+	}
+	dest := "/out/"
+	if !spec.isPrefix() {
+		dest += path.Base(spec.BlobPath)
+	}
+	dlScript := generateAzureBlobDownloadScript(spec.url(), dest, spec.isPrefix())
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"sh", "-c", dlScript}),
+		llb.AddSecret("/run/secrets/azure-storage", llb.SecretID("azure-storage"), llb.SecretOptional),
+	}
+	run := llb.Image(alpineImage).Run(runOpts...)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/out/", "/", &llb.CopyInfo{CopyDirContentsOnly: true})), nil
+}
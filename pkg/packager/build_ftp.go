@@ -0,0 +1,84 @@
+package packager
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+)
+
+// ftpSpec represents a parsed ftp:// or sftp:// reference.
+// Supported forms:
+//
+//	ftp://host[:port]/dir/          -> mirror of the directory
+//	sftp://[user@]host[:port]/file  -> single file
+type ftpSpec struct {
+	Site string // scheme://host[:port]
+	User string // optional; credentials may also come from the ftp-credentials secret
+	Path string
+}
+
+// parseFTPSpec parses an ftp:// or sftp:// reference. Passwords are rejected in the URL
+// so they never end up in the build definition; use the ftp-credentials secret instead.
+func parseFTPSpec(src string) (*ftpSpec, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s source: %w", strings.SplitN(src, ":", 2)[0], err)
+	}
+	if u.Scheme != "ftp" && u.Scheme != "sftp" {
+		return nil, fmt.Errorf("not an ftp or sftp source: %s", src)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid %s source %q: host is empty", u.Scheme, src)
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("invalid %s source %q: pass the password with the ftp-credentials secret, not in the URL", u.Scheme, src)
+	}
+	if strings.ContainsAny(u.Path, "\"\n") || strings.Contains(u.Path+"/", "/../") {
+		return nil, fmt.Errorf("invalid %s path %q", u.Scheme, u.Path)
+	}
+	spec := &ftpSpec{Site: u.Scheme + "://" + u.Host, Path: u.Path}
+	if spec.Path == "" {
+		spec.Path = "/"
+	}
+	if u.User != nil {
+		spec.User = u.User.Username()
+	}
+	return spec, nil
+}
+
+// isDir reports whether the spec refers to a directory to mirror rather than a single file.
+func (s *ftpSpec) isDir() bool {
+	return strings.HasSuffix(s.Path, "/")
+}
+
+// buildFTPState returns an llb.State containing the file or mirrored directory referenced
+// by an ftp:// or sftp:// source rooted at /. Credentials are read from the ftp-credentials
+// secret (user:password) and, for sftp, a private key from the ssh-key secret and the
+// trusted host keys from the ssh-known-hosts secret if available.
+func buildFTPState(source string) (llb.State, error) {
+	spec, err := parseFTPSpec(source)
+	if err != nil {
+		return llb.State{}, err
+	}
+	dlScript := generateFTPDownloadScript(spec.Site, spec.User, spec.Path, spec.isDir())
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"sh", "-c", dlScript}),
+		llb.AddSecret("/run/secrets/ftp-credentials", llb.SecretID("ftp-credentials"), llb.SecretOptional),
+		llb.AddSecret("/run/secrets/ssh-key", llb.SecretID("ssh-key"), llb.SecretOptional),
+		llb.AddSecret("/run/secrets/ssh-known-hosts", llb.SecretID("ssh-known-hosts"), llb.SecretOptional),
+	}
+	run := llb.Image(alpineImage).Run(runOpts...)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/out/", "/", &llb.CopyInfo{CopyDirContentsOnly: true})), nil
+}
+
+// ftpGetCommand returns the lftp command fetching remotePath into /out: a mirror of the
+// directory when dir is true, otherwise the single file.
+func ftpGetCommand(remotePath string, dir bool) string {
+	if dir {
+		return fmt.Sprintf(`mirror --parallel=4 "%s" /out`, remotePath)
+	}
+	return fmt.Sprintf(`get "%s" -o "/out/%s"`, remotePath, path.Base(remotePath))
+}
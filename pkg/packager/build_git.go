@@ -0,0 +1,65 @@
+package packager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+)
+
+// gitSpec represents a parsed git source reference.
+// Supported forms:
+//
+//	git+https://host/org/repo.git        -> default branch
+//	git+https://host/org/repo.git@ref    -> branch, tag or commit
+//	git://host/org/repo.git@ref
+type gitSpec struct {
+	URL string
+	Ref string // optional; empty means the remote's default branch
+}
+
+// parseGitSpec parses a git+https:// or git:// reference. The ref is taken from the
+// last "@" after the host, so credentials in the host part are not mistaken for a ref.
+func parseGitSpec(src string) (*gitSpec, error) {
+	var scheme, rest string
+	switch {
+	case strings.HasPrefix(src, "git+https://"):
+		scheme, rest = "https://", strings.TrimPrefix(src, "git+https://")
+	case strings.HasPrefix(src, "git://"):
+		scheme, rest = "git://", strings.TrimPrefix(src, "git://")
+	default:
+		return nil, fmt.Errorf("not a git source: %s", src)
+	}
+	hostEnd := strings.Index(rest, "/")
+	if hostEnd <= 0 || hostEnd == len(rest)-1 {
+		return nil, fmt.Errorf("invalid git source %s: expected a host and repository path", src)
+	}
+	spec := &gitSpec{}
+	if at := strings.LastIndex(rest, "@"); at > hostEnd {
+		rest, spec.Ref = rest[:at], rest[at+1:]
+		if spec.Ref == "" {
+			return nil, fmt.Errorf("invalid git source %s: empty ref after @", src)
+		}
+	}
+	spec.URL = scheme + rest
+	return spec, nil
+}
+
+// buildGitState returns an llb.State containing the working tree of a git repository
+// (with Git LFS objects fetched) rooted at /, excluding the .git directory. A token for
+// private repositories is read from the git-token secret if available.
+func buildGitState(source string) (llb.State, error) {
+	spec, err := parseGitSpec(source)
+	if err != nil {
+		return llb.State{}, err
+	}
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"sh", "-c", generateGitCloneScript(spec.URL, spec.Ref)}),
+		llb.AddSecret("/run/secrets/git-token", llb.SecretID("git-token"), llb.SecretOptional),
+	}
+	run := llb.Image(alpineImage).Run(runOpts...)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/out/", "/", &llb.CopyInfo{
+		CopyDirContentsOnly: true,
+		ExcludePatterns:     []string{".git"},
+	})), nil
+}
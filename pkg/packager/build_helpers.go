@@ -3,41 +3,111 @@ package packager
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/kaito-project/aikit/pkg/utils"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // Shared container image references.
 const (
-	bashImage  = "cgr.dev/chainguard/bash:latest"
-	hfCLIImage = "ghcr.io/kaito-project/aikit/hf-cli:latest"
+	bashImage = "cgr.dev/chainguard/bash:latest"
+	// bashDevImage is the bash image variant shipping apk, used when the script installs packages.
+	bashDevImage = "cgr.dev/chainguard/bash:latest-dev"
+	hfCLIImage   = "ghcr.io/kaito-project/aikit/hf-cli:latest"
+	awsCLIImage  = "public.ecr.aws/aws-cli/aws-cli:2.22.0"
+	alpineImage  = "docker.io/library/alpine:3.20"
 )
 
-// generateHFDownloadScript returns a shell script that downloads a Hugging Face
-// repository snapshot deterministically, honoring an optional token exposed
+// hfDownloadOptions configures a Hugging Face snapshot download (see generateHFDownloadScript).
+type hfDownloadOptions struct {
+	// exclude is an optional space-separated list of patterns (e.g., "'original/*' 'metal/*'")
+	// passed as separate --exclude flags to the hf download command.
+	exclude string
+	// include uses the same syntax and is passed as separate --include flags, restricting
+	// the download to matching files. When both are set, both flag groups are emitted.
+	include string
+	// prune uses the same syntax but is applied after the download: matching paths are deleted
+	// from /out, so the full snapshot is still fetched (and cached) but left out of the pack.
+	prune string
+	// endpoint is exported as HF_ENDPOINT so the hf CLI can use a mirror (see utils.HFEndpoint).
+	endpoint string
+	// timeout is the number of seconds the hf CLI may wait on metadata and download connections.
+	timeout int
+	// retries is the number of download attempts, spaced with exponential backoff.
+	retries int
+	// downloadTimeout, when positive, bounds each attempt in seconds (see utils.TimeoutFunc).
+	downloadTimeout int
+	// workers, when positive, is passed as --max-workers to parallelize the download.
+	workers int
+	// precheck fetches the repository metadata first so a missing or private model fails
+	// the build before the snapshot download begins.
+	precheck bool
+	// allowEmpty lets a download that (after pruning) left no files in /out succeed.
+	allowEmpty bool
+}
+
+// generateHFDownloadScript returns a shell script that downloads the namespace/model
+// repository snapshot at revision deterministically, honoring an optional token exposed
 // through a BuildKit secret at /run/secrets/hf-token.
-// exclude is an optional space-separated list of patterns (e.g., "'original/*' 'metal/*'")
-// which will be passed as separate --exclude flags to the hf download command.
-func generateHFDownloadScript(namespace, model, revision, exclude string) string {
+func generateHFDownloadScript(namespace, model, revision string, opts hfDownloadOptions) string {
+	timeoutFunc, timeoutPrefix := utils.TimeoutFunc(opts.downloadTimeout)
+	// Each pattern requires its own --exclude or --include flag per hf cli syntax
 	excludeFlags := ""
-	if exclude != "" {
-		// Parse the exclude patterns: they come in as "'pattern1' 'pattern2'"
-		// We need to convert this to: --exclude 'pattern1' --exclude 'pattern2'
-		// Each pattern requires its own --exclude flag per hf cli syntax
-		patterns := parseExcludePatterns(exclude)
-		for _, pattern := range patterns {
-			excludeFlags += fmt.Sprintf(" --exclude '%s'", pattern)
-		}
+	for _, pattern := range parseExcludePatterns(opts.exclude) {
+		excludeFlags += fmt.Sprintf(" --exclude '%s'", pattern)
+	}
+	includeFlags := ""
+	for _, pattern := range parseExcludePatterns(opts.include) {
+		includeFlags += fmt.Sprintf(" --include '%s'", pattern)
+	}
+	workerFlag := ""
+	if opts.workers > 0 {
+		workerFlag = fmt.Sprintf(" --max-workers %d", opts.workers)
+	}
+	// Patterns match the path relative to /out, with * crossing directories like hf's filters
+	pruneCmds := ""
+	for _, pattern := range parseExcludePatterns(opts.prune) {
+		pruneCmds += fmt.Sprintf("find /out -mindepth 1 -path '/out/%s' -prune -exec rm -rf {} +\n", pattern)
+	}
+	precheckCmd := ""
+	if opts.precheck {
+		precheckCmd = hfPrecheckCommand(namespace, model, revision, opts.timeout)
+	}
+	emptyGuard := ""
+	if !opts.allowEmpty {
+		emptyGuard = fmt.Sprintf(`if [ -z "$(find /out -type f | head -1)" ]; then
+	echo "no files downloaded/matched from %s/%s; check include/exclude/prune or set allow_empty=true" >&2
+	exit 1
+fi
+`, namespace, model)
 	}
 	return fmt.Sprintf(`set -euo pipefail
+%s%s
 if [ -f /run/secrets/hf-token ]; then export HF_TOKEN="$(cat /run/secrets/hf-token)"; fi
-mkdir -p /out
-hf download %s/%s --revision %s --local-dir /out%s
+export HF_ENDPOINT=%s
+export HF_HUB_ETAG_TIMEOUT=%d HF_HUB_DOWNLOAD_TIMEOUT=%d
+%smkdir -p /out
+retry %shf download %s/%s --revision %s --local-dir /out%s%s%s
 # remove transient cache / lock artifacts
 rm -rf /out/.cache || true
 find /out -type f -name '*.lock' -delete || true
-`, namespace, model, revision, excludeFlags)
+%s%s`, timeoutFunc, strings.TrimSuffix(utils.RetryFunc(opts.retries), "\n"), utils.ShellQuote(utils.HFEndpoint(opts.endpoint)), opts.timeout, opts.timeout, precheckCmd, timeoutPrefix, namespace, model, revision, includeFlags, workerFlag, excludeFlags, pruneCmds, emptyGuard)
+}
+
+// hfPrecheckCommand returns the shell lines that query the metadata of a Hugging Face
+// model (the /api/models/<namespace>/<model> endpoint) at revision and exit with a clear
+// error when it is not found or not accessible, instead of failing deep in the download.
+// The query uses the exported HF_ENDPOINT and HF_TOKEN and gives up after timeout seconds.
+func hfPrecheckCommand(namespace, model, revision string, timeout int) string {
+	return fmt.Sprintf(`# Check that the model exists and is accessible before downloading it
+if ! python3 -c 'import sys; from huggingface_hub import HfApi; HfApi().model_info(sys.argv[1], revision=sys.argv[2], timeout=float(sys.argv[3]))' %[1]s %[2]s %[3]d >/dev/null; then
+	echo "huggingface model %[1]s (revision %[2]s) not found or private; check the name and provide the hf-token secret for gated or private models" >&2
+	exit 1
+fi
+`, namespace+"/"+model, revision, timeout)
 }
 
 // parseExcludePatterns takes a string like "'original/*' 'metal/*'" and returns
@@ -80,24 +150,185 @@ func parseExcludePatterns(exclude string) []string {
 
 // generateHFSingleFileDownloadScript downloads a single file from a Hugging Face
 // repository deterministically. filePath is the relative path inside the repo.
-func generateHFSingleFileDownloadScript(namespace, model, revision, filePath string) string {
-	return fmt.Sprintf(`set -euo pipefail
+// When sha256 is non-empty, the downloaded file is verified against it and the script
+// fails on mismatch. endpoint, timeout, retries and downloadTimeout are applied as in
+// generateHFDownloadScript.
+func generateHFSingleFileDownloadScript(namespace, model, revision, filePath, sha256, endpoint string, timeout, retries, downloadTimeout int) string {
+	timeoutFunc, timeoutPrefix := utils.TimeoutFunc(downloadTimeout)
+	script := fmt.Sprintf(`set -euo pipefail
+%s%s
 if [ -f /run/secrets/hf-token ]; then export HF_TOKEN="$(cat /run/secrets/hf-token)"; fi
+export HF_ENDPOINT=%s
+export HF_HUB_ETAG_TIMEOUT=%d HF_HUB_DOWNLOAD_TIMEOUT=%d
 mkdir -p /out
-hf download %s/%s %s --revision %s --local-dir /out
+retry %shf download %s/%s %s --revision %s --local-dir /out
 # remove transient cache / lock artifacts
 rm -rf /out/.cache || true
 find /out -type f -name '*.lock' -delete || true
-`, namespace, model, filePath, revision)
+`, timeoutFunc, strings.TrimSuffix(utils.RetryFunc(retries), "\n"), utils.ShellQuote(utils.HFEndpoint(endpoint)), timeout, timeout, timeoutPrefix, namespace, model, filePath, revision)
+	if sha256 != "" {
+		script += fmt.Sprintf(`if ! echo '%[1]s  /out/%[2]s' | sha256sum -c -; then
+	echo "sha256 mismatch for %[2]s" >&2
+	exit 1
+fi
+`, sha256, filePath)
+	}
+	return script
+}
+
+// generateHFMultiFileDownloadScript downloads several files from a Hugging Face repository,
+// issuing one hf download per file into /out. files are relative paths inside the repo;
+// endpoint, timeout, retries and downloadTimeout are applied as in generateHFDownloadScript.
+func generateHFMultiFileDownloadScript(namespace, model, revision string, files []string, endpoint string, timeout, retries, downloadTimeout int) string {
+	timeoutFunc, timeoutPrefix := utils.TimeoutFunc(downloadTimeout)
+	var downloads strings.Builder
+	for _, f := range files {
+		fmt.Fprintf(&downloads, "retry %shf download %s/%s %s --revision %s --local-dir /out\n", timeoutPrefix, namespace, model, f, revision)
+	}
+	return fmt.Sprintf(`set -euo pipefail
+%s%s
+if [ -f /run/secrets/hf-token ]; then export HF_TOKEN="$(cat /run/secrets/hf-token)"; fi
+export HF_ENDPOINT=%s
+export HF_HUB_ETAG_TIMEOUT=%d HF_HUB_DOWNLOAD_TIMEOUT=%d
+mkdir -p /out
+%s# remove transient cache / lock artifacts
+rm -rf /out/.cache || true
+find /out -type f -name '*.lock' -delete || true
+`, timeoutFunc, strings.TrimSuffix(utils.RetryFunc(retries), "\n"), utils.ShellQuote(utils.HFEndpoint(endpoint)), timeout, timeout, downloads.String())
+}
+
+// generateS3DownloadScript downloads an S3 object (or every object under a prefix when
+// recursive is true) into /out, honoring an optional AWS shared credentials file exposed
+// through a BuildKit secret at /run/secrets/aws-credentials.
+func generateS3DownloadScript(uri string, recursive bool) string {
+	recursiveFlag := ""
+	if recursive {
+		recursiveFlag = " --recursive"
+	}
+	return fmt.Sprintf(`set -euo pipefail
+# anonymous (unsigned) requests unless credentials are provided
+sign="--no-sign-request"
+if [ -f /run/secrets/aws-credentials ]; then export AWS_SHARED_CREDENTIALS_FILE=/run/secrets/aws-credentials; sign=""; fi
+mkdir -p /out
+aws s3 cp $sign%s %s /out/
+`, recursiveFlag, utils.ShellQuote(uri))
+}
+
+// generateAzureBlobDownloadScript downloads an Azure blob (or every blob under a prefix
+// when recursive is true) from blobURL into dest with azcopy. The azure-storage secret may
+// hold a SAS token or a connection string carrying a SharedAccessSignature.
+func generateAzureBlobDownloadScript(blobURL, dest string, recursive bool) string {
+	src := blobURL
+	flags := ""
+	if recursive {
+		src = strings.TrimSuffix(blobURL, "/") + "/*"
+		flags = " --recursive"
+	}
+	return fmt.Sprintf(`set -eu
+apk add --no-cache curl tar >/dev/null
+suffix=""
+[ "$(uname -m)" = "aarch64" ] && suffix="-arm64"
+curl -fsSL "https://aka.ms/downloadazcopy-v10-linux$suffix" | tar -xz --strip-components=1 -C /usr/local/bin --wildcards '*/azcopy'
+sas=""
+if [ -s /run/secrets/azure-storage ]; then
+	cred=$(cat /run/secrets/azure-storage)
+	case "$cred" in
+		*SharedAccessSignature=*) sas=$(printf '%%s' "$cred" | tr ';' '\n' | sed -n 's/^SharedAccessSignature=//p') ;;
+		*AccountKey=*) echo "azure-storage secret: account key connection strings are not supported by azcopy, provide a SAS token or a connection string with SharedAccessSignature" >&2; exit 1 ;;
+		*) sas=${cred#\?} ;;
+	esac
+fi
+query=""
+[ -n "$sas" ] && query="?$sas"
+mkdir -p /out
+azcopy copy %s"$query" %s%s --log-level ERROR
+`, utils.ShellQuote(src), utils.ShellQuote(dest), flags)
+}
+
+// generateFTPDownloadScript downloads remotePath from an ftp:// or sftp:// site into /out
+// with lftp, mirroring it when dir is true. Credentials come from /run/secrets/ftp-credentials
+// as user:password (user from the URL otherwise, anonymous for ftp without either), and an
+// sftp private key from /run/secrets/ssh-key. sftp host keys are verified against
+// /run/secrets/ssh-known-hosts when present, and trusted on first use otherwise.
+func generateFTPDownloadScript(site, user, remotePath string, dir bool) string {
+	return fmt.Sprintf(`set -eu
+apk add --no-cache lftp openssh-client >/dev/null
+mkdir -p /out
+site=%[3]s
+cat > /tmp/ftp.lftp <<'LFTP'
+set net:max-retries 3
+set net:timeout 30
+LFTP
+ssh_cmd="ssh -a -x"
+if [ -s /run/secrets/ssh-key ]; then
+	install -m 600 /run/secrets/ssh-key /tmp/ssh-key
+	ssh_cmd="$ssh_cmd -i /tmp/ssh-key"
+fi
+if [ -s /run/secrets/ssh-known-hosts ]; then
+	install -m 600 /run/secrets/ssh-known-hosts /tmp/known_hosts
+	ssh_cmd="$ssh_cmd -o UserKnownHostsFile=/tmp/known_hosts -o StrictHostKeyChecking=yes"
+	echo 'set sftp:auto-confirm no' >> /tmp/ftp.lftp
+else
+	case "$site" in
+		sftp://*) echo "[WARNING] no ssh-known-hosts secret, trusting the host key of $site on first use" >&2 ;;
+	esac
+	ssh_cmd="$ssh_cmd -o StrictHostKeyChecking=accept-new"
+	echo 'set sftp:auto-confirm yes' >> /tmp/ftp.lftp
+fi
+echo "set sftp:connect-program \"$ssh_cmd\"" >> /tmp/ftp.lftp
+cat >> /tmp/ftp.lftp <<'LFTP'
+%[1]s
+bye
+LFTP
+user=%[2]s
+if [ -s /run/secrets/ftp-credentials ]; then
+	cred=$(cat /run/secrets/ftp-credentials)
+	case "$cred" in
+		*:*) set -- -u "${cred%%%%:*},${cred#*:}" ;;
+		*) set -- -u "$cred," ;;
+	esac
+elif [ -n "$user" ]; then
+	set -- -u "$user,"
+else
+	set --
+fi
+lftp "$@" -e 'source /tmp/ftp.lftp' "$site"
+`, ftpGetCommand(remotePath, dir), utils.ShellQuote(user), utils.ShellQuote(site))
+}
+
+// generateGitCloneScript shallow clones repoURL at ref (the default branch when empty)
+// into /out with Git LFS objects. Refs that cannot be cloned as a branch or tag (such as
+// commit SHAs) are fetched directly. A token from /run/secrets/git-token is sent as
+// HTTP basic auth when present.
+func generateGitCloneScript(repoURL, ref string) string {
+	return fmt.Sprintf(`set -eu
+apk add --no-cache git git-lfs >/dev/null
+git lfs install --skip-repo
+if [ -s /run/secrets/git-token ]; then
+	auth=$(printf 'x-access-token:%%s' "$(cat /run/secrets/git-token)" | base64 | tr -d '\n')
+	git config --global http.extraHeader "Authorization: Basic $auth"
+fi
+url=%[1]s
+ref=%[2]s
+if [ -z "$ref" ]; then
+	git clone --depth 1 "$url" /out
+elif ! git clone --depth 1 --branch "$ref" "$url" /out; then
+	rm -rf /out
+	git init -q /out
+	cd /out
+	git remote add origin "$url"
+	git fetch --depth 1 origin "$ref"
+	git checkout -q FETCH_HEAD
+fi
+`, utils.ShellQuote(repoURL), utils.ShellQuote(ref))
 }
 
 // createMinimalImageConfig produces a serialized minimal OCI image config JSON
-// with provided OS and architecture. RootFS is empty (no layers) matching other
-// packager outputs.
-func createMinimalImageConfig(os, arch string) ([]byte, error) {
-	cfg := ocispec.Image{}
-	cfg.OS = os
-	cfg.Architecture = arch
+// with the provided platform; a zero platform leaves OS and architecture empty for
+// platform-agnostic artifacts. RootFS is empty (no layers) matching other
+// packager outputs. created is omitted when nil so configs carry no wall-clock time.
+func createMinimalImageConfig(platform ocispec.Platform, created *time.Time) ([]byte, error) {
+	cfg := ocispec.Image{Platform: platform, Created: created}
 	cfg.RootFS = ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{}}
 	return json.Marshal(cfg)
 }
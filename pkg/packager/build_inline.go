@@ -0,0 +1,37 @@
+package packager
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/kaito-project/aikit/pkg/utils"
+	"github.com/moby/buildkit/client/llb"
+)
+
+// buildInlineState returns an llb.State holding a single file named after an
+// inline://<filename> source. The file content is data when non-nil (decoded from the
+// inline_data build-arg); otherwise it is read from the inline-data secret, which
+// allows payloads larger than a build-arg.
+func buildInlineState(source string, data []byte) (llb.State, error) {
+	name := strings.TrimPrefix(source, "inline://")
+	if name == "" || name != path.Base(name) || name == "." || name == ".." {
+		return llb.State{}, fmt.Errorf("invalid inline source %q: expected inline://<filename>", source)
+	}
+	if data != nil {
+		return llb.Scratch().File(llb.Mkfile("/"+name, 0o644, data)), nil
+	}
+	script := fmt.Sprintf(`set -euo pipefail
+if [ ! -f /run/secrets/inline-data ]; then
+	echo "inline source requires the inline_data build-arg or the inline-data secret" >&2
+	exit 1
+fi
+mkdir -p /out
+cp /run/secrets/inline-data %s
+`, utils.ShellQuote("/out/"+name))
+	run := llb.Image(bashImage).Run(
+		llb.Args([]string{"bash", "-c", script}),
+		llb.AddSecret("/run/secrets/inline-data", llb.SecretID("inline-data"), llb.SecretOptional),
+	)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/out/", "/", &llb.CopyInfo{CopyDirContentsOnly: true})), nil
+}
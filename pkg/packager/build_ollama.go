@@ -0,0 +1,148 @@
+package packager
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kaito-project/aikit/pkg/utils"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/gateway/client"
+)
+
+const (
+	// ollamaModelMediaType is the media type of the GGUF weights layer of an Ollama model.
+	ollamaModelMediaType = "application/vnd.ollama.image.model"
+	// ollamaNamespace is the registry namespace Ollama stores locally created models under.
+	ollamaNamespace = "registry.ollama.ai/library"
+	// defaultOllamaTag is the tag used when the name build-arg carries none.
+	defaultOllamaTag = "latest"
+)
+
+// ollamaNamePattern matches an Ollama model name or tag component.
+var ollamaNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// ollamaConfig holds the build parameters of the packager/ollama target.
+type ollamaConfig struct {
+	*buildConfig
+	model string
+	tag   string
+}
+
+// parseOllamaConfig extracts and validates the packager/ollama build configuration. The
+// model name and tag come from the name build-arg as <model>[:<tag>].
+func parseOllamaConfig(opts map[string]string, sessionID string) (*ollamaConfig, error) {
+	if getBuildArg(opts, "source") == "" {
+		return nil, fmt.Errorf("source is required for ollama target")
+	}
+	cfg, err := parseBuildConfig(opts, sessionID, false)
+	if err != nil {
+		return nil, err
+	}
+	model, tag, found := strings.Cut(cfg.name, ":")
+	if !found {
+		tag = defaultOllamaTag
+	}
+	if !ollamaNamePattern.MatchString(model) || !ollamaNamePattern.MatchString(tag) {
+		return nil, fmt.Errorf("invalid ollama model name %q, must be <model>[:<tag>] of letters, digits, '.', '_' and '-'", cfg.name)
+	}
+	return &ollamaConfig{buildConfig: cfg, model: model, tag: tag}, nil
+}
+
+// BuildOllama builds an Ollama models directory (target packager/ollama) holding the single
+// GGUF file of the source as an application/vnd.ollama.image.model layer.
+func BuildOllama(ctx context.Context, c client.Client) (*client.Result, error) {
+	opts := c.BuildOpts().Opts
+	sessionID := c.BuildOpts().SessionID
+
+	cfg, err := parseOllamaConfig(opts, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	srcState, err := resolveSourceState(cfg.source, cfg.sessionID, false, cfg.exclude, cfg.sourceOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve ollama source %q: %w", cfg.source, err)
+	}
+
+	script := generateOllamaScript(cfg.model, cfg.tag, cfg.platform.OS, cfg.platform.Architecture, cfg.debug)
+	run := llb.Image(bashImage).Run(
+		llb.Args([]string{"bash", "-c", script}),
+		llb.AddMount("/src", srcState, llb.Readonly),
+	)
+	final := llb.Scratch().File(llb.Copy(run.Root(), "/layout/", "/"))
+
+	if cfg.dryRun {
+		return dryRunResult(ctx, final, "packager:ollama", script)
+	}
+	return solveAndBuildResult(ctx, c, final, "packager:ollama", cfg.solveRetries, cfg.platform, cfg.sourceDate)
+}
+
+// generateOllamaScript builds the script assembling an Ollama models directory in /layout:
+// blobs/sha256-<hex> files and the manifest at manifests/registry.ollama.ai/library/<model>/<tag>.
+// The source must contain exactly one .gguf file, which becomes the model layer; files named
+// template, system, params or LICENSE at the source root are added as the matching Ollama layers.
+//
+// Arguments:
+//
+//	model, tag: model name and tag the manifest is stored under
+//	osName, arch: platform recorded in the model config (may be empty)
+//	debug: if true, enables bash debug mode (set -x)
+func generateOllamaScript(model, tag, osName, arch string, debug bool) string {
+	debugLine := ""
+	if debug {
+		debugLine = "set -x"
+	}
+	tmpl := `set -euo pipefail
+%[1]s
+mkdir -p /layout/blobs
+
+# Handle single file input (copy to temporary directory)
+work=/src
+if [ -f /src ]; then mkdir -p /worksrc && cp /src /worksrc/; work=/worksrc; fi
+cd "$work"
+
+# The model layer is the single GGUF file of the source
+find . -type f -iname '*.gguf' ! -path './.cache/*' | LC_ALL=C sort > /tmp/gguf.list
+n=$(wc -l < /tmp/gguf.list | tr -d ' ')
+if [ "$n" -ne 1 ]; then
+	echo "ollama target needs exactly one .gguf file in the source, found $n" >&2
+	cat /tmp/gguf.list >&2
+	exit 1
+fi
+
+# add_layer: Store a file as a blob and append its descriptor to the layer list
+# Args: file path, media type
+: > /tmp/layers.json
+add_layer() {
+	dgst=$(sha256sum "$1" | cut -d' ' -f1)
+	size=$(stat -c%%s "$1")
+	cp "$1" /layout/blobs/sha256-$dgst
+	[ -s /tmp/layers.json ] && printf ', ' >> /tmp/layers.json
+	printf '{ "mediaType": "%%s", "digest": "sha256:%%s", "size": %%s }' "$2" "$dgst" "$size" >> /tmp/layers.json
+}
+
+add_layer "$(head -n1 /tmp/gguf.list)" %[2]s
+model_dgst=$dgst
+for kind in template system params license; do
+	f=$kind
+	[ "$kind" = license ] && f=LICENSE
+	if [ -f "$f" ]; then add_layer "$f" "application/vnd.ollama.image.$kind"; fi
+done
+
+# Model config referencing the weights by digest, as written by ollama create
+printf '{"model_format":"gguf","model_family":"","model_families":null,"model_type":"","file_type":"","architecture":"%%s","os":"%%s","rootfs":{"type":"layers","diff_ids":["sha256:%%s"]}}' %[3]s %[4]s "$model_dgst" > /tmp/config.json
+c_dgst=$(sha256sum /tmp/config.json | cut -d' ' -f1)
+c_size=$(stat -c%%s /tmp/config.json)
+cp /tmp/config.json /layout/blobs/sha256-$c_dgst
+
+mkdir -p /layout/manifests/%[5]s/%[6]s
+{
+	printf '{ "schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.v2+json", "config": { "mediaType": "application/vnd.docker.container.image.v1+json", "digest": "sha256:%%s", "size": %%s }, "layers": [ ' "$c_dgst" "$c_size"
+	cat /tmp/layers.json
+	printf ' ] }'
+} > /layout/manifests/%[5]s/%[6]s/%[7]s
+`
+	return fmt.Sprintf(tmpl, debugLine, utils.ShellQuote(ollamaModelMediaType), utils.ShellQuote(arch), utils.ShellQuote(osName), ollamaNamespace, model, tag)
+}
@@ -0,0 +1,30 @@
+package packager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moby/buildkit/client/llb"
+)
+
+// buildS3State returns an llb.State containing the objects referenced by an s3:// source
+// rooted at /. References ending in "/" (or naming only a bucket) download every object
+// under the prefix; anything else downloads a single object. AWS credentials are mounted
+// from the aws-credentials secret if available.
+func buildS3State(source string) (llb.State, error) {
+	if !strings.HasPrefix(source, "s3://") {
+		return llb.State{}, fmt.Errorf("not an s3 source: %s", source)
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(source, "s3://"), "/")
+	if bucket == "" {
+		return llb.State{}, fmt.Errorf("invalid s3 source %q: bucket is empty", source)
+	}
+	recursive := key == "" || strings.HasSuffix(key, "/")
+	dlScript := generateS3DownloadScript(source, recursive)
+	runOpts := []llb.RunOption{
+		llb.Args([]string{"bash", "-c", dlScript}),
+		llb.AddSecret("/run/secrets/aws-credentials", llb.SecretID("aws-credentials"), llb.SecretOptional),
+	}
+	run := llb.Image(awsCLIImage).Run(runOpts...)
+	return llb.Scratch().File(llb.Copy(run.Root(), "/out/", "/", &llb.CopyInfo{CopyDirContentsOnly: true})), nil
+}
@@ -6,7 +6,9 @@ import (
 	"strings"
 
 	"github.com/kaito-project/aikit/pkg/aikit2llb/inference"
+	"github.com/kaito-project/aikit/pkg/utils"
 	"github.com/moby/buildkit/client/llb"
+	digest "github.com/opencontainers/go-digest"
 )
 
 const (
@@ -15,30 +17,121 @@ const (
 	minPathDepthForHFFile = 2
 )
 
+// sourceOptions holds optional source resolution behaviors, toggled via build-args.
+type sourceOptions struct {
+	// httpDownloader selects the HTTP(S) download implementation ("" uses llb.HTTP).
+	httpDownloader string
+	// httpAuth fetches HTTP(S) sources with curl, authorized by the http-auth secret.
+	httpAuth bool
+	// include is an optional space-separated list of patterns restricting huggingface downloads.
+	include string
+	// prune is an optional space-separated list of patterns deleted from huggingface snapshots after download.
+	prune string
+	// inlineData is the decoded content of an inline:// source (nil reads the inline-data secret).
+	inlineData []byte
+	// networkTimeout is the connect timeout in seconds for huggingface downloads.
+	networkTimeout int
+	// retries is the number of attempts made by huggingface downloads.
+	retries int
+	// downloadTimeout bounds, in seconds, each huggingface and oras download attempt (0 is unbounded).
+	downloadTimeout int
+	// hfEndpoint overrides the Hugging Face base URL, e.g. with a mirror.
+	hfEndpoint string
+	// sha256 is the expected hex digest of a single-file HTTP(S) or huggingface download.
+	sha256 string
+	// hfWorkers is the number of parallel workers of huggingface snapshot downloads (0 uses the hf default).
+	hfWorkers int
+	// allowEmptyDownload lets huggingface snapshot downloads without any files succeed.
+	allowEmptyDownload bool
+	// skipPrecheck disables the model existence check run before huggingface snapshot downloads.
+	skipPrecheck bool
+}
+
+// hfDownload returns the options of a huggingface snapshot download excluding and
+// including the given patterns.
+func (o sourceOptions) hfDownload(exclude, include string) hfDownloadOptions {
+	return hfDownloadOptions{
+		exclude:         exclude,
+		include:         include,
+		prune:           o.prune,
+		endpoint:        o.hfEndpoint,
+		timeout:         o.networkTimeout,
+		retries:         o.retries,
+		downloadTimeout: o.downloadTimeout,
+		workers:         o.hfWorkers,
+		precheck:        !o.skipPrecheck,
+		allowEmpty:      o.allowEmptyDownload,
+	}
+}
+
+// hfSubdirInclude returns the include patterns restricting a snapshot download to the
+// repository directory dir (with trailing slash). Patterns in include are relative to dir.
+func hfSubdirInclude(dir, include string) string {
+	patterns := parseExcludePatterns(include)
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	quoted := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		quoted = append(quoted, "'"+dir+p+"'")
+	}
+	return strings.Join(quoted, " ")
+}
+
 // resolveSourceState normalizes a model/artifact source reference into an llb.State.
-// Supports local context ("." or "context"), HTTP(S), huggingface://, or a path/glob
-// inside the local context. For HTTP(S) single files, preserveHTTPFilename controls
-// whether the original basename is explicitly enforced (useful to avoid anonymous temp names).
-// exclude is an optional space-separated list of patterns to exclude from huggingface downloads.
-// HF token secret is automatically mounted if available in the BuildKit session.
-func resolveSourceState(source, sessionID string, preserveHTTPFilename bool, exclude string) (llb.State, error) {
+// Supports local context ("." or "context"), HTTP(S), huggingface://, s3://, gs://, azblob://,
+// git+https:// or git://, ftp:// or sftp://, inline://, or a path/glob inside the local context.
+// For HTTP(S) single files, preserveHTTPFilename controls whether the original basename is
+// explicitly enforced (useful to avoid anonymous temp names).
+// exclude is an optional space-separated list of patterns to exclude from huggingface downloads
+// (opts.include restricts them to matching patterns).
+// HF token, git token, ftp/ssh and cloud storage credential secrets are automatically mounted
+// if available in the BuildKit session.
+// opts carries optional behaviors such as the HTTP downloader and inline source content.
+func resolveSourceState(source, sessionID string, preserveHTTPFilename bool, exclude string, opts sourceOptions) (llb.State, error) {
 	if source == "" || source == "." || source == "context" {
 		return llb.Local(localNameContext, llb.SessionID(sessionID), llb.SharedKeyHint(localNameContext)), nil
 	}
 	switch {
 	case strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://"):
+		if opts.httpAuth {
+			return inference.HTTPAuthState(source, path.Base(source), opts.sha256, opts.networkTimeout), nil
+		}
+		if opts.httpDownloader == utils.HTTPDownloaderAria2 {
+			return inference.Aria2State(source, path.Base(source), opts.sha256), nil
+		}
+		var httpOpts []llb.HTTPOption
 		if preserveHTTPFilename {
-			base := path.Base(source)
-			return llb.HTTP(source, llb.Filename(base)), nil
+			httpOpts = append(httpOpts, llb.Filename(path.Base(source)))
+		}
+		if opts.sha256 != "" {
+			httpOpts = append(httpOpts, llb.Checksum(digest.NewDigestFromEncoded(digest.SHA256, opts.sha256)))
 		}
-		return llb.HTTP(source), nil
+		return llb.HTTP(source, httpOpts...), nil
 	case strings.HasPrefix(source, "huggingface://"):
-		// If the reference includes a file path (namespace/model/file...), fetch only that file.
+		// If the reference includes a file path (namespace/model/file...), fetch only that file,
+		// or only that directory when the path ends with a slash.
 		trimmed := strings.TrimPrefix(source, "huggingface://")
 		if strings.Count(trimmed, "/") >= minPathDepthForHFFile { // namespace/model/file (optionally with further subdirs)
 			if spec, err := inference.ParseHuggingFaceSpec(source); err == nil && spec.SubPath != "" {
-				// Use hf CLI to download only the specified file (deterministic & token aware)
-				fileScript := generateHFSingleFileDownloadScript(spec.Namespace, spec.Model, spec.Revision, spec.SubPath)
+				if spec.IsDir() {
+					// A trailing slash names a directory: download a snapshot restricted to it
+					st, err := buildHuggingFaceState(source, opts.hfDownload(exclude, hfSubdirInclude(spec.SubPath, opts.include)))
+					if err != nil {
+						return llb.State{}, fmt.Errorf("failed to build huggingface state for %q: %w", source, err)
+					}
+					return st, nil
+				}
+				// Use hf CLI to download only the specified file(s) (deterministic & token aware)
+				var fileScript string
+				if files := spec.Files(); len(files) > 1 {
+					if opts.sha256 != "" {
+						return llb.State{}, fmt.Errorf("sha256 cannot be used with the multi-file huggingface source %q", source)
+					}
+					fileScript = generateHFMultiFileDownloadScript(spec.Namespace, spec.Model, spec.Revision, files, opts.hfEndpoint, opts.networkTimeout, opts.retries, opts.downloadTimeout)
+				} else {
+					fileScript = generateHFSingleFileDownloadScript(spec.Namespace, spec.Model, spec.Revision, spec.SubPath, opts.sha256, opts.hfEndpoint, opts.networkTimeout, opts.retries, opts.downloadTimeout)
+				}
 				runOpts := []llb.RunOption{
 					llb.Args([]string{"bash", "-c", fileScript}),
 					llb.AddSecret("/run/secrets/hf-token", llb.SecretID("hf-token"), llb.SecretOptional),
@@ -48,11 +141,49 @@ func resolveSourceState(source, sessionID string, preserveHTTPFilename bool, exc
 			}
 		}
 		// Fallback: download full repository snapshot
-		st, err := buildHuggingFaceState(source, exclude)
+		st, err := buildHuggingFaceState(source, opts.hfDownload(exclude, opts.include))
 		if err != nil {
 			return llb.State{}, fmt.Errorf("failed to build huggingface state for %q: %w", source, err)
 		}
 		return st, nil
+	case strings.HasPrefix(source, "oci://"):
+		st, err := inference.ModelPackState(source, opts.networkTimeout, opts.retries, opts.downloadTimeout)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to build oci state for %q: %w", source, err)
+		}
+		return st, nil
+	case strings.HasPrefix(source, "s3://"):
+		st, err := buildS3State(source)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to build s3 state for %q: %w", source, err)
+		}
+		return st, nil
+	case strings.HasPrefix(source, "gs://"):
+		st, err := inference.GCSState(source)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to build gs state for %q: %w", source, err)
+		}
+		return st, nil
+	case strings.HasPrefix(source, "azblob://"):
+		st, err := buildAzureBlobState(source)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to build azblob state for %q: %w", source, err)
+		}
+		return st, nil
+	case strings.HasPrefix(source, "git+https://") || strings.HasPrefix(source, "git://"):
+		st, err := buildGitState(source)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to build git state for %q: %w", source, err)
+		}
+		return st, nil
+	case strings.HasPrefix(source, "ftp://") || strings.HasPrefix(source, "sftp://"):
+		st, err := buildFTPState(source)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to build ftp state for %q: %w", source, err)
+		}
+		return st, nil
+	case strings.HasPrefix(source, "inline://"):
+		return buildInlineState(source, opts.inlineData)
 	default:
 		include := source
 		if strings.HasSuffix(include, "/") {
@@ -1,41 +1,469 @@
 package packager
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"text/template"
+	"time"
 
+	"github.com/kaito-project/aikit/pkg/utils"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // File categorization thresholds and patterns.
 const (
-	// largeFileThreshold defines the size (10 MiB) above which unknown files are categorized as weights.
+	// largeFileThreshold defines the default size (10 MiB) above which unknown files are categorized as weights.
 	largeFileThreshold = 10485760 // 10 * 1024 * 1024
 )
 
+// Model card referrer media types.
+const (
+	// modelCardArtifactType is the artifact type of the referrer manifest holding a model card.
+	modelCardArtifactType = "application/vnd.aikit.model.card.v1"
+	// modelCardMediaType is the media type of the model card layer.
+	modelCardMediaType = "text/markdown"
+	// defaultModelCard is the source file auto-detected as the model card.
+	defaultModelCard = "README.md"
+)
+
+// layoutGateScript is appended to every layout assembly script. It fails the build
+// unless index.json, oci-layout and every blob referenced from the index (and from the
+// manifests it points to) exist, so a partially written layout is never exported.
+const layoutGateScript = `
+# Final gate: refuse to export a partial OCI layout
+for f in /layout/index.json /layout/oci-layout; do
+	if [ ! -s "$f" ]; then echo "layout incomplete: missing $f" >&2; exit 1; fi
+done
+for d in $(grep -o 'sha256:[0-9a-f]\{64\}' /layout/index.json); do
+	blob=/layout/blobs/sha256/${d#sha256:}
+	if [ ! -f "$blob" ]; then echo "layout incomplete: missing blob $d" >&2; exit 1; fi
+	# the manifest subject refers to a manifest outside this layout and descriptors with
+	# inline data need no blob
+	for ld in $(sed 's/"subject": {[^}]*}//; s/{[^{}]*, "data": "[^"]*"}//g' "$blob" | grep -o 'sha256:[0-9a-f]\{64\}'); do
+		if [ ! -f "/layout/blobs/sha256/${ld#sha256:}" ]; then echo "layout incomplete: missing blob $ld referenced by $d" >&2; exit 1; fi
+	done
+done
+`
+
+// scriptOptions holds optional behaviors of the layout assembly scripts, toggled via build-args.
+type scriptOptions struct {
+	// mimeCategorization classifies files with unknown extensions by MIME type before the size heuristic.
+	mimeCategorization bool
+	// configFrom names a file in the source to use as the modelpack manifest config blob.
+	configFrom string
+	// categoryJobs bounds how many modelpack categories are packaged concurrently (<= 1 is sequential).
+	categoryJobs int
+	// layerCreatedAnnotation adds org.opencontainers.image.created to every modelpack layer.
+	// It is only set together with sourceDateEpoch.
+	layerCreatedAnnotation bool
+	// sourceDateEpoch is the reproducible build time (unix seconds) used for timestamps.
+	sourceDateEpoch int64
+	// created is the RFC 3339 org.opencontainers.image.created annotation of the index
+	// entry, derived from source_date_epoch; empty omits it.
+	created string
+	// layerSource, when set, is added to every modelpack layer as org.opencontainers.image.source.
+	layerSource string
+	// nondeterministic skips the global file sort and reproducibility flags, trading determinism for speed.
+	nondeterministic bool
+	// singleLayer bundles all modelpack categories into one tar layer instead of per-category layers.
+	singleLayer bool
+	// subject, when set, is written as the manifest subject so the pack is a referrer of that manifest.
+	subject *ocispec.Descriptor
+	// diskHeadroom is the free space, as a percentage of the source size, required beyond the source size before packaging.
+	diskHeadroom int
+	// inlineEmptyConfig uses the well-known empty descriptor with inline data as the generic
+	// manifest config instead of storing an empty config blob.
+	inlineEmptyConfig bool
+	// keepXattrs keeps extended attributes and ACLs of source files in tar entries instead of stripping them.
+	keepXattrs bool
+	// modelCard names a source file attached to the modelpack manifest as a model card referrer.
+	modelCard string
+	// modelCardOptional skips the model card referrer instead of failing when modelCard is missing.
+	modelCardOptional bool
+	// skipEmptyFiles leaves zero-byte files out of modelpack layers.
+	skipEmptyFiles bool
+	// minSize and maxSize, when positive, leave files smaller or larger than that many bytes
+	// out of the pack.
+	minSize int64
+	maxSize int64
+	// largeFileThreshold is the size in bytes above which unknown files are categorized as
+	// weights; zero means the 10 MiB default.
+	largeFileThreshold int64
+	// compressionLevel is the gzip, zstd or lz4 compression level; zero keeps the tool default.
+	compressionLevel int
+	// zstdLong enables zstd long-distance matching with a 2 GiB window (--long=31).
+	zstdLong bool
+	// categoryOverrides are file name patterns matched before the built-in modelpack categorization.
+	categoryOverrides []categoryPatterns
+	// categoryPackModes maps modelpack categories to the pack mode of their layers, overriding
+	// the global pack mode.
+	categoryPackModes map[string]string
+	// allowEmpty packages a source without files instead of failing the build.
+	allowEmpty bool
+}
+
+// categoryPatterns assigns files whose lowercased base name matches one of patterns to category.
+type categoryPatterns struct {
+	category string
+	patterns []string
+}
+
+// categoryRule is a built-in modelpack categorization rule, described by comment.
+type categoryRule struct {
+	comment string
+	categoryPatterns
+}
+
+// builtinCategoryRules are the built-in modelpack categorization rules, tried in order after
+// any category overrides. Both the packaging script and PackDirectory categorize with them.
+var builtinCategoryRules = []categoryRule{
+	{"Model weight files", categoryPatterns{"weights", []string{"*.safetensors", "*.bin", "*.gguf", "*.pt", "*.ckpt", "*.onnx", "*.tflite", "*.mlmodel", "*.engine", "*.pb"}}},
+	{"Documentation files", categoryPatterns{"docs", []string{"readme*", "license*", "license", "*.md"}}},
+	{"Configuration and tokenizer files", categoryPatterns{"config", []string{"config.json", "tokenizer.json", "*tokenizer*.json", "generation_config.json", "*.json", "*.txt"}}},
+	{"Code files", categoryPatterns{"code", []string{"*.py", "*.sh", "*.ipynb", "*.go", "*.js", "*.ts"}}},
+	{"Dataset files", categoryPatterns{"dataset", []string{"*.csv", "*.tsv", "*.jsonl", "*.parquet", "*.arrow", "*.h5", "*.npz"}}},
+}
+
+// builtinCategoryCase returns the case branches of builtinCategoryRules for the
+// categorization case statement of the modelpack script.
+func builtinCategoryCase() string {
+	var b strings.Builder
+	for _, r := range builtinCategoryRules {
+		fmt.Fprintf(&b, "\t\t# %s\n\t\t%s) echo \"$f\" >> /tmp/%s.list ;;\n", r.comment, strings.Join(r.patterns, "|"), r.category)
+	}
+	return b.String()
+}
+
+// tarFlagsProbe drops TAR_FLAGS when the tar in the packaging image does not support them
+// (e.g. busybox tar), so stripping attributes degrades to a warning instead of a failed build.
+const tarFlagsProbe = `if [ -n "$TAR_FLAGS" ] && ! tar $TAR_FLAGS -cf /dev/null -T /dev/null 2>/dev/null; then
+	echo "warning: tar does not support $TAR_FLAGS, keeping extended attributes" >&2
+	TAR_FLAGS=
+fi
+`
+
+// sortCmd returns the filter applied to the file list: a byte-wise sort for
+// reproducible layouts, or a plain pass-through when determinism is disabled.
+func (o scriptOptions) sortCmd() string {
+	if o.nondeterministic {
+		return "cat"
+	}
+	return "LC_ALL=C sort"
+}
+
+// emptySourceGuard returns the script step failing the build when the source in the
+// current directory holds no files, unless allowEmpty is set.
+func (o scriptOptions) emptySourceGuard() string {
+	if o.allowEmpty {
+		return ""
+	}
+	return `if [ -z "$(find . -type f ! -name '*.lock' ! -path './.cache/*' | head -1)" ]; then
+	echo "no files downloaded/matched in the source; set allow_empty=true to package it anyway" >&2
+	exit 1
+fi
+`
+}
+
+// findFilter returns extra find predicates selecting the files to package; with
+// skipEmptyFiles, zero-byte files are left out, as are files outside the size bounds.
+func (o scriptOptions) findFilter() string {
+	if o.skipEmptyFiles {
+		return " ! -empty" + o.sizeFilter()
+	}
+	return o.sizeFilter()
+}
+
+// sizeFilter returns the find predicates leaving out files smaller than minSize or larger
+// than maxSize. Sizes are given in bytes (c suffix) as find rounds other units up.
+func (o scriptOptions) sizeFilter() string {
+	var b strings.Builder
+	if o.minSize > 0 {
+		fmt.Fprintf(&b, " ! -size -%dc", o.minSize)
+	}
+	if o.maxSize > 0 {
+		fmt.Fprintf(&b, " ! -size +%dc", o.maxSize)
+	}
+	return b.String()
+}
+
+// weightThreshold returns the size in bytes above which unknown files are categorized as weights.
+func (o scriptOptions) weightThreshold() int64 {
+	if o.largeFileThreshold > 0 {
+		return o.largeFileThreshold
+	}
+	return largeFileThreshold
+}
+
+// categoryPackModeVars returns the <CATEGORY>_PACK_MODE assignments passed to add_category,
+// set from categoryPackModes and defaulting to PACK_MODE.
+func (o scriptOptions) categoryPackModeVars() string {
+	var b strings.Builder
+	b.WriteString("# Pack mode of each category (category_pack_modes build-arg), defaulting to PACK_MODE\n")
+	for _, c := range modelpackCategories {
+		mode := "$PACK_MODE"
+		if m, ok := o.categoryPackModes[c]; ok {
+			mode = utils.ShellQuote(m)
+		}
+		fmt.Fprintf(&b, "%s_PACK_MODE=%s\n", strings.ToUpper(c), mode)
+	}
+	return b.String()
+}
+
+// categoryOverridesCase returns the case branches for categoryOverrides, placed ahead of
+// the built-in patterns so they extend and override the default categorization.
+func (o scriptOptions) categoryOverridesCase() string {
+	if len(o.categoryOverrides) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\t\t# Category overrides (category_overrides build-arg)\n")
+	for _, c := range o.categoryOverrides {
+		fmt.Fprintf(&b, "\t\t%s) echo \"$f\" >> /tmp/%s.list ;;\n", strings.Join(c.patterns, "|"), c.category)
+	}
+	return b.String()
+}
+
+// tarFlags returns the extra tar flags; by default extended attributes and ACLs are
+// left out so archive digests do not depend on the source filesystem.
+func (o scriptOptions) tarFlags() string {
+	if o.keepXattrs {
+		return ""
+	}
+	return "--no-xattrs --no-acls"
+}
+
+// gzipCmd returns the gzip invocation; -n omits the original name and timestamp
+// from the header so the compressed output is reproducible.
+func (o scriptOptions) gzipCmd() string {
+	cmd := "gzip -n"
+	if o.nondeterministic {
+		cmd = "gzip"
+	}
+	return cmd + o.levelFlag()
+}
+
+// zstdCmd returns the zstd invocation used for tar+zstd layers. Layers compressed with
+// zstdLong need a decompressor allowing the same window (zstd -d --long=31).
+func (o scriptOptions) zstdCmd() string {
+	cmd := "zstd -q --no-progress" + o.levelFlag()
+	if o.zstdLong {
+		cmd += " --long=31"
+	}
+	return cmd
+}
+
+// lz4Cmd returns the lz4 invocation used for tar+lz4 layers.
+func (o scriptOptions) lz4Cmd() string {
+	return "lz4 -q" + o.levelFlag()
+}
+
+// levelFlag returns the compression level flag shared by gzip, zstd and lz4, if any.
+func (o scriptOptions) levelFlag() string {
+	if o.compressionLevel <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" -%d", o.compressionLevel)
+}
+
+// subjectField returns the manifest subject property (with a leading comma), or an
+// empty string when no subject is set.
+func (o scriptOptions) subjectField() string {
+	if o.subject == nil {
+		return ""
+	}
+	data, _ := json.Marshal(o.subject)
+	return `, "subject": ` + string(data)
+}
+
+// emptyConfigScript returns the generic script step defining the empty manifest config
+// (cfg_dgst, cfg_size and the optional cfg_data descriptor field). By default an empty
+// config blob is written to the layout; with inlineEmptyConfig the well-known empty
+// descriptor embeds its content, so there is no blob to store or upload.
+func (o scriptOptions) emptyConfigScript() string {
+	if o.inlineEmptyConfig {
+		return fmt.Sprintf(`# Use the well-known empty descriptor with inline data instead of an empty config blob
+cfg_dgst=%s
+cfg_size=%d
+cfg_data=', "data": "%s"'
+`, ocispec.DescriptorEmptyJSON.Digest.Encoded(), ocispec.DescriptorEmptyJSON.Size, base64.StdEncoding.EncodeToString(ocispec.DescriptorEmptyJSON.Data))
+	}
+	return `# Create empty config blob
+printf '{}' > /tmp/config.json
+cfg_dgst=$(sha256sum /tmp/config.json | awk '{print $1}')
+cfg_size=$(stat -c%s /tmp/config.json)
+cp /tmp/config.json /layout/blobs/sha256/$cfg_dgst
+cfg_data=''
+`
+}
+
+// modelCardScript returns the modelpack script step that stores modelCard as the single
+// layer of a referrer manifest whose subject is the model manifest, and sets card_entry to
+// its index.json descriptor (empty when there is no model card).
+func (o scriptOptions) modelCardScript() string {
+	if o.modelCard == "" {
+		return "card_entry=''\n"
+	}
+	empty := ocispec.DescriptorEmptyJSON
+	return fmt.Sprintf(`# Attach the model card as a referrer of the model manifest
+MODEL_CARD=%[1]s
+card_entry=''
+if [ -f "$MODEL_CARD" ]; then
+	card_dgst=$(sha256sum "$MODEL_CARD" | cut -d' ' -f1)
+	card_size=$(stat -c%%s "$MODEL_CARD")
+	cp "$MODEL_CARD" /layout/blobs/sha256/$card_dgst
+	printf '{}' > /layout/blobs/sha256/%[4]s
+	printf '{ "schemaVersion": 2, "mediaType": "%[2]s", "artifactType": "%[3]s", "config": {"mediaType": "%[5]s", "digest": "%[6]s", "size": %[7]d}, "layers": [ { "mediaType": "%[8]s", "digest": "sha256:%%s", "size": %%s, "annotations": { "org.opencontainers.image.title": "%%s" } } ], "subject": {"mediaType": "%[2]s", "digest": "sha256:%%s", "size": %%s} }\n' \
+		"$card_dgst" "$card_size" "$(basename "$MODEL_CARD")" "$m_dgst" "$m_size" > /tmp/model-card-manifest.json
+	rc_dgst=$(sha256sum /tmp/model-card-manifest.json | cut -d' ' -f1)
+	rc_size=$(stat -c%%s /tmp/model-card-manifest.json)
+	cp /tmp/model-card-manifest.json /layout/blobs/sha256/$rc_dgst
+	card_entry=", { \"mediaType\": \"%[2]s\", \"digest\": \"sha256:$rc_dgst\", \"size\": $rc_size, \"artifactType\": \"%[3]s\" }"
+elif [ "%[9]t" != "true" ]; then
+	echo "model_card file $MODEL_CARD not found in source" >&2; exit 1
+fi
+`, utils.ShellQuote(o.modelCard), ocispec.MediaTypeImageManifest, modelCardArtifactType, empty.Digest.Encoded(), empty.MediaType, empty.Digest, empty.Size, modelCardMediaType, o.modelCardOptional)
+}
+
+// indexCreatedField returns the created annotation of the index manifest entry, if any.
+func (o scriptOptions) indexCreatedField() string {
+	if o.created == "" {
+		return ""
+	}
+	return fmt.Sprintf(`, "org.opencontainers.image.created": "%s"`, o.created)
+}
+
+// layerCreated returns the per-layer created timestamp derived from sourceDateEpoch,
+// or an empty string when the annotation is disabled.
+func (o scriptOptions) layerCreated() string {
+	if !o.layerCreatedAnnotation {
+		return ""
+	}
+	return time.Unix(o.sourceDateEpoch, 0).UTC().Format(time.RFC3339)
+}
+
 // generateModelpackScript returns the bash script used to assemble a modelpack OCI layout.
 //
 // This script performs the following operations:
 //  1. Categorizes files into weights, config, docs, code, and dataset based on extensions and size
-//  2. Packages each category according to packMode (raw, tar, tar+gzip, tar+zstd)
+//  2. Packages each category according to packMode (raw, tar, tar+gzip, tar+zstd, tar+lz4), or its own
+//     mode from opts.categoryPackModes, optionally in parallel,
+//     or bundles every file into a single tar layer when single layer mode is enabled
 //  3. Computes SHA256 digests and creates OCI layout with proper annotations
 //  4. Validates the generated manifest structure
+//  5. Verifies the layout is complete before it is exported
 //
 // The script runs in a bash container and expects:
 //   - Source files mounted at /src (read-only)
 //   - Output directory at /layout/ (writable)
-//   - Standard unix tools: find, tar, gzip, zstd, sha256sum
+//   - Standard unix tools: find, tar, gzip, zstd, lz4, sha256sum
 //
 // Arguments:
 //
-//	packMode: raw|tar|tar+gzip|tar+zstd - how to package layer content
+//	packMode: raw|tar|tar+gzip|tar+zstd|tar+lz4 - how to package layer content
 //	artifactType: model artifact type (e.g. v1.ArtifactTypeModelManifest)
 //	mtManifest: manifest config media type (e.g. v1.MediaTypeModelConfig)
 //	name: annotation org.opencontainers.image.title
 //	refName: annotation org.opencontainers.image.ref.name
-func generateModelpackScript(packMode, artifactType, mtManifest, name, refName string) string { //nolint:lll
-	tmpl := `set -euo pipefail
-PACK_MODE=%[1]s
+//	opts: optional script behaviors (see scriptOptions)
+func generateModelpackScript(packMode, artifactType, mtManifest, name, refName string, opts scriptOptions) string { //nolint:lll
+	data := modelpackScriptData{
+		PackMode:              packMode,
+		ArtifactType:          artifactType,
+		ConfigMediaType:       mtManifest,
+		Name:                  name,
+		RefName:               refName,
+		CategoryPackModeVars:  opts.categoryPackModeVars(),
+		LayerCreated:          utils.ShellQuote(opts.layerCreated()),
+		LayerSource:           utils.ShellQuote(opts.layerSource),
+		GzipCmd:               utils.ShellQuote(opts.gzipCmd()),
+		ZstdCmd:               utils.ShellQuote(opts.zstdCmd()),
+		Lz4Cmd:                utils.ShellQuote(opts.lz4Cmd()),
+		TarFlags:              utils.ShellQuote(opts.tarFlags()),
+		TarFlagsProbe:         tarFlagsProbe,
+		EmptySourceGuard:      opts.emptySourceGuard(),
+		FindFilter:            opts.findFilter(),
+		SortCmd:               opts.sortCmd(),
+		FreeSpaceCheck:        freeSpaceCheck("/tmp/allfiles_with_size.list", opts.diskHeadroom),
+		CategoryOverridesCase: opts.categoryOverridesCase(),
+		BuiltinCategoryCase:   builtinCategoryCase(),
+		MimeProbe:             opts.mimeProbe(),
+		UnknownFileCase:       unknownFileCase(opts.mimeCategorization, opts.weightThreshold()),
+		CategoryJobs:          max(opts.categoryJobs, 1),
+		SingleLayer:           opts.singleLayer,
+		ConfigFrom:            utils.ShellQuote(opts.configFrom),
+		SubjectField:          opts.subjectField(),
+		ModelCardScript:       opts.modelCardScript(),
+		IndexCreatedField:     opts.indexCreatedField(),
+	}
+	var b strings.Builder
+	if err := modelpackScriptTemplate.Execute(&b, data); err != nil {
+		// the data only holds strings, ints and bools, so execution cannot fail
+		panic(err)
+	}
+	return b.String() + layoutGateScript
+}
 
+// modelpackScriptData holds the values substituted into modelpackScriptTemplate. Fields
+// assigned to shell variables are already shell quoted; the others are script fragments
+// or values embedded as is.
+type modelpackScriptData struct {
+	// PackMode is the global pack mode and CategoryPackModeVars the <CATEGORY>_PACK_MODE
+	// assignments overriding it per category.
+	PackMode             string
+	CategoryPackModeVars string
+	// ArtifactType, ConfigMediaType, Name and RefName describe the manifest and its index entry.
+	ArtifactType    string
+	ConfigMediaType string
+	Name            string
+	RefName         string
+	// LayerCreated and LayerSource are the optional per-layer annotations.
+	LayerCreated string
+	LayerSource  string
+	// GzipCmd, ZstdCmd, Lz4Cmd and TarFlags are the archiving commands and flags, and
+	// TarFlagsProbe drops TarFlags when tar does not support them.
+	GzipCmd       string
+	ZstdCmd       string
+	Lz4Cmd        string
+	TarFlags      string
+	TarFlagsProbe string
+	// EmptySourceGuard, FindFilter, SortCmd and FreeSpaceCheck select and list the source files.
+	EmptySourceGuard string
+	FindFilter       string
+	SortCmd          string
+	FreeSpaceCheck   string
+	// MimeProbe makes sure file(1) is available for MIME categorization.
+	MimeProbe string
+	// CategoryOverridesCase, BuiltinCategoryCase and UnknownFileCase are the branches of the
+	// categorization case statement, in match order.
+	CategoryOverridesCase string
+	BuiltinCategoryCase   string
+	UnknownFileCase       string
+	// CategoryJobs bounds the categories packaged concurrently and SingleLayer bundles
+	// every category into one layer instead.
+	CategoryJobs int
+	SingleLayer  bool
+	// ConfigFrom names the source file used as manifest config, SubjectField is the manifest
+	// subject property and ModelCardScript attaches the model card referrer.
+	ConfigFrom      string
+	SubjectField    string
+	ModelCardScript string
+	// IndexCreatedField is the created annotation of the index entry.
+	IndexCreatedField string
+}
+
+// modelpackScriptTemplate is the modelpack layout assembly script; see generateModelpackScript
+// and modelpackScriptData for its fields.
+var modelpackScriptTemplate = template.Must(template.New("modelpack").Parse(`set -euo pipefail
+PACK_MODE={{.PackMode}}
+{{.CategoryPackModeVars}}LAYER_CREATED={{.LayerCreated}}
+LAYER_SOURCE={{.LayerSource}}
+GZIP_CMD={{.GzipCmd}}
+ZSTD_CMD={{.ZstdCmd}}
+LZ4_CMD={{.Lz4Cmd}}
+TAR_FLAGS={{.TarFlags}}
+{{.TarFlagsProbe}}
 # Initialize OCI layout directory structure
 mkdir -p /layout/blobs/sha256
 
@@ -43,7 +471,7 @@ mkdir -p /layout/blobs/sha256
 src=/src
 if [ -f /src ]; then mkdir -p /worksrc && cp /src /worksrc/; src=/worksrc; fi
 cd "$src"
-
+{{.EmptySourceGuard}}
 # Initialize category lists for file classification
 > /tmp/weights.list
 > /tmp/config.list
@@ -51,37 +479,26 @@ cd "$src"
 > /tmp/code.list
 > /tmp/dataset.list
 
-# Find all files, excluding lock files and cache, and sort deterministically
+# Find all files, excluding lock files and cache, and sort deterministically (unless disabled)
 # Also cache file sizes in parallel to avoid repeated stat calls
-find . -type f ! -name '*.lock' ! -path './.cache/*' -print0 | \
-	xargs -0 -P $(nproc) -I {} sh -c 'echo "{}|$(stat -c%%s "{}")"' | \
-	LC_ALL=C sort > /tmp/allfiles_with_size.list
-
+find . -type f ! -name '*.lock' ! -path './.cache/*'{{.FindFilter}} -print0 | \
+	xargs -0 -P $(nproc) -I {} sh -c 'echo "{}|$(stat -c%s "{}")"' | \
+	{{.SortCmd}} > /tmp/allfiles_with_size.list
+{{.FreeSpaceCheck}}{{.MimeProbe}}
 # Categorize files by extension and size into appropriate lists
 # File size is already computed and cached
 while IFS='|' read -r f sz; do
 	f=${f#./}
 	base=$(basename "$f" | tr A-Z a-z)
 	case "$base" in
-		# Model weight files
-		*.safetensors|*.bin|*.gguf|*.pt|*.ckpt) echo "$f" >> /tmp/weights.list ;;
-		# Documentation files
-		readme*|license*|license|*.md) echo "$f" >> /tmp/docs.list ;;
-		# Configuration and tokenizer files
-		config.json|tokenizer.json|*tokenizer*.json|generation_config.json|*.json|*.txt) echo "$f" >> /tmp/config.list ;;
-		# Code files
-		*.py|*.sh|*.ipynb|*.go|*.js|*.ts) echo "$f" >> /tmp/code.list ;;
-		# Dataset files
-		*.csv|*.tsv|*.jsonl|*.parquet|*.arrow|*.h5|*.npz) echo "$f" >> /tmp/dataset.list ;;
-		# Unknown files: large ones (>10MB) go to weights, small ones to config
-		*) if [ "$sz" -gt %[6]d ]; then echo "$f" >> /tmp/weights.list; else echo "$f" >> /tmp/config.list; fi ;;
-	esac
+{{.CategoryOverridesCase}}{{.BuiltinCategoryCase}}{{.UnknownFileCase}}	esac
 	# Cache size for later use
 	echo "$f|$sz" >> /tmp/file_sizes.cache
 done < /tmp/allfiles_with_size.list
 
-# Initialize JSON array for manifest layers
-layers_json=""
+# Initialize manifest layer list; layer objects are appended incrementally to files
+# instead of an in-memory string so very large packs stay within shell limits
+: > /tmp/layers.json
 
 # get_cached_size: Retrieve cached file size to avoid repeated stat calls
 get_cached_size() {
@@ -89,116 +506,246 @@ get_cached_size() {
 	grep -F "$file|" /tmp/file_sizes.cache 2>/dev/null | cut -d'|' -f2 | head -n1
 }
 
-# append_layer: Add a file as a layer blob with annotations
-# Args: file path, media type, filepath annotation, metadata JSON, untested flag
+# file_mode: Print the permission bits of a file in decimal, as in the tar header mode field
+file_mode() {
+	echo $((8#$(stat -c%a "$1")))
+}
+
+# append_layer: Add a file as a layer blob with annotations. Each layer is written to
+# $LAYERS_FILE as one "<digest> <layer JSON>" line, and its filepath to $LAYERS_FILE.paths
+# Args: file path, media type, filepath annotation, metadata JSON, untested flag, category
 append_layer() {
-	file="$1"; mt="$2"; fpath="$3"; metaJson="$4"; untested="$5"
+	file="$1"; mt="$2"; fpath="$3"; metaJson="$4"; untested="$5"; category="$6"
 	[ ! -f "$file" ] && return 0
 	dgst=$(sha256sum "$file" | cut -d' ' -f1)
-	size=$(stat -c%%s "$file")
-	mv "$file" /layout/blobs/sha256/$dgst
-	[ -n "$layers_json" ] && layers_json="$layers_json , "
-	metaEsc=$(printf '%%s' "$metaJson" | sed 's/"/\\"/g')
-	ann="{ \"org.opencontainers.image.title\": \"$fpath\", \"org.cncf.model.filepath\": \"$fpath\", \"org.cncf.model.file.metadata+json\": \"$metaEsc\", \"org.cncf.model.file.mediatype.untested\": \"$untested\" }"
-	layers_json="${layers_json}{ \"mediaType\": \"$mt\", \"digest\": \"sha256:$dgst\", \"size\": $size, \"annotations\": $ann }"
+	size=$(stat -c%s "$file")
+	# Blobs are content-addressed: keep an existing blob with this digest instead of copying again.
+	# Parallel categories may store the same content at once, so blobs are renamed into place atomically
+	if [ -e /layout/blobs/sha256/$dgst ]; then
+		rm -f "$file"
+	else
+		mv "$file" /layout/blobs/sha256/.$dgst.$BASHPID
+		mv -f /layout/blobs/sha256/.$dgst.$BASHPID /layout/blobs/sha256/$dgst
+	fi
+	metaEsc=$(printf '%s' "$metaJson" | sed 's/"/\\"/g')
+	extra=""
+	[ -n "$LAYER_CREATED" ] && extra=", \"org.opencontainers.image.created\": \"$LAYER_CREATED\""
+	[ -n "$LAYER_SOURCE" ] && extra="$extra, \"org.opencontainers.image.source\": \"$LAYER_SOURCE\""
+	ann="{ \"org.opencontainers.image.title\": \"$fpath\", \"org.cncf.model.filepath\": \"$fpath\", \"org.cncf.model.file.metadata+json\": \"$metaEsc\", \"org.cncf.model.file.mediatype.untested\": \"$untested\", \"org.cncf.model.category\": \"$category\"$extra }"
+	printf '%s %s\n' "$dgst" "{ \"mediaType\": \"$mt\", \"digest\": \"sha256:$dgst\", \"size\": $size, \"annotations\": $ann }" >> "$LAYERS_FILE"
+	printf '%s\n' "$fpath" >> "$LAYERS_FILE.paths"
 }
 
 # det_tar: Create deterministic tar archive from file list
-det_tar() { list="$1"; out="$2"; [ ! -s "$list" ] && return 1; tar -cf "$out" -T "$list"; }
+det_tar() { list="$1"; out="$2"; [ ! -s "$list" ] && return 1; tar $TAR_FLAGS -cf "$out" -T "$list"; }
 
-# add_category: Process a file category and add layers according to pack mode
-# Args: list file, category name, raw media type, tar media type, tar+gzip media type, tar+zstd media type
-add_category() {
-	list="$1"; cat="$2"; mtRaw="$3"; mtTar="$4"; mtTarGz="$5"; mtTarZst="$6"
+# package_category: Process a file category and add layers according to pack mode
+# Args: list file, category name, pack mode, raw media type, tar media type, tar+gzip media type, tar+zstd media type, tar+lz4 media type
+package_category() {
+	list="$1"; cat="$2"; catMode="$3"; mtRaw="$4"; mtTar="$5"; mtTarGz="$6"; mtTarZst="$7"; mtTarLz4="$8"
 	[ ! -s "$list" ] && return 0
-	case "$PACK_MODE" in
+	case "$catMode" in
 		raw)
 			# Raw mode: each file becomes its own layer
 			while IFS= read -r f; do
 				fsize=$(get_cached_size "$f")
-				[ -z "$fsize" ] && fsize=$(stat -c%%s "$f")  # Fallback to stat if cache miss
-				meta=$(printf '{"name":"%%s","mode":420,"uid":0,"gid":0,"size":%%s,"mtime":"1970-01-01T00:00:00Z","typeflag":0}' "$f" "$fsize")
-				tmpCp=/tmp/raw-$(basename "$f")
+				[ -z "$fsize" ] && fsize=$(stat -c%s "$f")  # Fallback to stat if cache miss
+				meta=$(printf '{"name":"%s","mode":%s,"uid":0,"gid":0,"size":%s,"mtime":"1970-01-01T00:00:00Z","typeflag":0}' "$f" "$(file_mode "$f")" "$fsize")
+				tmpCp=/tmp/raw-${cat}-$(basename "$f")
 				cp "$f" "$tmpCp"
-				append_layer "$tmpCp" "$mtRaw" "$f" "$meta" "true"
+				append_layer "$tmpCp" "$mtRaw" "$f" "$meta" "true" "$cat"
 			done < "$list" ;;
-		tar|tar+gzip|tar+zstd)
+		tar|tar+gzip|tar+zstd|tar+lz4)
 			if [ "$cat" = "weights" ]; then
 				# Weights: tar each file individually (can be large)
 				while IFS= read -r f; do
 					b=$(basename "$f")
 					tmpTar=/tmp/${cat}-$b.tar
-					tar -cf "$tmpTar" -C "$(dirname "$f")" "$b"
-					case "$PACK_MODE" in
+					tar $TAR_FLAGS -cf "$tmpTar" -C "$(dirname "$f")" "$b"
+					case "$catMode" in
 						tar) mt=$mtTar ;;
-						tar+gzip) gzip -n "$tmpTar"; tmpTar="$tmpTar.gz"; mt=$mtTarGz ;;
-						tar+zstd) zstd -q --no-progress "$tmpTar"; tmpTar="$tmpTar.zst"; mt=$mtTarZst ;;
+						tar+gzip) $GZIP_CMD "$tmpTar"; tmpTar="$tmpTar.gz"; mt=$mtTarGz ;;
+						tar+zstd) $ZSTD_CMD "$tmpTar"; tmpTar="$tmpTar.zst"; mt=$mtTarZst ;;
+						tar+lz4) $LZ4_CMD "$tmpTar" "$tmpTar.lz4"; tmpTar="$tmpTar.lz4"; mt=$mtTarLz4 ;;
 					esac
 					fsize=$(get_cached_size "$f")
-					[ -z "$fsize" ] && fsize=$(stat -c%%s "$f")
-					meta=$(printf '{"name":"%%s","mode":420,"uid":0,"gid":0,"size":%%s,"mtime":"1970-01-01T00:00:00Z","typeflag":0}' "$f" "$fsize")
-					append_layer "$tmpTar" "$mt" "$f" "$meta" "true"
+					[ -z "$fsize" ] && fsize=$(stat -c%s "$f")
+					meta=$(printf '{"name":"%s","mode":%s,"uid":0,"gid":0,"size":%s,"mtime":"1970-01-01T00:00:00Z","typeflag":0}' "$f" "$(file_mode "$f")" "$fsize")
+					append_layer "$tmpTar" "$mt" "$f" "$meta" "true" "$cat"
 				done < "$list"
 			else
 				# Non-weights: bundle all category files into single tar
 				tmpTar=/tmp/${cat}.tar
 				det_tar "$list" "$tmpTar" || return 0
-				case "$PACK_MODE" in
+				case "$catMode" in
 					tar) outFile="$tmpTar"; mt=$mtTar ;;
-					tar+gzip) gzip -n "$tmpTar"; outFile="$tmpTar.gz"; mt=$mtTarGz ;;
-					tar+zstd) zstd -q --no-progress "$tmpTar"; outFile="$tmpTar.zst"; mt=$mtTarZst ;;
+					tar+gzip) $GZIP_CMD "$tmpTar"; outFile="$tmpTar.gz"; mt=$mtTarGz ;;
+					tar+zstd) $ZSTD_CMD "$tmpTar"; outFile="$tmpTar.zst"; mt=$mtTarZst ;;
+					tar+lz4) $LZ4_CMD "$tmpTar" "$tmpTar.lz4"; outFile="$tmpTar.lz4"; mt=$mtTarLz4 ;;
 				esac
 				count=$(wc -l < "$list" | tr -d ' ')
 				totalSize=0
 				while IFS= read -r f2; do
 					sz=$(get_cached_size "$f2")
-					[ -z "$sz" ] && sz=$(stat -c%%s "$f2")
+					[ -z "$sz" ] && sz=$(stat -c%s "$f2")
 					totalSize=$((totalSize + sz))
 				done < "$list"
-				meta=$(printf '{"name":"%%s","mode":420,"uid":0,"gid":0,"size":%%s,"mtime":"1970-01-01T00:00:00Z","typeflag":0,"files":%%d}' "$cat" "$totalSize" "$count")
-				append_layer "$outFile" "$mt" "$cat" "$meta" "true"
+				meta=$(printf '{"name":"%s","mode":420,"uid":0,"gid":0,"size":%s,"mtime":"1970-01-01T00:00:00Z","typeflag":0,"files":%d}' "$cat" "$totalSize" "$count")
+				append_layer "$outFile" "$mt" "$cat" "$meta" "true" "$cat"
 			fi ;;
+		*) echo "unknown pack mode $catMode for $cat" >&2; exit 1 ;;
+	esac
+}
+
+# Process each file category with appropriate ModelPack media types.
+# Categories run concurrently when CATEGORY_JOBS > 1 (bounded worker count). Each category
+# writes its layers to its own file; files are merged in fixed order so the manifest stays deterministic.
+CATEGORY_JOBS={{.CategoryJobs}}
+category_pids=()
+# add_category: Package a category into its own layer list, in the background when parallel
+add_category() {
+	LAYERS_FILE=/tmp/layers-$2.json
+	: > "$LAYERS_FILE"
+	: > "$LAYERS_FILE.paths"
+	if [ "$CATEGORY_JOBS" -gt 1 ]; then
+		while [ "$(jobs -rp | wc -l)" -ge "$CATEGORY_JOBS" ]; do wait -n; done
+		package_category "$@" &
+		category_pids+=($!)
+	else
+		package_category "$@"
+	fi
+}
+
+# package_single_layer: Bundle every category into one weight layer and record the
+# file-to-category mapping in /tmp/categories.json for the manifest config
+package_single_layer() {
+	cat /tmp/weights.list /tmp/config.list /tmp/docs.list /tmp/code.list /tmp/dataset.list > /tmp/all.list
+	{
+		printf '{ "categories": {'
+		csep=''
+		for c in weights config docs code dataset; do
+			printf '%s "%s": [' "$csep" "$c"; csep=','
+			fsep=''
+			while IFS= read -r f; do
+				printf '%s "%s"' "$fsep" "$(printf '%s' "$f" | sed 's/\\/\\\\/g; s/"/\\"/g')"; fsep=','
+			done < /tmp/$c.list
+			printf ' ]'
+		done
+		printf ' } }'
+	} > /tmp/categories.json
+	LAYERS_FILE=/tmp/layers-model.json
+	: > "$LAYERS_FILE"
+	: > "$LAYERS_FILE.paths"
+	tmpTar=/tmp/model.tar
+	det_tar /tmp/all.list "$tmpTar" || return 0
+	case "$PACK_MODE" in
+		raw|tar) outFile="$tmpTar"; mt=application/vnd.cncf.model.weight.v1.tar ;;
+		tar+gzip) $GZIP_CMD "$tmpTar"; outFile="$tmpTar.gz"; mt=application/vnd.cncf.model.weight.v1.tar+gzip ;;
+		tar+zstd) $ZSTD_CMD "$tmpTar"; outFile="$tmpTar.zst"; mt=application/vnd.cncf.model.weight.v1.tar+zstd ;;
+		tar+lz4) $LZ4_CMD "$tmpTar" "$tmpTar.lz4"; outFile="$tmpTar.lz4"; mt=application/vnd.cncf.model.weight.v1.tar+lz4 ;;
 		*) echo "unknown PACK_MODE $PACK_MODE" >&2; exit 1 ;;
 	esac
+	count=$(wc -l < /tmp/all.list | tr -d ' ')
+	totalSize=0
+	while IFS= read -r f; do
+		sz=$(get_cached_size "$f")
+		[ -z "$sz" ] && sz=$(stat -c%s "$f")
+		totalSize=$((totalSize + sz))
+	done < /tmp/all.list
+	meta=$(printf '{"name":"model","mode":420,"uid":0,"gid":0,"size":%s,"mtime":"1970-01-01T00:00:00Z","typeflag":0,"files":%d}' "$totalSize" "$count")
+	append_layer "$outFile" "$mt" "model" "$meta" "true" "model"
 }
 
-# Process each file category with appropriate ModelPack media types
-add_category /tmp/weights.list weights \
-	application/vnd.cncf.model.weight.v1.raw \
-	application/vnd.cncf.model.weight.v1.tar \
-	application/vnd.cncf.model.weight.v1.tar+gzip \
-	application/vnd.cncf.model.weight.v1.tar+zstd
-add_category /tmp/config.list config \
-	application/vnd.cncf.model.weight.config.v1.raw \
-	application/vnd.cncf.model.weight.config.v1.tar \
-	application/vnd.cncf.model.weight.config.v1.tar+gzip \
-	application/vnd.cncf.model.weight.config.v1.tar+zstd
-add_category /tmp/docs.list docs \
-	application/vnd.cncf.model.doc.v1.raw \
-	application/vnd.cncf.model.doc.v1.tar \
-	application/vnd.cncf.model.doc.v1.tar+gzip \
-	application/vnd.cncf.model.doc.v1.tar+zstd
-add_category /tmp/code.list code \
-	application/vnd.cncf.model.code.v1.raw \
-	application/vnd.cncf.model.code.v1.tar \
-	application/vnd.cncf.model.code.v1.tar+gzip \
-	application/vnd.cncf.model.code.v1.tar+zstd
-add_category /tmp/dataset.list dataset \
-	application/vnd.cncf.model.dataset.v1.raw \
-	application/vnd.cncf.model.dataset.v1.tar \
-	application/vnd.cncf.model.dataset.v1.tar+gzip \
-	application/vnd.cncf.model.dataset.v1.tar+zstd
-
-# Create empty manifest config and add as blob
-printf '{}' > /tmp/manifest-config.json
+SINGLE_LAYER={{.SingleLayer}}
+if [ "$SINGLE_LAYER" = "true" ]; then
+	# Single layer mode: one tar blob holding every file, categories kept in the manifest config
+	package_single_layer
+else
+	add_category /tmp/weights.list weights "$WEIGHTS_PACK_MODE" \
+		application/vnd.cncf.model.weight.v1.raw \
+		application/vnd.cncf.model.weight.v1.tar \
+		application/vnd.cncf.model.weight.v1.tar+gzip \
+		application/vnd.cncf.model.weight.v1.tar+zstd \
+		application/vnd.cncf.model.weight.v1.tar+lz4
+	add_category /tmp/config.list config "$CONFIG_PACK_MODE" \
+		application/vnd.cncf.model.weight.config.v1.raw \
+		application/vnd.cncf.model.weight.config.v1.tar \
+		application/vnd.cncf.model.weight.config.v1.tar+gzip \
+		application/vnd.cncf.model.weight.config.v1.tar+zstd \
+		application/vnd.cncf.model.weight.config.v1.tar+lz4
+	add_category /tmp/docs.list docs "$DOCS_PACK_MODE" \
+		application/vnd.cncf.model.doc.v1.raw \
+		application/vnd.cncf.model.doc.v1.tar \
+		application/vnd.cncf.model.doc.v1.tar+gzip \
+		application/vnd.cncf.model.doc.v1.tar+zstd \
+		application/vnd.cncf.model.doc.v1.tar+lz4
+	add_category /tmp/code.list code "$CODE_PACK_MODE" \
+		application/vnd.cncf.model.code.v1.raw \
+		application/vnd.cncf.model.code.v1.tar \
+		application/vnd.cncf.model.code.v1.tar+gzip \
+		application/vnd.cncf.model.code.v1.tar+zstd \
+		application/vnd.cncf.model.code.v1.tar+lz4
+	add_category /tmp/dataset.list dataset "$DATASET_PACK_MODE" \
+		application/vnd.cncf.model.dataset.v1.raw \
+		application/vnd.cncf.model.dataset.v1.tar \
+		application/vnd.cncf.model.dataset.v1.tar+gzip \
+		application/vnd.cncf.model.dataset.v1.tar+zstd \
+		application/vnd.cncf.model.dataset.v1.tar+lz4
+	for pid in "${category_pids[@]}"; do wait "$pid"; done
+fi
+
+# Merge the layer lists in deterministic category order, storing identical content once:
+# a layer whose digest was already seen is dropped and its path recorded as an alias of the
+# first one. This runs serially after packaging, so the outcome does not depend on how
+# parallel categories were scheduled.
+mkdir -p /tmp/layer-digests
+for c in weights config docs code dataset model; do
+	[ -s /tmp/layers-$c.json ] || continue
+	while IFS= read -r entry <&3 && IFS= read -r fpath <&4; do
+		dgst=${entry%% *}
+		if ! mkdir /tmp/layer-digests/$dgst 2>/dev/null; then
+			printf '%s\n' "$fpath" >> /tmp/layer-digests/$dgst/aliases
+			continue
+		fi
+		[ -s /tmp/layers.json ] && printf ' , ' >> /tmp/layers.json
+		printf '%s' "${entry#* }" >> /tmp/layers.json
+	done 3< /tmp/layers-$c.json 4< /tmp/layers-$c.json.paths
+done
+
+# Annotate layers whose content also appears under other paths with those paths
+for a in /tmp/layer-digests/*/aliases; do
+	[ -f "$a" ] || continue
+	d=$(basename "$(dirname "$a")")
+	aliases=$(sort "$a" | paste -sd, - | sed 's/[\/&|]/\\&/g')
+	sed -i "s|\"digest\": \"sha256:$d\", \"size\": [0-9]*, \"annotations\": { |&\"org.cncf.model.filepath.aliases\": \"$aliases\", |" /tmp/layers.json
+done
+
+# Total size and number of the packaged files, annotated on the manifest and index entry
+total_size=$(awk -F'|' '{ s += $NF } END { printf "%.0f", s }' /tmp/allfiles_with_size.list)
+file_count=$(wc -l < /tmp/allfiles_with_size.list | tr -d ' ')
+totals="\"org.cncf.model.total.size\": \"$total_size\", \"org.cncf.model.file.count\": \"$file_count\""
+
+# Create manifest config (empty unless a source file was requested or single layer
+# mode recorded the categories) and add as blob
+CONFIG_FROM={{.ConfigFrom}}
+if [ -n "$CONFIG_FROM" ]; then
+	if [ ! -f "$CONFIG_FROM" ]; then echo "config_from file $CONFIG_FROM not found in source" >&2; exit 1; fi
+	cp "$CONFIG_FROM" /tmp/manifest-config.json
+elif [ "$SINGLE_LAYER" = "true" ] && [ -f /tmp/categories.json ]; then
+	cp /tmp/categories.json /tmp/manifest-config.json
+else
+	printf '{}' > /tmp/manifest-config.json
+fi
 mc_dgst=$(sha256sum /tmp/manifest-config.json | cut -d' ' -f1)
-mc_size=$(stat -c%%s /tmp/manifest-config.json)
+mc_size=$(stat -c%s /tmp/manifest-config.json)
 cp /tmp/manifest-config.json /layout/blobs/sha256/$mc_dgst
 
-# Generate OCI manifest with all layers
-cat > /tmp/manifest.json <<EOF_MANIFEST
-{ "schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "artifactType": "%[2]s", "config": {"mediaType": "%[3]s", "digest": "sha256:$mc_dgst", "size": $mc_size}, "layers": [ $layers_json ] }
-EOF_MANIFEST
+# Generate OCI manifest with all layers, streaming the layer list from disk
+{
+	printf '{ "schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "artifactType": "{{.ArtifactType}}", "config": {"mediaType": "{{.ConfigMediaType}}", "digest": "sha256:%s", "size": %s}, "layers": [ ' "$mc_dgst" "$mc_size"
+	cat /tmp/layers.json
+	printf ' ], "annotations": { %s }{{.SubjectField}} }\n' "$totals"
+} > /tmp/manifest.json
 
 # Validate manifest structure
 if [ "$(head -c1 /tmp/manifest.json)" != "{" ] || \
@@ -209,35 +756,104 @@ fi
 
 # Add manifest as blob
 m_dgst=$(sha256sum /tmp/manifest.json | cut -d' ' -f1)
-m_size=$(stat -c%%s /tmp/manifest.json)
+m_size=$(stat -c%s /tmp/manifest.json)
 cp /tmp/manifest.json /layout/blobs/sha256/$m_dgst
 
-# Create OCI index pointing to manifest
+{{.ModelCardScript}}
+# Create OCI index pointing to manifest (and the model card referrer, if any)
 cat > /layout/index.json <<IDX
-{ "schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [ { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:$m_dgst", "size": $m_size, "annotations": { "org.opencontainers.image.title": "%[4]s", "org.opencontainers.image.ref.name": "%[5]s" } } ] }
+{ "schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [ { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:$m_dgst", "size": $m_size, "annotations": { "org.opencontainers.image.title": "{{.Name}}", "org.opencontainers.image.ref.name": "{{.RefName}}", $totals{{.IndexCreatedField}} } }$card_entry ] }
 IDX
 
 # Create OCI layout version marker
 printf '{ "imageLayoutVersion": "1.0.0" }' > /layout/oci-layout
+`))
+
+// freeSpaceCheck returns a script snippet that fails fast, rather than running out of space
+// partway through packaging, when there is not enough free space for the files in sizeList
+// (path|size lines) plus headroom percent. Layers are staged in /tmp (file copies, tar
+// bundles and their compressed output) before they move into /layout, so both need room for
+// a full copy, and a filesystem holding both must fit two.
+func freeSpaceCheck(sizeList string, headroom int) string {
+	return fmt.Sprintf(`
+# Fail fast unless /layout and the /tmp staging area can hold the packed files plus %[2]d%% headroom
+need_kb=$(awk -F'|' -v h=%[2]d '{ s += $NF } END { printf "%%d", s * (100 + h) / 100 / 1024 + 1 }' %[1]s)
+layout_need_kb=$need_kb
+if [ "$(stat -c %%d /tmp)" = "$(stat -c %%d /layout)" ]; then
+	layout_need_kb=$((need_kb * 2))
+else
+	tmp_avail_kb=$(df -Pk /tmp | awk 'NR == 2 { print $4 }')
+	if [ "$tmp_avail_kb" -lt "$need_kb" ]; then
+		echo "insufficient disk space: staging layers needs ${need_kb} KiB (source size plus %[2]d%% headroom) but only ${tmp_avail_kb} KiB is free in /tmp; free up space or lower disk_headroom" >&2
+		exit 1
+	fi
+fi
+avail_kb=$(df -Pk /layout | awk 'NR == 2 { print $4 }')
+if [ "$avail_kb" -lt "$layout_need_kb" ]; then
+	echo "insufficient disk space: packaging needs ${layout_need_kb} KiB (source size plus %[2]d%% headroom, twice when staged on the same filesystem) but only ${avail_kb} KiB is free in /layout; free up space or lower disk_headroom" >&2
+	exit 1
+fi
+`, sizeList, headroom)
+}
+
+// mimeProbe returns the script step making sure file(1) is available when mimeCategorization
+// is set: it is installed with apk when missing, and the build fails when it cannot be, instead
+// of every unknown file silently falling back to the size heuristic.
+func (o scriptOptions) mimeProbe() string {
+	if !o.mimeCategorization {
+		return ""
+	}
+	return `# MIME categorization needs file(1); install it when the packaging image lacks it
+if ! command -v file >/dev/null 2>&1; then
+	if command -v apk >/dev/null 2>&1; then apk add --no-cache file >/dev/null || true; fi
+	if ! command -v file >/dev/null 2>&1; then
+		echo "mime_categorization requires the file command, which is missing from the packaging image and could not be installed" >&2
+		exit 1
+	fi
+fi
 `
-	return fmt.Sprintf(tmpl, packMode, artifactType, mtManifest, name, refName, largeFileThreshold)
+}
+
+// unknownFileCase returns the fallback branch of the categorization case statement for
+// files whose extension is not recognized. When mime is true, the file's MIME type
+// (via file --mime-type) is consulted before falling back to the size heuristic, which
+// puts files larger than threshold bytes in weights.
+func unknownFileCase(mime bool, threshold int64) string {
+	sizeHeuristic := fmt.Sprintf(`if [ "$sz" -gt %d ]; then echo "$f" >> /tmp/weights.list; else echo "$f" >> /tmp/config.list; fi`, threshold)
+	if !mime {
+		return fmt.Sprintf(`		# Unknown files: large ones go to weights, small ones to config
+		*) %s ;;
+`, sizeHeuristic)
+	}
+	return fmt.Sprintf(`		# Unknown files: classify by MIME type, then fall back to size (large ones weights, else config)
+		*)
+			mime=$(file --brief --mime-type "$f")
+			case "$mime" in
+				text/x-python|text/x-script.python|text/x-shellscript|application/x-sh|application/javascript|text/javascript) echo "$f" >> /tmp/code.list ;;
+				text/markdown|text/x-markdown|text/html) echo "$f" >> /tmp/docs.list ;;
+				text/csv|text/tab-separated-values|application/x-hdf|application/x-hdf5|application/vnd.apache.parquet) echo "$f" >> /tmp/dataset.list ;;
+				application/json|text/plain|application/x-yaml|text/yaml) echo "$f" >> /tmp/config.list ;;
+				*) %s ;;
+			esac ;;
+`, sizeHeuristic)
 }
 
 // generateGenericScript builds the generic artifact OCI layout assembly script.
 //
 // This script performs simpler packaging than modelpack:
 //  1. Finds all files in source
-//  2. Packages them according to packMode (raw, tar, tar+gzip, tar+zstd)
+//  2. Packages them according to packMode (raw, tar, tar+gzip, tar+zstd, tar+lz4)
 //  3. Creates OCI layout with single layer or multiple raw layers
 //
 // Arguments:
 //
-//	packMode: raw|tar|tar+gzip|tar+zstd - packaging method
+//	packMode: raw|tar|tar+gzip|tar+zstd|tar+lz4 - packaging method
 //	artifactType: artifact type for manifest (default: application/vnd.unknown.artifact.v1)
 //	name: annotation org.opencontainers.image.title
 //	refName: annotation org.opencontainers.image.ref.name
 //	debug: if true, enables bash debug mode (set -x)
-func generateGenericScript(packMode, artifactType, name, refName string, debug bool) string { //nolint:lll
+//	opts: optional script behaviors (see scriptOptions)
+func generateGenericScript(packMode, artifactType, name, refName string, debug bool, opts scriptOptions) string { //nolint:lll
 	debugLine := ""
 	if debug {
 		debugLine = "set -x"
@@ -248,9 +864,13 @@ func generateGenericScript(packMode, artifactType, name, refName string, debug b
 		rawLayerMT = "application/octet-stream"
 	}
 	tmpl := `set -euo pipefail
-%s
-PACK_MODE=%s
-
+%[1]s
+PACK_MODE=%[2]s
+GZIP_CMD=%[9]s
+ZSTD_CMD=%[15]s
+LZ4_CMD=%[16]s
+TAR_FLAGS=%[13]s
+%[14]s
 # Initialize OCI layout directory structure
 mkdir -p /layout/blobs/sha256
 
@@ -258,18 +878,18 @@ mkdir -p /layout/blobs/sha256
 work=/src
 if [ -f /src ]; then mkdir -p /worksrc && cp /src /worksrc/; work=/worksrc; fi
 cd "$work"
-
-# Find all files, excluding lock files and cache, sorted deterministically
+%[18]s
+# Find all files, excluding lock files and cache, sorted deterministically (unless disabled)
 # Cache file sizes for later use
-find . -type f ! -name '*.lock' ! -path './.cache/*' -print0 | \
+find . -type f ! -name '*.lock' ! -path './.cache/*'%[19]s -print0 | \
 	xargs -0 -P $(nproc) -I {} sh -c 'f="{}"; echo "$f|$(stat -c%%s "$f")"' | \
-	sed 's|^\./||' | LC_ALL=C sort > /tmp/files_with_size.list
-
+	sed 's|^\./||' | %[8]s > /tmp/files_with_size.list
+%[11]s
 # Extract just the file paths for processing
 cut -d'|' -f1 < /tmp/files_with_size.list > /tmp/files.list
 
-# Initialize JSON array for manifest layers
-layers_json=""
+# Initialize manifest layer list; layer objects are appended incrementally to a file
+: > /tmp/layers.json
 
 # get_file_size: Retrieve cached file size
 get_file_size() {
@@ -283,10 +903,11 @@ append_layer() {
 	[ ! -f "$file" ] && return 0
 	dgst=$(sha256sum "$file" | cut -d' ' -f1)
 	size=$(stat -c%%s "$file")
-	mv "$file" /layout/blobs/sha256/$dgst
-	[ -n "$layers_json" ] && layers_json="$layers_json , "
+	# Blobs are content-addressed: identical files share one blob but keep their own layer entry
+	if [ -e /layout/blobs/sha256/$dgst ]; then rm -f "$file"; else mv "$file" /layout/blobs/sha256/$dgst; fi
+	[ -s /tmp/layers.json ] && printf ' , ' >> /tmp/layers.json
 	ann="{ \"org.opencontainers.image.title\": \"$title\" }"
-	layers_json="${layers_json}{ \"mediaType\": \"$mt\", \"digest\": \"sha256:$dgst\", \"size\": $size, \"annotations\": $ann }"
+	printf '%%s' "{ \"mediaType\": \"$mt\", \"digest\": \"sha256:$dgst\", \"size\": $size, \"annotations\": $ann }" >> /tmp/layers.json
 }
 
 # Process files according to pack mode
@@ -295,32 +916,31 @@ case "$PACK_MODE" in
 		# Raw mode: each file becomes its own layer
 		while IFS= read -r f; do
 			cp "$f" "/tmp/$(basename "$f")"
-			append_layer "/tmp/$(basename "$f")" "%s" "$f"
+			append_layer "/tmp/$(basename "$f")" "%[3]s" "$f"
 		done < /tmp/files.list ;;
-	tar|tar+gzip|tar+zstd)
+	tar|tar+gzip|tar+zstd|tar+lz4)
 		# Archive mode: bundle all files into single tar
 		tarFile=/tmp/allfiles.tar
-		tar -cf "$tarFile" -T /tmp/files.list || true
-		mt="%s"
+		tar $TAR_FLAGS -cf "$tarFile" -T /tmp/files.list || true
+		mt="%[4]s"
 		layerName="allfiles.tar"
 		case "$PACK_MODE" in
 			tar) outFile="$tarFile" ;;
-			tar+gzip) gzip -n "$tarFile"; outFile="$tarFile.gz"; layerName="allfiles.tar.gz" ;;
-			tar+zstd) zstd -q --no-progress "$tarFile"; outFile="$tarFile.zst"; layerName="allfiles.tar.zst" ;;
+			tar+gzip) $GZIP_CMD "$tarFile"; outFile="$tarFile.gz"; layerName="allfiles.tar.gz" ;;
+			tar+zstd) $ZSTD_CMD "$tarFile"; outFile="$tarFile.zst"; layerName="allfiles.tar.zst" ;;
+			tar+lz4) $LZ4_CMD "$tarFile" "$tarFile.lz4"; outFile="$tarFile.lz4"; layerName="allfiles.tar.lz4" ;;
 		esac
 		append_layer "$outFile" "$mt" "$layerName" ;;
 	*) echo "unknown PACK_MODE $PACK_MODE" >&2; exit 1 ;;
 esac
 
-# Create empty config blob
-printf '{}' > /tmp/config.json
-cfg_dgst=$(sha256sum /tmp/config.json | awk '{print $1}')
-cfg_size=$(stat -c%%s /tmp/config.json)
-cp /tmp/config.json /layout/blobs/sha256/$cfg_dgst
-
-# Generate OCI manifest
-manifest="{ \"schemaVersion\": 2, \"mediaType\": \"application/vnd.oci.image.manifest.v1+json\", \"artifactType\": \"%s\", \"config\": {\"mediaType\": \"application/vnd.oci.empty.v1+json\", \"digest\": \"sha256:$cfg_dgst\", \"size\": $cfg_size}, \"layers\": [ $layers_json ] }"
-printf '%%s' "$manifest" > /tmp/manifest.json
+%[12]s
+# Generate OCI manifest, streaming the layer list from disk
+{
+	printf '{ "schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "artifactType": "%[5]s", "config": {"mediaType": "application/vnd.oci.empty.v1+json", "digest": "sha256:%%s", "size": %%s%%s}, "layers": [ ' "$cfg_dgst" "$cfg_size" "$cfg_data"
+	cat /tmp/layers.json
+	printf ' ]%[10]s }'
+} > /tmp/manifest.json
 
 # Add manifest as blob
 m_dgst=$(sha256sum /tmp/manifest.json | awk '{print $1}')
@@ -329,7 +949,7 @@ cp /tmp/manifest.json /layout/blobs/sha256/$m_dgst
 
 # Create OCI index pointing to manifest
 cat > /layout/index.json <<EOF
-{ "schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [ { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:$m_dgst", "size": $m_size, "annotations": { "org.opencontainers.image.title": "%s", "org.opencontainers.image.ref.name": "%s" } } ] }
+{ "schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [ { "mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:$m_dgst", "size": $m_size, "annotations": { "org.opencontainers.image.title": "%[6]s", "org.opencontainers.image.ref.name": "%[7]s"%[17]s } } ] }
 EOF
 
 # Create OCI layout version marker
@@ -337,5 +957,45 @@ cat > /layout/oci-layout <<EOF
 { "imageLayoutVersion": "1.0.0" }
 EOF
 `
-	return fmt.Sprintf(tmpl, debugLine, packMode, rawLayerMT, archiveLayerMT, artifactType, name, refName)
+	return fmt.Sprintf(tmpl, debugLine, packMode, rawLayerMT, archiveLayerMT, artifactType, name, refName, opts.sortCmd(), utils.ShellQuote(opts.gzipCmd()), opts.subjectField(), freeSpaceCheck("/tmp/files_with_size.list", opts.diskHeadroom), opts.emptyConfigScript(), utils.ShellQuote(opts.tarFlags()), tarFlagsProbe, utils.ShellQuote(opts.zstdCmd()), utils.ShellQuote(opts.lz4Cmd()), opts.indexCreatedField(), opts.emptySourceGuard(), opts.sizeFilter()) + layoutGateScript
+}
+
+// generateSingleTarScript builds the script for generic_output_mode=tar, which archives every
+// source file into /out/<tarName> instead of assembling an OCI layout. Entries are sorted
+// (unless determinism is disabled) and carry the sourceDateEpoch mtime and root ownership,
+// so the tarball only depends on file paths, modes and contents.
+//
+// Arguments:
+//
+//	tarName: file name of the tarball written to /out
+//	debug: if true, enables bash debug mode (set -x)
+//	opts: optional script behaviors (see scriptOptions)
+func generateSingleTarScript(tarName string, debug bool, opts scriptOptions) string {
+	debugLine := ""
+	if debug {
+		debugLine = "set -x"
+	}
+	tmpl := `set -euo pipefail
+%[1]s
+TAR_FLAGS=%[2]s
+%[3]s
+# Normalize entry metadata; tars without these options keep source timestamps and owners
+REPRO_FLAGS="--format=gnu --mtime=@%[4]d --owner=0 --group=0 --numeric-owner"
+if ! tar $REPRO_FLAGS -cf /dev/null -T /dev/null 2>/dev/null; then
+	echo "warning: tar does not support $REPRO_FLAGS, the archive is not reproducible" >&2
+	REPRO_FLAGS=
+fi
+mkdir -p /out
+
+# Handle single file input (copy to temporary directory)
+work=/src
+if [ -f /src ]; then mkdir -p /worksrc && cp /src /worksrc/; work=/worksrc; fi
+cd "$work"
+%[7]s
+# Find all files, excluding lock files and cache, sorted deterministically (unless disabled)
+find . -type f ! -name '*.lock' ! -path './.cache/*'%[8]s | sed 's|^\./||' | %[5]s > /tmp/files.list
+
+tar $TAR_FLAGS $REPRO_FLAGS -cf /out/%[6]s -T /tmp/files.list
+`
+	return fmt.Sprintf(tmpl, debugLine, utils.ShellQuote(opts.tarFlags()), tarFlagsProbe, opts.sourceDateEpoch, opts.sortCmd(), utils.ShellQuote(tarName), opts.emptySourceGuard(), opts.sizeFilter())
 }
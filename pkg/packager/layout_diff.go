@@ -0,0 +1,217 @@
+package packager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Reasons reported for a LayoutDifference.
+const (
+	DiffReasonTimestamp = "timestamp" // a date annotation differs
+	DiffReasonOrdering  = "ordering"  // the same layers appear in a different order
+	DiffReasonContent   = "content"   // a blob digest or size differs
+	DiffReasonMetadata  = "metadata"  // a media type or non-date annotation differs
+	DiffReasonMissing   = "missing"   // a descriptor or annotation exists in only one layout
+)
+
+// LayoutDifference is a single difference between two OCI image layouts. Path locates the
+// descriptor (e.g. "manifests[0].layers[2]"), Field names what differs and A/B hold the
+// values from each layout (empty when absent).
+type LayoutDifference struct {
+	Path   string `json:"path"`
+	Field  string `json:"field"`
+	A      string `json:"a,omitempty"`
+	B      string `json:"b,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// LayoutDiff is the structured result of DiffLayouts.
+type LayoutDiff struct {
+	Differences []LayoutDifference `json:"differences"`
+}
+
+// Identical reports whether both layouts resolved to the same descriptors.
+func (d *LayoutDiff) Identical() bool {
+	return len(d.Differences) == 0
+}
+
+func (d *LayoutDiff) add(path, field, a, b, reason string) {
+	d.Differences = append(d.Differences, LayoutDifference{Path: path, Field: field, A: a, B: b, Reason: reason})
+}
+
+// DiffLayouts compares two OCI image layout directories (as produced by the packager) by
+// walking index.json, each referenced manifest, its config and layers, and reports which
+// digests, sizes, media types and annotations differ along with the likely reason. Manifests
+// are paired by position in the index. It is intended for checking build reproducibility.
+func DiffLayouts(a, b string) (*LayoutDiff, error) {
+	indexA, err := readLayoutIndex(a)
+	if err != nil {
+		return nil, err
+	}
+	indexB, err := readLayoutIndex(b)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &LayoutDiff{}
+	diffAnnotations(diff, "index", indexA.Annotations, indexB.Annotations)
+	for i := 0; i < max(len(indexA.Manifests), len(indexB.Manifests)); i++ {
+		p := fmt.Sprintf("manifests[%d]", i)
+		if i >= len(indexA.Manifests) || i >= len(indexB.Manifests) {
+			diff.add(p, "descriptor", descriptorDigest(indexA.Manifests, i), descriptorDigest(indexB.Manifests, i), DiffReasonMissing)
+			continue
+		}
+		descA, descB := indexA.Manifests[i], indexB.Manifests[i]
+		diffDescriptor(diff, p, descA, descB)
+		if descA.Digest == descB.Digest {
+			continue
+		}
+		manifestA, err := readLayoutManifest(a, descA.Digest)
+		if err != nil {
+			return nil, err
+		}
+		manifestB, err := readLayoutManifest(b, descB.Digest)
+		if err != nil {
+			return nil, err
+		}
+		diffManifests(diff, p, manifestA, manifestB)
+	}
+	return diff, nil
+}
+
+// diffManifests compares the config, layers and annotations of two manifests.
+func diffManifests(diff *LayoutDiff, p string, a, b *ocispec.Manifest) {
+	if a.ArtifactType != b.ArtifactType {
+		diff.add(p, "artifactType", a.ArtifactType, b.ArtifactType, DiffReasonMetadata)
+	}
+	diffAnnotations(diff, p, a.Annotations, b.Annotations)
+	diffDescriptor(diff, p+".config", a.Config, b.Config)
+
+	// Layers with identical digests in a different order are reported as an ordering difference.
+	reordered := len(a.Layers) == len(b.Layers) && sameDigests(a.Layers, b.Layers)
+	for i := 0; i < max(len(a.Layers), len(b.Layers)); i++ {
+		lp := fmt.Sprintf("%s.layers[%d]", p, i)
+		if i >= len(a.Layers) || i >= len(b.Layers) {
+			diff.add(lp, "descriptor", descriptorDigest(a.Layers, i), descriptorDigest(b.Layers, i), DiffReasonMissing)
+			continue
+		}
+		if reordered && a.Layers[i].Digest != b.Layers[i].Digest {
+			diff.add(lp, "digest", a.Layers[i].Digest.String(), b.Layers[i].Digest.String(), DiffReasonOrdering)
+			continue
+		}
+		diffDescriptor(diff, lp, a.Layers[i], b.Layers[i])
+	}
+}
+
+// diffDescriptor compares the media type, digest, size and annotations of two descriptors.
+func diffDescriptor(diff *LayoutDiff, p string, a, b ocispec.Descriptor) {
+	if a.MediaType != b.MediaType {
+		diff.add(p, "mediaType", a.MediaType, b.MediaType, DiffReasonMetadata)
+	}
+	if a.Digest != b.Digest {
+		diff.add(p, "digest", a.Digest.String(), b.Digest.String(), DiffReasonContent)
+	}
+	if a.Size != b.Size {
+		diff.add(p, "size", fmt.Sprint(a.Size), fmt.Sprint(b.Size), DiffReasonContent)
+	}
+	diffAnnotations(diff, p, a.Annotations, b.Annotations)
+}
+
+// diffAnnotations reports annotations that differ, in key order.
+func diffAnnotations(diff *LayoutDiff, p string, a, b map[string]string) {
+	keys := map[string]struct{}{}
+	for k := range a {
+		keys[k] = struct{}{}
+	}
+	for k := range b {
+		keys[k] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		va, okA := a[k]
+		vb, okB := b[k]
+		switch {
+		case okA && okB && va == vb:
+			continue
+		case !okA || !okB:
+			diff.add(p, "annotation "+k, va, vb, DiffReasonMissing)
+		case isTimestamp(va) && isTimestamp(vb):
+			diff.add(p, "annotation "+k, va, vb, DiffReasonTimestamp)
+		default:
+			diff.add(p, "annotation "+k, va, vb, DiffReasonMetadata)
+		}
+	}
+}
+
+// isTimestamp reports whether v is an RFC 3339 date, as used by created annotations.
+func isTimestamp(v string) bool {
+	_, err := time.Parse(time.RFC3339, v)
+	return err == nil
+}
+
+// sameDigests reports whether a and b reference the same multiset of digests.
+func sameDigests(a, b []ocispec.Descriptor) bool {
+	counts := map[digest.Digest]int{}
+	for _, d := range a {
+		counts[d.Digest]++
+	}
+	for _, d := range b {
+		counts[d.Digest]--
+	}
+	for _, n := range counts {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// descriptorDigest returns the digest of descs[i], or an empty string when out of range.
+func descriptorDigest(descs []ocispec.Descriptor, i int) string {
+	if i >= len(descs) {
+		return ""
+	}
+	return descs[i].Digest.String()
+}
+
+// readLayoutIndex reads and decodes the index.json of an OCI image layout.
+func readLayoutIndex(layout string) (*ocispec.Index, error) {
+	data, err := os.ReadFile(filepath.Join(layout, ocispec.ImageIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCI layout index: %w", err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filepath.Join(layout, ocispec.ImageIndexFile), err)
+	}
+	return &index, nil
+}
+
+// readLayoutManifest reads and decodes the manifest blob dgst from an OCI image layout.
+func readLayoutManifest(layout string, dgst digest.Digest) (*ocispec.Manifest, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest digest %q: %w", dgst, err)
+	}
+	blob := filepath.Join(layout, ocispec.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+	data, err := os.ReadFile(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", dgst, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", dgst, err)
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,439 @@
+package packager
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	v1 "github.com/modelpack/model-spec/specs-go/v1"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PackOptions configures PackDirectory.
+type PackOptions struct {
+	// OutputDir is the directory the OCI image layout is written to, created if missing.
+	// When empty, a new temporary directory is used.
+	OutputDir string
+	// PackMode is the layer packaging: raw (the default), tar, tar+gzip or tar+zstd.
+	PackMode string
+	// Name is the org.opencontainers.image.title of the index entry, aikitmodel when empty.
+	Name string
+	// RefName is the org.opencontainers.image.ref.name of the index entry, latest when empty.
+	RefName string
+	// LargeFileThreshold is the size in bytes above which files of unknown type are
+	// categorized as weights; zero means the 10 MiB default.
+	LargeFileThreshold int64
+	// CategoryOverrides are file name patterns matched before the built-in categorization,
+	// in the syntax of the category_overrides build-arg (e.g. "weights:*.onnx;config:*.yaml").
+	CategoryOverrides string
+	// SkipEmptyFiles leaves zero-byte files out of the pack.
+	SkipEmptyFiles bool
+}
+
+// packCategoryMediaTypes maps each modelpack category to its layer media types, indexed
+// like packDirectoryModes.
+var packCategoryMediaTypes = map[string][]string{
+	"weights": {v1.MediaTypeModelWeightRaw, v1.MediaTypeModelWeight, v1.MediaTypeModelWeightGzip, v1.MediaTypeModelWeightZstd},
+	"config":  {v1.MediaTypeModelWeightConfigRaw, v1.MediaTypeModelWeightConfig, v1.MediaTypeModelWeightConfigGzip, v1.MediaTypeModelWeightConfigZstd},
+	"docs":    {v1.MediaTypeModelDocRaw, v1.MediaTypeModelDoc, v1.MediaTypeModelDocGzip, v1.MediaTypeModelDocZstd},
+	"code":    {v1.MediaTypeModelCodeRaw, v1.MediaTypeModelCode, v1.MediaTypeModelCodeGzip, v1.MediaTypeModelCodeZstd},
+	"dataset": {v1.MediaTypeModelDatasetRaw, v1.MediaTypeModelDataset, v1.MediaTypeModelDatasetGzip, v1.MediaTypeModelDatasetZstd},
+}
+
+// packDirectoryModes lists the pack modes PackDirectory supports.
+var packDirectoryModes = []string{packModeRaw, "tar", "tar+gzip", "tar+zstd"}
+
+// packFile is a source file selected for packing.
+type packFile struct {
+	path string // slash-separated path relative to the source directory
+	size int64
+	mode fs.FileMode
+}
+
+// PackDirectory packages the files of the local directory dir as a modelpack OCI image
+// layout, without BuildKit, and returns the path of the layout. Files are selected,
+// categorized and turned into layers like the packager/modelpack target does: lock files
+// and .cache are skipped, categories follow the same rules, and in tar modes weights get
+// one layer per file while every other category is bundled into a single layer. Tar
+// entries are normalized (epoch mtime, root owner) so packing the same files yields the
+// same digests.
+func PackDirectory(dir string, opts PackOptions) (string, error) {
+	packMode := opts.PackMode
+	if packMode == "" {
+		packMode = packModeRaw
+	}
+	modeIndex := slices.Index(packDirectoryModes, packMode)
+	if modeIndex < 0 {
+		return "", fmt.Errorf("invalid pack mode %q, must be one of %s", packMode, strings.Join(packDirectoryModes, ", "))
+	}
+	overrides, err := parseCategoryOverrides(opts.CategoryOverrides)
+	if err != nil {
+		return "", err
+	}
+
+	files, err := collectPackFiles(dir, opts.SkipEmptyFiles)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no files matched in %s", dir)
+	}
+	threshold := scriptOptions{largeFileThreshold: opts.LargeFileThreshold}.weightThreshold()
+	categories := make(map[string][]packFile)
+	for _, f := range files {
+		c := categorizeFile(f.path, f.size, overrides, threshold)
+		categories[c] = append(categories[c], f)
+	}
+
+	out := opts.OutputDir
+	if out == "" {
+		if out, err = os.MkdirTemp("", "aikit-pack-"); err != nil {
+			return "", err
+		}
+	}
+	w := &layoutWriter{blobDir: filepath.Join(out, "blobs", "sha256"), layerIndex: make(map[digest.Digest]int)}
+	if err := os.MkdirAll(w.blobDir, 0o755); err != nil {
+		return "", err
+	}
+
+	for _, c := range modelpackCategories {
+		if err := w.addCategory(dir, c, categories[c], packMode, packCategoryMediaTypes[c][modeIndex]); err != nil {
+			return "", fmt.Errorf("failed to pack %s: %w", c, err)
+		}
+	}
+	if err := w.writeIndex(out, files, opts); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// collectPackFiles returns the regular files below dir in byte-wise path order, leaving
+// out lock files, the .cache directory and, with skipEmpty, zero-byte files.
+func collectPackFiles(dir string, skipEmpty bool) ([]packFile, error) {
+	var files []packFile
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == ".cache" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), ".lock") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if skipEmpty && info.Size() == 0 {
+			return nil
+		}
+		files = append(files, packFile{path: rel, size: info.Size(), mode: info.Mode().Perm()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(files, func(a, b packFile) int { return strings.Compare(a.path, b.path) })
+	return files, nil
+}
+
+// CategorizeFile returns the modelpack category ("weights", "config", "docs", "code" or
+// "dataset") of a file named name of size bytes under the built-in rules, the same ones the
+// packaging script generates its categorization case statement from.
+func CategorizeFile(name string, size int64) string {
+	return categorizeFile(name, size, nil, largeFileThreshold)
+}
+
+// categorizeFile returns the modelpack category of the file at name: the first override or
+// built-in rule whose pattern matches the lowercased base name, else weights for files
+// larger than threshold bytes and config for the rest.
+func categorizeFile(name string, size int64, overrides []categoryPatterns, threshold int64) string {
+	base := strings.ToLower(path.Base(name))
+	rules := slices.Clone(overrides)
+	for _, r := range builtinCategoryRules {
+		rules = append(rules, r.categoryPatterns)
+	}
+	for _, r := range rules {
+		for _, p := range r.patterns {
+			// Shell case patterns negate bracket expressions with ! where path.Match uses ^
+			if ok, _ := path.Match(strings.ReplaceAll(p, "[!", "[^"), base); ok {
+				return r.category
+			}
+		}
+	}
+	if size > threshold {
+		return "weights"
+	}
+	return "config"
+}
+
+// fileMetadata returns the org.cncf.model.file.metadata+json value of f.
+func fileMetadata(f packFile) v1.FileMetadata {
+	return v1.FileMetadata{Name: f.path, Mode: uint32(f.mode), Size: f.size, ModTime: time.Unix(0, 0).UTC()}
+}
+
+// layoutWriter writes blobs to an OCI image layout and collects the manifest layers.
+// Layers with identical content are stored once; the paths of later copies are recorded
+// in the org.cncf.model.filepath.aliases annotation of the first.
+type layoutWriter struct {
+	blobDir    string
+	layers     []ocispec.Descriptor
+	layerIndex map[digest.Digest]int
+	aliases    map[int][]string
+}
+
+// addCategory adds the layers of one category: a layer per file in raw mode and for
+// weights, otherwise a single tar layer holding every file of the category.
+func (w *layoutWriter) addCategory(dir, category string, files []packFile, packMode, mediaType string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	if packMode == packModeRaw || category == "weights" {
+		for _, f := range files {
+			desc, err := w.writeBlob(mediaType, func(dst io.Writer) error {
+				if packMode == packModeRaw {
+					return copyFile(dst, filepath.Join(dir, filepath.FromSlash(f.path)))
+				}
+				return writeTar(dst, packMode, dir, []packFile{f}, true)
+			})
+			if err != nil {
+				return err
+			}
+			meta, err := json.Marshal(fileMetadata(f))
+			if err != nil {
+				return err
+			}
+			w.addLayer(desc, f.path, string(meta), category)
+		}
+		return nil
+	}
+
+	desc, err := w.writeBlob(mediaType, func(dst io.Writer) error {
+		return writeTar(dst, packMode, dir, files, false)
+	})
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	meta, err := json.Marshal(struct {
+		v1.FileMetadata
+		Files int `json:"files"`
+	}{v1.FileMetadata{Name: category, Mode: 0o644, Size: total, ModTime: time.Unix(0, 0).UTC()}, len(files)})
+	if err != nil {
+		return err
+	}
+	w.addLayer(desc, category, string(meta), category)
+	return nil
+}
+
+// addLayer appends desc as a layer for fpath, or records fpath as an alias when a layer
+// with the same digest already exists.
+func (w *layoutWriter) addLayer(desc ocispec.Descriptor, fpath, meta, category string) {
+	if i, ok := w.layerIndex[desc.Digest]; ok {
+		if w.aliases == nil {
+			w.aliases = make(map[int][]string)
+		}
+		w.aliases[i] = append(w.aliases[i], fpath)
+		return
+	}
+	desc.Annotations = map[string]string{
+		ocispec.AnnotationTitle:        fpath,
+		v1.AnnotationFilepath:          fpath,
+		v1.AnnotationFileMetadata:      meta,
+		v1.AnnotationMediaTypeUntested: "true",
+		"org.cncf.model.category":      category,
+	}
+	w.layerIndex[desc.Digest] = len(w.layers)
+	w.layers = append(w.layers, desc)
+}
+
+// writeBlob stores the content written by write as a blob and returns its descriptor.
+func (w *layoutWriter) writeBlob(mediaType string, write func(io.Writer) error) (ocispec.Descriptor, error) {
+	tmp, err := os.CreateTemp(w.blobDir, ".tmp-")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	digester := digest.Canonical.Digester()
+	if err := write(io.MultiWriter(tmp, digester.Hash())); err != nil {
+		tmp.Close()
+		return ocispec.Descriptor{}, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return ocispec.Descriptor{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	dgst := digester.Digest()
+	if err := os.Rename(tmp.Name(), filepath.Join(w.blobDir, dgst.Encoded())); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: info.Size()}, nil
+}
+
+// writeJSONBlob stores v marshaled as JSON and returns its descriptor.
+func (w *layoutWriter) writeJSONBlob(mediaType string, v any) (ocispec.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return w.writeBlob(mediaType, func(dst io.Writer) error {
+		_, err := dst.Write(data)
+		return err
+	})
+}
+
+// writeIndex writes the empty model config, the manifest referencing the collected layers,
+// index.json and the oci-layout marker to the layout at out.
+func (w *layoutWriter) writeIndex(out string, files []packFile, opts PackOptions) error {
+	for i, paths := range w.aliases {
+		slices.Sort(paths)
+		w.layers[i].Annotations["org.cncf.model.filepath.aliases"] = strings.Join(paths, ",")
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	totals := map[string]string{
+		"org.cncf.model.total.size": strconv.FormatInt(total, 10),
+		"org.cncf.model.file.count": strconv.Itoa(len(files)),
+	}
+
+	config, err := w.writeJSONBlob(v1.MediaTypeModelConfig, struct{}{})
+	if err != nil {
+		return err
+	}
+	manifest, err := w.writeJSONBlob(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: v1.ArtifactTypeModelManifest,
+		Config:       config,
+		Layers:       w.layers,
+		Annotations:  totals,
+	})
+	if err != nil {
+		return err
+	}
+
+	name, refName := opts.Name, opts.RefName
+	if name == "" {
+		name = "aikitmodel"
+	}
+	if refName == "" {
+		refName = "latest"
+	}
+	manifest.Annotations = map[string]string{
+		ocispec.AnnotationTitle:   name,
+		ocispec.AnnotationRefName: refName,
+	}
+	for k, v := range totals {
+		manifest.Annotations[k] = v
+	}
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{manifest},
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(out, ocispec.ImageIndexFile), index, 0o644); err != nil {
+		return err
+	}
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(out, ocispec.ImageLayoutFile), layout, 0o644)
+}
+
+// copyFile copies the content of the file at src to dst.
+func copyFile(dst io.Writer, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// writeTar writes files of dir as a tar archive to dst, compressed as packMode requires.
+// Entries are named by their path, or by their base name when baseNames is true, and
+// carry the file mode with an epoch mtime and root ownership.
+func writeTar(dst io.Writer, packMode, dir string, files []packFile, baseNames bool) error {
+	cw, err := compressWriter(packMode, dst)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	for _, f := range files {
+		name := f.path
+		if baseNames {
+			name = path.Base(f.path)
+		}
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     int64(f.mode),
+			Size:     f.size,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyFile(tw, filepath.Join(dir, filepath.FromSlash(f.path))); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// compressWriter wraps w with the compressor of packMode (none for plain tar).
+func compressWriter(packMode string, w io.Writer) (io.WriteCloser, error) {
+	switch packMode {
+	case "tar+gzip":
+		return gzip.NewWriter(w), nil
+	case "tar+zstd":
+		return zstd.NewWriter(w)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// nopWriteCloser adds a no-op Close to an io.Writer.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
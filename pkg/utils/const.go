@@ -3,6 +3,7 @@ package utils // nolint:revive
 const (
 	RuntimeNVIDIA       = "cuda"
 	RuntimeAppleSilicon = "applesilicon" // experimental apple silicon runtime with vulkan arm64 support
+	RuntimeIntel        = "intel"        // experimental intel oneapi runtime with sycl support for arc and max gpus
 
 	BackendExllamaV2 = "exllama2"
 	BackendDiffusers = "diffusers"
@@ -12,6 +13,20 @@ const (
 
 	TargetUnsloth = "unsloth"
 
+	HTTPDownloaderAria2 = "aria2"
+
+	FileModePreserve = "preserve"
+
+	PromptTemplateFormatGo    = "go-template"
+	PromptTemplateFormatJinja = "jinja"
+
+	DefaultNetworkTimeout = 10 // seconds allowed to resolve and connect to a host in network build steps
+	DefaultRetries        = 3  // attempts made by network downloads before the build fails
+
+	DefaultHFEndpoint = "https://huggingface.co"
+
+	DefaultModelsPath = "/models" // directory models are copied to and LocalAI loads them from
+
 	DatasetAlpaca = "alpaca"
 
 	APIv1alpha1 = "v1alpha1"
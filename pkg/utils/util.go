@@ -3,7 +3,10 @@ package utils
 import (
 	"fmt"
 	"net/url"
+	"os"
 	"path"
+	"regexp"
+	"strings"
 
 	"github.com/moby/buildkit/client/llb"
 )
@@ -27,3 +30,63 @@ func Shf(cmd string, v ...interface{}) llb.RunOption {
 func Bashf(cmd string, v ...interface{}) llb.RunOption {
 	return llb.Args([]string{"/bin/bash", "-c", fmt.Sprintf(cmd, v...)})
 }
+
+// ShellQuote returns s wrapped in single quotes so it can be safely embedded in a shell script.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// SHA256Pattern matches a hex encoded sha256 digest without algorithm prefix.
+var SHA256Pattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// HFEndpoint returns the Hugging Face base URL without a trailing slash: endpoint when set,
+// otherwise the HF_ENDPOINT environment variable, otherwise DefaultHFEndpoint.
+func HFEndpoint(endpoint string) string {
+	if endpoint == "" {
+		endpoint = os.Getenv("HF_ENDPOINT")
+	}
+	if endpoint == "" {
+		endpoint = DefaultHFEndpoint
+	}
+	return strings.TrimRight(endpoint, "/")
+}
+
+// TimeoutFunc returns the definition of a shell function, with_timeout, that runs its
+// arguments as a command for at most seconds with timeout(1) and reports when the limit is
+// hit, together with the prefix applying it to a command. Both are empty when seconds is not
+// positive, so commands run unbounded.
+func TimeoutFunc(seconds int) (string, string) {
+	if seconds <= 0 {
+		return "", ""
+	}
+	return fmt.Sprintf(`with_timeout() {
+	status=0
+	timeout %[1]d "$@" || status=$?
+	case "$status" in
+		124|143) echo "$1 timed out after %[1]ds, raise download_timeout if the download is just slow" >&2 ;;
+	esac
+	return "$status"
+}
+`, seconds), "with_timeout "
+}
+
+// RetryFunc returns the definition of a shell function, retry, that runs its arguments as a
+// command up to attempts times, sleeping 2s, 4s, 8s, ... between failed attempts. Commands
+// wrapped in with_timeout (see TimeoutFunc) are reported by their own name.
+func RetryFunc(attempts int) string {
+	return fmt.Sprintf(`retry() {
+	attempt=1
+	cmd=$1
+	if [ "$cmd" = with_timeout ]; then cmd=$2; fi
+	until "$@"; do
+		if [ "$attempt" -ge %d ]; then
+			echo "$cmd failed after $attempt attempts" >&2
+			return 1
+		fi
+		echo "$cmd failed (attempt $attempt), retrying in $((1 << attempt))s" >&2
+		sleep $((1 << attempt))
+		attempt=$((attempt + 1))
+	done
+}
+`, attempts)
+}
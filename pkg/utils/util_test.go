@@ -1,6 +1,8 @@
 package utils // nolint:revive
 
 import (
+	"os/exec"
+	"strings"
 	"testing"
 )
 
@@ -37,3 +39,97 @@ func Test_FileNameFromURL(t *testing.T) {
 		})
 	}
 }
+
+func Test_ShellQuote(t *testing.T) {
+	for _, s := range []string{"", "plain", "it's", "$(id) `id` \"q\" \\", "a\nb"} {
+		out, err := exec.Command("sh", "-c", "printf '%s' "+ShellQuote(s)).Output()
+		if err != nil {
+			t.Fatalf("ShellQuote(%q): %v", s, err)
+		}
+		if string(out) != s {
+			t.Errorf("ShellQuote(%q) round-tripped to %q", s, out)
+		}
+	}
+}
+
+func Test_SHA256Pattern(t *testing.T) {
+	valid := strings.Repeat("a1", 32)
+	for s, want := range map[string]bool{
+		valid:                   true,
+		strings.ToUpper(valid):  false,
+		"sha256:" + valid:       false,
+		valid[:63]:              false,
+		valid + "0":             false,
+		strings.Repeat("g", 64): false,
+		"":                      false,
+	} {
+		if got := SHA256Pattern.MatchString(s); got != want {
+			t.Errorf("SHA256Pattern.MatchString(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func Test_RetryFunc(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		cmd      string
+		wantErr  bool
+		wantLog  string
+	}{
+		{name: "succeeds", attempts: 3, cmd: "true"},
+		{name: "gives up", attempts: 1, cmd: "false", wantErr: true, wantLog: "false failed after 1 attempts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := exec.Command("sh", "-c", RetryFunc(tt.attempts)+"retry "+tt.cmd).CombinedOutput()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("retry %s: err = %v, wantErr %v; output: %s", tt.cmd, err, tt.wantErr, out)
+			}
+			if !strings.Contains(string(out), tt.wantLog) {
+				t.Errorf("expected output to contain %q, got %q", tt.wantLog, out)
+			}
+		})
+	}
+}
+
+func Test_TimeoutFunc(t *testing.T) {
+	if def, prefix := TimeoutFunc(0); def != "" || prefix != "" {
+		t.Errorf("TimeoutFunc(0) = %q, %q, want no timeout", def, prefix)
+	}
+
+	def, prefix := TimeoutFunc(1)
+	if prefix != "with_timeout " {
+		t.Errorf("TimeoutFunc(1) prefix = %q, want with_timeout", prefix)
+	}
+	out, err := exec.Command("sh", "-c", def+RetryFunc(1)+"retry "+prefix+"sleep 5").CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected sleep 5 to time out, got output: %s", out)
+	}
+	for _, want := range []string{"sleep timed out after 1s", "sleep failed after 1 attempts"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected output to contain %q, got %q", want, out)
+		}
+	}
+	if out, err := exec.Command("sh", "-c", def+prefix+"true").CombinedOutput(); err != nil {
+		t.Errorf("expected a fast command to succeed, got %v: %s", err, out)
+	}
+}
+
+func Test_HFEndpoint(t *testing.T) {
+	t.Setenv("HF_ENDPOINT", "")
+	if got := HFEndpoint(""); got != DefaultHFEndpoint {
+		t.Errorf("HFEndpoint() = %q, want default %q", got, DefaultHFEndpoint)
+	}
+	if got := HFEndpoint("https://hf-mirror.com/"); got != "https://hf-mirror.com" {
+		t.Errorf("HFEndpoint() = %q, want configured mirror without trailing slash", got)
+	}
+
+	t.Setenv("HF_ENDPOINT", "https://proxy.example.com")
+	if got := HFEndpoint(""); got != "https://proxy.example.com" {
+		t.Errorf("HFEndpoint() = %q, want HF_ENDPOINT from the environment", got)
+	}
+	if got := HFEndpoint("https://hf-mirror.com"); got != "https://hf-mirror.com" {
+		t.Errorf("HFEndpoint() = %q, want configured endpoint to win over the environment", got)
+	}
+}